@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/wangfeiping/weeder/stats"
+)
+
+var ErrTooLarge = errors.New("cache entry too large")
+
+// Entry describes a cached response, the content is stored in a file
+// under the cache directory.
+type Entry struct {
+	Key    string
+	Header http.Header
+	Size   int64
+	Stored time.Time
+	Expire time.Time
+	file   string
+	elem   *list.Element
+}
+
+// Fresh reports whether the entry has not expired yet.
+func (e *Entry) Fresh() bool {
+	return time.Now().Before(e.Expire)
+}
+
+// DiskCache is a size bounded LRU cache keeping response bodies on disk.
+type DiskCache struct {
+	sync.Mutex
+	dir     string
+	maxSize int64
+	size    int64
+	seq     int64
+	lru     *list.List
+	entries map[string]*Entry
+	writers map[string]*EntryWriter
+}
+
+// EntryWriter receives the content of a new entry, the entry becomes
+// visible after Commit.
+type EntryWriter struct {
+	cache   *DiskCache
+	entry   *Entry
+	file    *os.File
+	max     int64
+	aborted bool
+	err     error
+}
+
+// Content files are named with this extension, only these files are
+// removed when the cache is created.
+const entryExt = ".cache"
+
+// NewDiskCache creates a cache in dir, content files left by a previous
+// process are removed, other files in dir are kept.
+func NewDiskCache(dir string, maxSize int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+entryExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if err = os.Remove(name); err != nil {
+			return nil, err
+		}
+	}
+	return &DiskCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*Entry),
+		writers: make(map[string]*EntryWriter),
+	}, nil
+}
+
+// Get returns the entry and an opened content file, expired entries are
+// returned as well so they can be served stale.
+func (c *DiskCache) Get(key string) (*Entry, *os.File) {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, nil
+	}
+	f, err := os.Open(e.file)
+	if err != nil {
+		c.remove(e)
+		return nil, nil
+	}
+	c.lru.MoveToFront(e.elem)
+	return e, f
+}
+
+// NewWriter starts a new entry, it returns nil if another writer of the
+// same key is in progress.
+func (c *DiskCache) NewWriter(key string, header http.Header, maxSize int64,
+	expire time.Time) *EntryWriter {
+	if maxSize <= 0 || maxSize > c.maxSize {
+		maxSize = c.maxSize
+	}
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.writers[key]; ok {
+		return nil
+	}
+	c.seq++
+	f, err := ioutil.TempFile(c.dir, fmt.Sprintf("%d-*%s", c.seq, entryExt))
+	if err != nil {
+		return nil
+	}
+	w := &EntryWriter{
+		cache: c,
+		entry: &Entry{
+			Key:    key,
+			Header: header,
+			Expire: expire,
+			file:   f.Name(),
+		},
+		file: f,
+		max:  maxSize,
+	}
+	c.writers[key] = w
+	return w
+}
+
+// Delete removes the entry and aborts the writer of the key.
+func (c *DiskCache) Delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if w, ok := c.writers[key]; ok {
+		w.aborted = true
+	}
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+}
+
+// Size returns the total size of committed entries.
+func (c *DiskCache) Size() int64 {
+	c.Lock()
+	defer c.Unlock()
+	return c.size
+}
+
+func (c *DiskCache) remove(e *Entry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.Key)
+	c.size -= e.Size
+	os.Remove(e.file)
+}
+
+func (c *DiskCache) commit(e *Entry) {
+	if old, ok := c.entries[e.Key]; ok {
+		c.remove(old)
+	}
+	e.Stored = time.Now()
+	e.elem = c.lru.PushFront(e)
+	c.entries[e.Key] = e
+	c.size += e.Size
+	for c.size > c.maxSize {
+		last := c.lru.Back()
+		if last == nil {
+			break
+		}
+		c.remove(last.Value.(*Entry))
+		stats.Incr("cache.disk.evictions")
+	}
+}
+
+func (w *EntryWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.entry.Size+int64(len(p)) > w.max {
+		w.err = ErrTooLarge
+		return 0, w.err
+	}
+	n, err := w.file.Write(p)
+	w.entry.Size += int64(n)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
+
+// Commit adds the entry to the cache unless it was aborted or deleted
+// while writing.
+func (w *EntryWriter) Commit() error {
+	c := w.cache
+	err := w.file.Close()
+	if err == nil {
+		err = w.err
+	}
+	c.Lock()
+	defer c.Unlock()
+	delete(c.writers, w.entry.Key)
+	if err == nil && w.aborted {
+		err = errors.New("cache entry invalidated")
+	}
+	if err != nil {
+		os.Remove(w.entry.file)
+		return err
+	}
+	c.commit(w.entry)
+	return nil
+}
+
+// Abort discards the entry.
+func (w *EntryWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.entry.file)
+	w.cache.Lock()
+	delete(w.cache.writers, w.entry.Key)
+	w.cache.Unlock()
+}
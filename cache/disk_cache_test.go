@@ -0,0 +1,86 @@
+package cache
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func putEntry(t *testing.T, c *DiskCache, key string, content string) {
+	w := c.NewWriter(key, http.Header{}, 0, time.Now().Add(time.Minute))
+	if w == nil {
+		t.Fatal("NewWriter returned nil: ", key)
+	}
+	w.Write([]byte(content))
+	if err := w.Commit(); err != nil {
+		t.Fatal("Commit: ", err.Error())
+	}
+}
+
+func Test_DiskCacheLru(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "weeder-cache-test")
+	c, err := NewDiskCache(filepath.Join(dir, "cache"), 10)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	putEntry(t, c, "/a", "aaaa")
+	putEntry(t, c, "/b", "bbbb")
+	if e, f := c.Get("/a"); e == nil || !e.Fresh() {
+		t.Error("Test_DiskCacheLru: /a should be cached")
+	} else {
+		bs, _ := ioutil.ReadAll(f)
+		f.Close()
+		if string(bs) != "aaaa" {
+			t.Error("Test_DiskCacheLru: content ", string(bs))
+		}
+	}
+	// /b 是最近最少使用的条目，超过容量时被淘汰
+	putEntry(t, c, "/c", "cccc")
+	if e, _ := c.Get("/b"); e != nil {
+		t.Error("Test_DiskCacheLru: /b should be evicted")
+	}
+	if c.Size() != 8 {
+		t.Error("Test_DiskCacheLru: size ", c.Size())
+	}
+}
+
+func Test_DiskCacheInvalidate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "weeder-cache-test")
+	c, _ := NewDiskCache(filepath.Join(dir, "cache"), 10)
+	w := c.NewWriter("/a", http.Header{}, 0, time.Now().Add(time.Minute))
+	if c.NewWriter("/a", http.Header{}, 0, time.Now()) != nil {
+		t.Error("Test_DiskCacheInvalidate: concurrent writer")
+	}
+	w.Write([]byte("aa"))
+	c.Delete("/a")
+	if w.Commit() == nil {
+		t.Error("Test_DiskCacheInvalidate: deleted entry committed")
+	}
+	w = c.NewWriter("/b", http.Header{}, 3, time.Now().Add(time.Minute))
+	if _, err := w.Write([]byte("bbbb")); err != ErrTooLarge {
+		t.Error("Test_DiskCacheInvalidate: max size")
+	}
+	w.Abort()
+	if e, _ := c.Get("/b"); e != nil {
+		t.Error("Test_DiskCacheInvalidate: aborted entry cached")
+	}
+}
+
+func Test_DiskCacheKeepsOtherFiles(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "weeder-cache-test")
+	c, _ := NewDiskCache(dir, 10)
+	putEntry(t, c, "/a", "aa")
+	other := filepath.Join(dir, "data.db")
+	ioutil.WriteFile(other, []byte("x"), 0644)
+	if _, err := NewDiskCache(dir, 10); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := ioutil.ReadFile(other); err != nil {
+		t.Error("Test_DiskCacheKeepsOtherFiles: other file removed")
+	}
+	if names, _ := filepath.Glob(filepath.Join(dir, "*"+entryExt)); len(names) != 0 {
+		t.Error("Test_DiskCacheKeepsOtherFiles: entries left ", names)
+	}
+}
@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wangfeiping/weeder/stats"
+)
+
+// MemoryEntry is a small response kept in memory.
+type MemoryEntry struct {
+	Key    string
+	Header http.Header
+	Body   []byte
+	Stored time.Time
+	Expire time.Time
+	elem   *list.Element
+}
+
+// MemoryCache is a size bounded LRU cache of small responses.
+type MemoryCache struct {
+	sync.Mutex
+	maxSize int64
+	size    int64
+	lru     *list.List
+	entries map[string]*MemoryEntry
+}
+
+func NewMemoryCache(maxSize int64) *MemoryCache {
+	return &MemoryCache{
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*MemoryEntry),
+	}
+}
+
+// Get returns the entry of key, expired entries are removed.
+func (c *MemoryCache) Get(key string) *MemoryEntry {
+	c.Lock()
+	defer c.Unlock()
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if !time.Now().Before(e.Expire) {
+		c.remove(e)
+		return nil
+	}
+	c.lru.MoveToFront(e.elem)
+	return e
+}
+
+// Put adds or replaces the entry of key, the body must not be modified
+// afterwards.
+func (c *MemoryCache) Put(key string, header http.Header, body []byte,
+	expire time.Time) {
+	if int64(len(body)) > c.maxSize {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	if old, ok := c.entries[key]; ok {
+		c.remove(old)
+	}
+	e := &MemoryEntry{
+		Key:    key,
+		Header: header,
+		Body:   body,
+		Stored: time.Now(),
+		Expire: expire,
+	}
+	e.elem = c.lru.PushFront(e)
+	c.entries[key] = e
+	c.size += int64(len(body))
+	for c.size > c.maxSize {
+		last := c.lru.Back()
+		if last == nil {
+			break
+		}
+		c.remove(last.Value.(*MemoryEntry))
+		stats.Incr("cache.memory.evictions")
+	}
+}
+
+func (c *MemoryCache) Delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+	if e, ok := c.entries[key]; ok {
+		c.remove(e)
+	}
+}
+
+// DeletePrefix removes all entries whose key starts with prefix.
+func (c *MemoryCache) DeletePrefix(prefix string) {
+	c.Lock()
+	defer c.Unlock()
+	for key, e := range c.entries {
+		if strings.HasPrefix(key, prefix) {
+			c.remove(e)
+		}
+	}
+}
+
+func (c *MemoryCache) remove(e *MemoryEntry) {
+	c.lru.Remove(e.elem)
+	delete(c.entries, e.Key)
+	c.size -= int64(len(e.Body))
+}
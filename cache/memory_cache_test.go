@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_MemoryCache(t *testing.T) {
+	c := NewMemoryCache(8)
+	expire := time.Now().Add(time.Minute)
+	c.Put("/a", http.Header{}, []byte("aaaa"), expire)
+	c.Put("/b", http.Header{}, []byte("bbbb"), expire)
+	if e := c.Get("/a"); e == nil || string(e.Body) != "aaaa" {
+		t.Error("Test_MemoryCache: /a should be cached")
+	}
+	c.Put("/c", http.Header{}, []byte("cccc"), expire)
+	if c.Get("/b") != nil {
+		t.Error("Test_MemoryCache: /b should be evicted")
+	}
+	c.Put("/d", http.Header{}, []byte("ddddddddd"), expire)
+	if c.Get("/d") != nil {
+		t.Error("Test_MemoryCache: /d is larger than the cache")
+	}
+	c.Put("/e", http.Header{}, []byte("e"), time.Now().Add(-time.Second))
+	if c.Get("/e") != nil {
+		t.Error("Test_MemoryCache: /e is expired")
+	}
+	c.Delete("/a")
+	if c.Get("/a") != nil {
+		t.Error("Test_MemoryCache: /a is deleted")
+	}
+}
+
+func Test_MemoryCacheDeletePrefix(t *testing.T) {
+	c := NewMemoryCache(64)
+	expire := time.Now().Add(time.Minute)
+	c.Put("/a.jpg?w=10", http.Header{}, []byte("a"), expire)
+	c.Put("/a.jpg?w=20", http.Header{}, []byte("b"), expire)
+	c.Put("/ab.jpg?w=10", http.Header{}, []byte("c"), expire)
+	c.DeletePrefix("/a.jpg?")
+	if c.Get("/a.jpg?w=10") != nil || c.Get("/a.jpg?w=20") != nil {
+		t.Error("Test_MemoryCacheDeletePrefix: not deleted")
+	}
+	if c.Get("/ab.jpg?w=10") == nil {
+		t.Error("Test_MemoryCacheDeletePrefix: deleted too much")
+	}
+}
@@ -0,0 +1,239 @@
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+)
+
+const (
+	ModeFit  = "fit"
+	ModeFill = "fill"
+	ModeCrop = "crop"
+
+	DefaultQuality = 85
+)
+
+var ErrUnsupportedFormat = errors.New("unsupported image format")
+var ErrTooManyPixels = errors.New("image is too large")
+
+// Options describes the requested output, a zero Width or Height keeps
+// the aspect ratio of the source image.
+type Options struct {
+	Width     int
+	Height    int
+	Mode      string
+	Quality   int
+	MaxPixels int
+}
+
+// Transform decodes a JPEG, PNG or GIF image, resizes or crops it and
+// encodes the result in the source format. It returns the encoded image
+// and its content type.
+func Transform(data []byte, opt *Options) ([]byte, string, error) {
+	src, format, err := Decode(data, opt.MaxPixels)
+	if err != nil {
+		return nil, "", err
+	}
+	return Encode(Process(src, opt), format, opt.Quality)
+}
+
+// Decode decodes a JPEG, PNG or GIF image, images with more than
+// maxPixels pixels are rejected before decoding.
+func Decode(data []byte, maxPixels int) (image.Image, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", ErrUnsupportedFormat
+	}
+	if maxPixels > 0 && config.Width*config.Height > maxPixels {
+		return nil, "", ErrTooManyPixels
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", err
+	}
+	return img, format, nil
+}
+
+// Encode encodes img in format ("jpeg", "png" or "gif") and returns the
+// content type, quality only applies to JPEG.
+func Encode(img image.Image, format string, quality int) ([]byte, string, error) {
+	buf := new(bytes.Buffer)
+	var mtype string
+	var err error
+	switch format {
+	case "jpeg":
+		if quality <= 0 || quality > 100 {
+			quality = DefaultQuality
+		}
+		mtype = "image/jpeg"
+		err = jpeg.Encode(buf, img, &jpeg.Options{Quality: quality})
+	case "png":
+		mtype = "image/png"
+		err = png.Encode(buf, img)
+	case "gif":
+		mtype = "image/gif"
+		err = gif.Encode(buf, img, nil)
+	default:
+		return nil, "", ErrUnsupportedFormat
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), mtype, nil
+}
+
+// Process resizes or crops img according to opt.Mode.
+func Process(img image.Image, opt *Options) image.Image {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	w, h := opt.Width, opt.Height
+	if sw == 0 || sh == 0 || (w <= 0 && h <= 0) {
+		return img
+	}
+	switch {
+	case opt.Mode == ModeCrop && w > 0 && h > 0:
+		return crop(img, w, h)
+	case opt.Mode == ModeFill && w > 0 && h > 0:
+		scale := math.Max(float64(w)/float64(sw), float64(h)/float64(sh))
+		rw := int(math.Ceil(float64(sw) * scale))
+		rh := int(math.Ceil(float64(sh) * scale))
+		return crop(Resize(img, rw, rh), w, h)
+	}
+	// fit：等比缩放到w*h 范围内，不放大原图
+	scale := 1.0
+	if w > 0 {
+		scale = float64(w) / float64(sw)
+	}
+	if h > 0 && (w <= 0 || float64(h)/float64(sh) < scale) {
+		scale = float64(h) / float64(sh)
+	}
+	if scale >= 1 {
+		return img
+	}
+	return Resize(img, int(math.Max(1, math.Round(float64(sw)*scale))),
+		int(math.Max(1, math.Round(float64(sh)*scale))))
+}
+
+// crop cuts a w*h area from the center of img.
+func crop(img image.Image, w, h int) image.Image {
+	b := img.Bounds()
+	if w > b.Dx() {
+		w = b.Dx()
+	}
+	if h > b.Dy() {
+		h = b.Dy()
+	}
+	x := b.Min.X + (b.Dx()-w)/2
+	y := b.Min.Y + (b.Dy()-h)/2
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(dst, dst.Bounds(), img, image.Pt(x, y), draw.Src)
+	return dst
+}
+
+type contrib struct {
+	index  int
+	weight float64
+}
+
+// weights maps each of dn destination pixels to the source pixels it
+// covers, area averaging is used for downscaling and linear
+// interpolation for upscaling.
+func weights(sn, dn int) [][]contrib {
+	scale := float64(sn) / float64(dn)
+	ret := make([][]contrib, dn)
+	for i := range ret {
+		var cs []contrib
+		if scale >= 1 {
+			start := float64(i) * scale
+			end := start + scale
+			for j := int(start); j < sn && float64(j) < end; j++ {
+				wt := math.Min(end, float64(j+1)) - math.Max(start, float64(j))
+				if wt > 0 {
+					cs = append(cs, contrib{j, wt})
+				}
+			}
+		} else {
+			c := (float64(i)+0.5)*scale - 0.5
+			j := int(math.Floor(c))
+			f := c - float64(j)
+			j0, j1 := j, j+1
+			if j0 < 0 {
+				j0 = 0
+			}
+			if j1 > sn-1 {
+				j1 = sn - 1
+			}
+			cs = []contrib{{j0, 1 - f}, {j1, f}}
+		}
+		sum := 0.0
+		for _, c := range cs {
+			sum += c.weight
+		}
+		for k := range cs {
+			cs[k].weight /= sum
+		}
+		ret[i] = cs
+	}
+	return ret
+}
+
+// Resize scales img to w*h using premultiplied RGBA pixels.
+func Resize(img image.Image, w, h int) *image.RGBA {
+	b := img.Bounds()
+	src := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	sw, sh := b.Dx(), b.Dy()
+
+	// 先水平缩放，再垂直缩放
+	tmp := make([]float64, w*sh*4)
+	xw := weights(sw, w)
+	for y := 0; y < sh; y++ {
+		row := src.Pix[y*src.Stride:]
+		for x, cs := range xw {
+			o := (y*w + x) * 4
+			for _, c := range cs {
+				p := row[c.index*4:]
+				tmp[o] += float64(p[0]) * c.weight
+				tmp[o+1] += float64(p[1]) * c.weight
+				tmp[o+2] += float64(p[2]) * c.weight
+				tmp[o+3] += float64(p[3]) * c.weight
+			}
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	yw := weights(sh, h)
+	for y, cs := range yw {
+		for x := 0; x < w; x++ {
+			var px [4]float64
+			for _, c := range cs {
+				o := (c.index*w + x) * 4
+				px[0] += tmp[o] * c.weight
+				px[1] += tmp[o+1] * c.weight
+				px[2] += tmp[o+2] * c.weight
+				px[3] += tmp[o+3] * c.weight
+			}
+			d := dst.Pix[y*dst.Stride+x*4:]
+			for k := 0; k < 4; k++ {
+				d[k] = clampUint8(px[k])
+			}
+		}
+	}
+	return dst
+}
+
+func clampUint8(v float64) uint8 {
+	v = math.Round(v)
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
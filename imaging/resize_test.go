@@ -0,0 +1,94 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func testImage(w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	buf := new(bytes.Buffer)
+	png.Encode(buf, img)
+	return buf.Bytes()
+}
+
+func decodedSize(t *testing.T, data []byte) (int, int) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return img.Bounds().Dx(), img.Bounds().Dy()
+}
+
+func Test_TransformModes(t *testing.T) {
+	src := testImage(200, 100)
+	cases := []struct {
+		opt  Options
+		w, h int
+	}{
+		{Options{Width: 100, Mode: ModeFit}, 100, 50},
+		{Options{Width: 100, Height: 100, Mode: ModeFit}, 100, 50},
+		{Options{Height: 20}, 40, 20},
+		{Options{Width: 400, Mode: ModeFit}, 200, 100},
+		{Options{Width: 50, Height: 50, Mode: ModeFill}, 50, 50},
+		{Options{Width: 30, Height: 60, Mode: ModeCrop}, 30, 60},
+		{Options{Width: 300, Height: 60, Mode: ModeCrop}, 200, 60},
+	}
+	for _, c := range cases {
+		out, mtype, err := Transform(src, &c.opt)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if mtype != "image/png" {
+			t.Error("Test_TransformModes mime: ", mtype)
+		}
+		if w, h := decodedSize(t, out); w != c.w || h != c.h {
+			t.Error("Test_TransformModes ", c.opt, ": ", w, "x", h)
+		}
+	}
+}
+
+func Test_TransformLimits(t *testing.T) {
+	if _, _, err := Transform([]byte("not an image"), &Options{Width: 10}); err != ErrUnsupportedFormat {
+		t.Error("Test_TransformLimits: format")
+	}
+	_, _, err := Transform(testImage(200, 100), &Options{Width: 10, MaxPixels: 100})
+	if err != ErrTooManyPixels {
+		t.Error("Test_TransformLimits: pixels")
+	}
+}
+
+func Test_ResizeColor(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 4, 4))
+	for i := range img.Pix {
+		img.Pix[i] = 200
+	}
+	dst := Resize(img, 2, 2)
+	for _, v := range dst.Pix {
+		if v != 200 {
+			t.Fatal("Test_ResizeColor: ", v)
+		}
+	}
+}
+
+func Test_DecodeEncode(t *testing.T) {
+	img, format, err := Decode(testImage(20, 10), 0)
+	if err != nil || format != "png" {
+		t.Fatal("Test_DecodeEncode: ", format, err)
+	}
+	out, mtype, err := Encode(Process(img, &Options{Width: 10}), "jpeg", 60)
+	if err != nil || mtype != "image/jpeg" {
+		t.Fatal("Test_DecodeEncode: ", mtype, err)
+	}
+	if w, h := decodedSize(t, out); w != 10 || h != 5 {
+		t.Error("Test_DecodeEncode: ", w, "x", h)
+	}
+}
@@ -23,13 +23,25 @@ type LogHeader struct {
 }
 
 type FileMeta struct {
-	Name      string `json:"fileName,omitempty"`
-	Fid       string `json:"fid,omitempty"`
-	Url       string `json:"fileUrl,omitempty"`
-	Size      int    `json:"size,omitempty"`
-	PublicUrl string `json:"publicUrl,omitempty"`
-	Count     uint64 `json:"count,omitempty"`
-	Error     string `json:"error,omitempty"`
+	Name        string        `json:"fileName,omitempty"`
+	Fid         string        `json:"fid,omitempty"`
+	Url         string        `json:"fileUrl,omitempty"`
+	Size        int           `json:"size,omitempty"`
+	PublicUrl   string        `json:"publicUrl,omitempty"`
+	Count       uint64        `json:"count,omitempty"`
+	Md5         string        `json:"md5,omitempty"`
+	Sha256      string        `json:"sha256,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	Derivatives []*Derivative `json:"derivatives,omitempty"`
+}
+
+// 上传时生成的衍生图片
+type Derivative struct {
+	Name  string `json:"name"`
+	Path  string `json:"path"`
+	Fid   string `json:"fid,omitempty"`
+	Size  int    `json:"size,omitempty"`
+	Error string `json:"error,omitempty"`
 }
 
 type ApiResult struct {
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+	"github.com/wangfeiping/weeder/util"
+)
+
+type autoChunker struct {
+	threshold   int64
+	chunkSize   int64
+	concurrency int
+}
+
+var autoChunk *autoChunker
+
+func initAutoChunk(ps *ProxyServer) {
+	c := &ps.Config.AutoChunk
+	log.DebugS("main", "config: autoChunk ", c.Enable)
+	if !c.Enable {
+		return
+	}
+	if c.ChunkSize <= 0 {
+		c.ChunkSize = 8 << 20
+	}
+	if c.Threshold <= 0 {
+		c.Threshold = 32 << 20
+	}
+	if c.Threshold < c.ChunkSize {
+		c.Threshold = c.ChunkSize
+	}
+	if c.Concurrency <= 0 {
+		c.Concurrency = 4
+	}
+	autoChunk = &autoChunker{
+		threshold:   c.Threshold,
+		chunkSize:   c.ChunkSize,
+		concurrency: c.Concurrency,
+	}
+	log.DebugS("main", "config: autoChunk threshold ", c.Threshold,
+		" chunkSize ", c.ChunkSize, " concurrency ", c.Concurrency)
+}
+
+/**
+ * 判断文件是否需要分片上传：大小已知时直接比较，
+ * 未知时先读取threshold+1 字节，返回的reader 包含已读取的内容
+ */
+func (c *autoChunker) detect(src io.Reader, size int64) (io.Reader, bool, error) {
+	if size >= 0 {
+		return src, size > c.threshold, nil
+	}
+	head := new(bytes.Buffer)
+	_, err := io.CopyN(head, src, c.threshold+1)
+	if err == io.EOF {
+		return head, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return io.MultiReader(head, src), true, nil
+}
+
+/**
+ * 按chunkSize 顺序读取文件内容并行上传各分片，全部成功后上传chunks manifest，
+ * path 不为空时注册filer 路径；失败时删除已上传的分片
+ */
+func (ps *ProxyServer) autoChunkUpload(src io.Reader, name string, mtype string,
+	ttl string, path string, placement *util.Placement,
+	logHeader *log.LogHeader) (*log.FileMeta, error) {
+	if mtype == "" {
+		mtype = mimeTypes.ByFilename(name)
+	}
+	manifest := &util.ChunkManifest{Name: name, Mime: mtype}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	var failed error
+	// 同时上传的分片数，也限制了分片缓冲区占用的内存
+	sem := make(chan struct{}, autoChunk.concurrency)
+	for index := 0; ; index++ {
+		sem <- struct{}{}
+		lock.Lock()
+		stop := failed != nil
+		lock.Unlock()
+		if stop {
+			<-sem
+			break
+		}
+		data := make([]byte, autoChunk.chunkSize)
+		n, err := io.ReadFull(src, data)
+		if n > 0 {
+			chunk := &util.ChunkInfo{Offset: manifest.Size, Size: int64(n)}
+			manifest.Size += int64(n)
+			manifest.Chunks = append(manifest.Chunks, chunk)
+			wg.Add(1)
+			go func(index int, data []byte) {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+				fid, e := ps.uploadAutoChunk(name, index, ttl, placement, data, logHeader)
+				lock.Lock()
+				chunk.Fid = fid
+				if e != nil && failed == nil {
+					failed = e
+				}
+				lock.Unlock()
+			}(index, data[:n])
+		} else {
+			<-sem
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			lock.Lock()
+			if failed == nil {
+				failed = err
+			}
+			lock.Unlock()
+			break
+		}
+	}
+	wg.Wait()
+	var assigned *AssignResult
+	err := failed
+	if err == nil {
+		var bs []byte
+		if err = manifest.Validate(); err == nil {
+			bs, err = manifest.Marshal()
+		}
+		if err == nil {
+			assigned, err = ps.registerChunkManifest(bytes.NewReader(bs),
+				name, path, ttl, placement, logHeader)
+		}
+	}
+	if err != nil {
+		stats.Incr("autoChunk.errors")
+		log.Error(logHeader, "chunked upload error: ", name, " ", err.Error())
+		var fids []string
+		for _, chunk := range manifest.Chunks {
+			if chunk.Fid != "" {
+				fids = append(fids, chunk.Fid)
+			}
+		}
+		ps.deleteFids(fids, logHeader)
+		return nil, err
+	}
+	stats.Incr("autoChunk.files")
+	stats.Add("autoChunk.chunks", int64(len(manifest.Chunks)))
+	log.Debug(logHeader, "chunked upload: ", name, " ", manifest.Size,
+		" bytes, ", len(manifest.Chunks), " chunks -> ", assigned.Fid)
+	return &log.FileMeta{
+		Name:      name,
+		Fid:       assigned.Fid,
+		PublicUrl: assigned.PublicUrl,
+		Size:      int(manifest.Size),
+	}, nil
+}
+
+// 分片内容保存在内存中，失败时可以重试
+func (ps *ProxyServer) uploadAutoChunk(name string, index int, ttl string,
+	placement *util.Placement, data []byte, logHeader *log.LogHeader) (string, error) {
+	chunkName := fmt.Sprintf("%s.%d", name, index)
+	var err error
+	for retry := int32(0); retry <= ps.Config.Retry; retry++ {
+		var assigned *AssignResult
+		assigned, err = ps.uploadChunkContent(chunkName, ttl, placement,
+			bytes.NewReader(data), logHeader)
+		if err == nil {
+			return assigned.Fid, nil
+		}
+		log.Error(logHeader, "chunk upload error: ", chunkName,
+			" retry ", retry, " ", err.Error())
+	}
+	return "", err
+}
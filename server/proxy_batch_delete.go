@@ -0,0 +1,247 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+)
+
+// 批量删除中因之前的删除失败而未执行的文件
+var ErrBatchDeleteSkipped = errors.New("Skipped after an earlier error.")
+
+type BatchDeleteRequest struct {
+	Fids        []string `json:"fids"`
+	Paths       []string `json:"paths"`
+	StopOnError bool     `json:"stopOnError"` // 有文件删除失败时不再删除之后的文件
+}
+
+type BatchDeleteItem struct {
+	Fid    string `json:"fid,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// 与ApiResult 相同的格式，result 为每个文件的删除结果
+type BatchDeleteResult struct {
+	Result  []*BatchDeleteItem `json:"result"`
+	Message string             `json:"message"`
+	Status  int                `json:"status"`
+	Detail  string             `json:"detail,omitempty"`
+}
+
+var batchDeleteMaxItems = 1000
+var batchDeleteConcurrency = 8
+var dirDeleteMaxFiles = 10000
+
+func initBatchDelete(ps *ProxyServer) {
+	c := &ps.Config.BatchDelete
+	if c.MaxItems > 0 {
+		batchDeleteMaxItems = c.MaxItems
+	}
+	if c.Concurrency > 0 {
+		batchDeleteConcurrency = c.Concurrency
+	}
+	if c.MaxDirFiles > 0 {
+		dirDeleteMaxFiles = c.MaxDirFiles
+	}
+	log.DebugS("main", "config: batchDelete maxItems ", batchDeleteMaxItems,
+		" concurrency ", batchDeleteConcurrency, " maxDirFiles ", dirDeleteMaxFiles)
+}
+
+/**
+ * 批量删除fid 与filer 路径：
+ *	POST /delete/batch
+ *	{"fids":["3,01637037d6"],"paths":["/app/a.jpg"],"stopOnError":false}
+ * 全部删除成功时返回200，否则返回207，每个文件的结果见result
+ */
+func (ps *ProxyServer) batchDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	logHeader := &log.LogHeader{
+		TraceId:    checkGid(r),
+		Caddress:   checkRealIp(r),
+		UserId:     checkUniSource(r),
+		Key:        "request",
+		ThreadName: r.URL.Path,
+		ClassName:  "batch_delete",
+		MethodName: r.Method,
+	}
+	log.Info(logHeader, `{"uri":"`, r.RequestURI, `"}`)
+	logHeader.Key = "response"
+	ret := &BatchDeleteResult{
+		Result:  make([]*BatchDeleteItem, 0, 0),
+		Message: "error",
+	}
+	if !strings.EqualFold(r.Method, "post") {
+		ret.Status = http.StatusMethodNotAllowed
+		ret.Detail = "Only delete via POST!"
+		writeBatchDeleteResult(w, ret, logHeader)
+		return
+	}
+	if ps.Config.UniSourceCheck && logHeader.UserId == "" {
+		ret.Status = http.StatusNotAcceptable
+		ret.Detail = "It's not allowed to delete without Uni-Source header."
+		writeBatchDeleteResult(w, ret, logHeader)
+		return
+	}
+	if ip, ok := ps.isWritable(r.RemoteAddr); !ok {
+		ret.Status = http.StatusNotAcceptable
+		ret.Detail = fmt.Sprintf("It's not allowed to delete by whitelist (%s).", ip)
+		writeBatchDeleteResult(w, ret, logHeader)
+		return
+	}
+	var req BatchDeleteRequest
+	body := http.MaxBytesReader(w, r.Body, int64(batchDeleteMaxItems)*1024)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		ret.Status = http.StatusBadRequest
+		ret.Detail = "Bad request, " + err.Error()
+		writeBatchDeleteResult(w, ret, logHeader)
+		return
+	}
+	count := len(req.Fids) + len(req.Paths)
+	if count == 0 || count > batchDeleteMaxItems {
+		ret.Status = http.StatusBadRequest
+		ret.Detail = fmt.Sprintf("Bad request, the number of files must be 1 to %d!",
+			batchDeleteMaxItems)
+		writeBatchDeleteResult(w, ret, logHeader)
+		return
+	}
+	stats.Incr("batchDelete.requests")
+	ret.Result = ps.batchDelete(&req, logHeader)
+	ret.Status = http.StatusOK
+	ret.Message = "ok"
+	for _, item := range ret.Result {
+		if item.Status != http.StatusOK {
+			ret.Status = http.StatusMultiStatus
+			ret.Message = "error"
+			break
+		}
+	}
+	writeBatchDeleteResult(w, ret, logHeader)
+}
+
+func (ps *ProxyServer) batchDelete(req *BatchDeleteRequest,
+	logHeader *log.LogHeader) []*BatchDeleteItem {
+	items := make([]*BatchDeleteItem, 0, len(req.Fids)+len(req.Paths))
+	for _, fid := range req.Fids {
+		items = append(items, &BatchDeleteItem{Fid: fid})
+	}
+	for _, path := range req.Paths {
+		items = append(items, &BatchDeleteItem{Path: path})
+	}
+	failed := ps.deleteItems(items, req.StopOnError, nil, logHeader)
+	stats.Add("batchDelete.items", int64(len(items)))
+	stats.Add("batchDelete.errors", int64(failed))
+	return items
+}
+
+/**
+ * 按顺序删除，同时最多删除batchDeleteConcurrency 个文件，返回失败的数量；
+ * stopOnError 时已开始的删除继续执行，之后的文件返回424；
+ * done 不为nil 时每个文件处理完成后调用，可能被并发调用
+ */
+func (ps *ProxyServer) deleteItems(items []*BatchDeleteItem, stopOnError bool,
+	done func(*BatchDeleteItem), logHeader *log.LogHeader) int {
+	var failed int32
+	next := make(chan *BatchDeleteItem)
+	var wg sync.WaitGroup
+	for i := 0; i < batchDeleteConcurrency && i < len(items); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range next {
+				if stopOnError && atomic.LoadInt32(&failed) > 0 {
+					item.Status = http.StatusFailedDependency
+					item.Detail = ErrBatchDeleteSkipped.Error()
+				} else {
+					ps.batchDeleteItem(item, logHeader)
+				}
+				if item.Status != http.StatusOK {
+					atomic.AddInt32(&failed, 1)
+				}
+				if done != nil {
+					done(item)
+				}
+			}
+		}()
+	}
+	for _, item := range items {
+		next <- item
+	}
+	close(next)
+	wg.Wait()
+	return int(failed)
+}
+
+func (ps *ProxyServer) batchDeleteItem(item *BatchDeleteItem,
+	parent *log.LogHeader) {
+	uri, isFiler := item.Path, true
+	if item.Fid != "" {
+		uri, isFiler = "/"+strings.TrimPrefix(item.Fid, "/"), false
+	}
+	if !validBatchDeleteUri(uri, isFiler) {
+		item.Status = http.StatusBadRequest
+		item.Detail = "Bad request, invalid fid or path!"
+		return
+	}
+	// 每个文件使用单独的日志头，并发删除时不互相覆盖
+	logHeader := *parent
+	logHeader.ThreadName = uri
+	status, err := ps.removeFile(uri, isFiler, &logHeader)
+	item.Status = status
+	if err != nil {
+		item.Detail = err.Error()
+		log.Error(&logHeader, "batch delete error: ", uri, " ", err.Error())
+		return
+	}
+	log.Debug(&logHeader, "batch delete: ", uri)
+}
+
+// fid 不包含'/'；filer 路径不能是目录，也不能是根路径下的文件，必须是规范的路径
+func validBatchDeleteUri(uri string, isFiler bool) bool {
+	if !isFiler {
+		return len(uri) > 1 && fidChecker.MatchString(uri)
+	}
+	return strings.HasPrefix(uri, "/") && !strings.HasSuffix(uri, "/") &&
+		strings.LastIndex(uri, "/") > 0 && !hasDotSegment(uri) &&
+		path.Clean(uri) == uri
+}
+
+// 路径中是否包含. 或.. ，包含时路径保护规则的检查可能被绕过
+func hasDotSegment(p string) bool {
+	for _, seg := range strings.Split(p, "/") {
+		if seg == "." || seg == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+func writeBatchDeleteResult(w http.ResponseWriter, ret *BatchDeleteResult,
+	logHeader *log.LogHeader) {
+	bs, err := json.Marshal(ret)
+	if err != nil {
+		logHeader.Status = "err"
+		log.Error(logHeader, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(ret.Status)
+	w.Write(bs)
+	w.Write([]byte("\n"))
+	if ret.Status == http.StatusOK {
+		logHeader.Status = "ok"
+		log.Info(logHeader, `{"message":"ok","count":`, len(ret.Result), `}`)
+	} else {
+		logHeader.Status = "err"
+		log.Error(logHeader, string(bs))
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func doTestBatchDelete(ps *ProxyServer, body string) (int, *BatchDeleteResult) {
+	r := httptest.NewRequest("POST", "/delete/batch", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	ps.batchDeleteHandler(w, r)
+	ret := &BatchDeleteResult{}
+	json.Unmarshal(w.Body.Bytes(), ret)
+	return w.Code, ret
+}
+
+func Test_BatchDelete(t *testing.T) {
+	weed := newFakeWeed()
+	defer weed.Close()
+	ps := newTestProxy(weed)
+	weed.put("/app/100%.txt", "a")
+	weed.put("/app/a?b", "b")
+	weed.put("/app/a", "c")
+	weed.put("/3,01637037d6", "d")
+
+	code, ret := doTestBatchDelete(ps, `{"fids":["3,01637037d6"],`+
+		`"paths":["/app/100%.txt","/app/a?b","/app/../a"]}`)
+	if code != http.StatusMultiStatus || len(ret.Result) != 4 {
+		t.Fatal("Test_BatchDelete: ", code, " ", ret.Detail)
+	}
+	for i, status := range []int{200, 200, 200, 400} {
+		if ret.Result[i].Status != status {
+			t.Error("Test_BatchDelete: ", i, " ", ret.Result[i].Status)
+		}
+	}
+	for _, path := range []string{"/3,01637037d6", "/app/100%.txt", "/app/a?b"} {
+		if _, ok := weed.get(path); ok {
+			t.Error("Test_BatchDelete: not deleted ", path)
+		}
+	}
+	if _, ok := weed.get("/app/a"); !ok {
+		t.Error("Test_BatchDelete: /app/a is deleted")
+	}
+}
+
+func Test_BatchDeleteStopOnError(t *testing.T) {
+	weed := newFakeWeed()
+	defer weed.Close()
+	ps := newTestProxy(weed)
+	batchDeleteConcurrency = 1
+	defer func() { batchDeleteConcurrency = 8 }()
+	weed.put("/app/b.txt", "b")
+
+	_, ret := doTestBatchDelete(ps,
+		`{"paths":["/app/","/app/b.txt"],"stopOnError":true}`)
+	if ret.Result[0].Status != http.StatusBadRequest ||
+		ret.Result[1].Status != http.StatusFailedDependency {
+		t.Error("Test_BatchDeleteStopOnError: ", ret.Result[0].Status,
+			" ", ret.Result[1].Status)
+	}
+	if _, ok := weed.get("/app/b.txt"); !ok {
+		t.Error("Test_BatchDeleteStopOnError: b.txt is deleted")
+	}
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wangfeiping/weeder/cache"
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+)
+
+/**
+ * 合并相同文件的并发读取请求：
+ * 第一个请求从seaweedfs 获取文件，响应内容写入共享缓冲区，
+ * 所有等待的客户端（包括第一个请求）从缓冲区读取响应。
+ */
+type requestCoalescer struct {
+	sync.Mutex
+	maxSize int64
+	flights map[string]*flight
+}
+
+type flight struct {
+	sync.Mutex
+	cond    *sync.Cond
+	key     string
+	header  http.Header
+	status  int
+	started bool
+	body    []byte
+	done    bool
+	err     error
+	// 大小未知或超过maxSize 的响应不缓冲，通过pipe 直接写给第一个请求的客户端，
+	// 其它等待的客户端各自获取文件
+	passThrough bool
+	pr          *io.PipeReader
+	pw          *io.PipeWriter
+	// 等待的客户端数量，由coalescer 的锁保护，全部离开时取消获取
+	waiters int
+	cancel  context.CancelFunc
+}
+
+// 不合并的请求，由客户端各自获取文件
+var errCoalesceBypass = errors.New("coalesce bypassed")
+
+// 从seaweedfs 获取文件时使用的ResponseWriter，写入内容保存到flight 缓冲区
+type flightWriter struct {
+	f           *flight
+	header      http.Header
+	wroteHeader bool
+}
+
+var coalescer *requestCoalescer
+var memoryCache *cache.MemoryCache
+
+func initCoalesce(ps *ProxyServer) {
+	c := &ps.Config.Coalesce
+	log.DebugS("main", "config: coalesce ", c.Enable)
+	if !c.Enable {
+		return
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = 16 << 20
+	}
+	if c.MemoryCacheObjectSize <= 0 {
+		c.MemoryCacheObjectSize = 64 << 10
+	}
+	if c.MemoryCacheTtl <= 0 {
+		c.MemoryCacheTtl = 60
+	}
+	coalescer = &requestCoalescer{
+		maxSize: c.MaxSize,
+		flights: make(map[string]*flight),
+	}
+	if c.MemoryCacheSize > 0 {
+		memoryCache = cache.NewMemoryCache(c.MemoryCacheSize)
+	}
+	log.DebugS("main", "config: coalesce maxSize ", c.MaxSize,
+		" memoryCacheSize ", c.MemoryCacheSize,
+		" memoryCacheObjectSize ", c.MemoryCacheObjectSize,
+		" memoryCacheTtl ", c.MemoryCacheTtl)
+}
+
+/**
+ * 只合并不带查询参数、Range 及条件请求头的GET 请求，
+ * 这些请求的响应内容完全相同
+ */
+func (ps *ProxyServer) coalescable(r *http.Request) bool {
+	if !strings.EqualFold(r.Method, "get") || r.URL.RawQuery != "" {
+		return false
+	}
+	for _, k := range forwardedDownloadHeaders {
+		if r.Header.Get(k) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+func (ps *ProxyServer) coalescedDownload(w http.ResponseWriter, r *http.Request,
+	isFiler bool, logHeader *log.LogHeader) error {
+	key := r.URL.Path
+	if memoryCache != nil {
+		if e := memoryCache.Get(key); e != nil {
+			stats.Incr("cache.memory.hits")
+			ps.writeResponseHeader(e.Header, w, r)
+			w.Header().Del("Content-Length")
+			w.Header().Set("X-Cache", "HIT")
+			cw := newCompressWriter(w, r)
+			defer cw.Close()
+			http.ServeContent(cw, r, "", e.Stored, bytes.NewReader(e.Body))
+			return nil
+		}
+		stats.Incr("cache.memory.misses")
+	}
+	var ctx context.Context
+	coalescer.Lock()
+	f, ok := coalescer.flights[key]
+	if !ok {
+		f = &flight{key: key}
+		f.cond = sync.NewCond(f)
+		f.pr, f.pw = io.Pipe()
+		ctx, f.cancel = context.WithCancel(context.Background())
+		coalescer.flights[key] = f
+	}
+	f.waiters++
+	coalescer.Unlock()
+	if ok {
+		stats.Incr("coalesce.followers")
+		log.Debug(logHeader, "coalesced: ", key)
+	} else {
+		stats.Incr("coalesce.leaders")
+		leaderHeader := *logHeader
+		// 第一个请求的客户端断开后仍需完成获取，供其它等待的客户端使用，
+		// 所有客户端都离开后取消获取；共享的响应内容不压缩，写给各客户端时再压缩
+		lr := r.WithContext(ctx)
+		lr.Header = r.Header.Clone()
+		lr.Header.Del("Accept-Encoding")
+		go ps.fly(f, lr, isFiler, &leaderHeader)
+	}
+	cw := newCompressWriter(w, r)
+	err := f.serve(cw, r, !ok)
+	f.leave(!ok)
+	if e := cw.Close(); e != nil && err == nil {
+		err = &writtenError{err: e}
+	}
+	if err == errCoalesceBypass {
+		stats.Incr("coalesce.bypassed")
+		return ps.downloadWithRetry(w, r, isFiler, logHeader)
+	}
+	return err
+}
+
+// 客户端离开，第一个请求的客户端离开后不再接收直接写出的响应
+func (f *flight) leave(leader bool) {
+	if leader {
+		f.pr.Close()
+	}
+	coalescer.Lock()
+	f.waiters--
+	last := f.waiters == 0
+	if last && coalescer.flights[f.key] == f {
+		delete(coalescer.flights, f.key)
+	}
+	coalescer.Unlock()
+	if last {
+		f.cancel()
+	}
+}
+
+func (ps *ProxyServer) fly(f *flight, r *http.Request, isFiler bool,
+	logHeader *log.LogHeader) {
+	fw := &flightWriter{f: f, header: make(http.Header)}
+	err := ps.downloadWithRetry(fw, r, isFiler, logHeader)
+	f.pw.CloseWithError(err)
+	coalescer.Lock()
+	if coalescer.flights[f.key] == f {
+		delete(coalescer.flights, f.key)
+	}
+	coalescer.Unlock()
+	f.Lock()
+	f.done = true
+	f.err = err
+	f.cond.Broadcast()
+	f.Unlock()
+	if err != nil || memoryCache == nil || f.status != http.StatusOK || f.passThrough ||
+		int64(len(f.body)) > ps.Config.Coalesce.MemoryCacheObjectSize {
+		return
+	}
+	expire, ok := cacheExpire(f.header,
+		time.Duration(ps.Config.Coalesce.MemoryCacheTtl)*time.Second)
+	if ok {
+		memoryCache.Put(f.key, f.header, f.body, expire)
+	}
+}
+
+/**
+ * 将共享缓冲区中的响应写给客户端，缓冲区增长时继续写出，直到获取完成；
+ * 不缓冲的响应只写给第一个请求的客户端，其它客户端返回errCoalesceBypass
+ */
+func (f *flight) serve(w http.ResponseWriter, r *http.Request, leader bool) error {
+	// 客户端断开时唤醒等待，使客户端及时离开
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-r.Context().Done():
+			f.Lock()
+			f.cond.Broadcast()
+			f.Unlock()
+		case <-stop:
+		}
+	}()
+	f.Lock()
+	for !f.started && !f.done && r.Context().Err() == nil {
+		f.cond.Wait()
+	}
+	if !f.started {
+		err := f.err
+		f.Unlock()
+		if e := r.Context().Err(); e != nil {
+			return &writtenError{err: e}
+		}
+		if err == nil {
+			err = ErrNotFound
+		}
+		return err
+	}
+	if f.passThrough && !leader {
+		f.Unlock()
+		return errCoalesceBypass
+	}
+	for k, v := range f.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	status := f.status
+	passThrough := f.passThrough
+	f.Unlock()
+	setCorsHeader(w, r)
+	w.WriteHeader(status)
+	if passThrough {
+		if _, err := io.Copy(w, f.pr); err != nil {
+			return &writtenError{err: err}
+		}
+		return nil
+	}
+	offset := 0
+	for {
+		f.Lock()
+		for offset == len(f.body) && !f.done && r.Context().Err() == nil {
+			f.cond.Wait()
+		}
+		chunk := f.body[offset:]
+		done := f.done
+		err := f.err
+		f.Unlock()
+		if len(chunk) > 0 {
+			n, e := w.Write(chunk)
+			offset += n
+			if e != nil {
+				return &writtenError{err: e}
+			}
+		} else if done {
+			return err
+		} else if e := r.Context().Err(); e != nil {
+			return &writtenError{err: e}
+		}
+	}
+}
+
+func (fw *flightWriter) Header() http.Header {
+	return fw.header
+}
+
+func (fw *flightWriter) WriteHeader(status int) {
+	if fw.wroteHeader {
+		return
+	}
+	fw.wroteHeader = true
+	f := fw.f
+	f.Lock()
+	f.header = make(http.Header, len(fw.header))
+	for k, v := range fw.header {
+		f.header[k] = append([]string(nil), v...)
+	}
+	f.status = status
+	// 大小未知或超过maxSize 的响应不缓冲，也不再合并新的请求
+	size, err := strconv.ParseInt(f.header.Get("Content-Length"), 10, 64)
+	f.passThrough = err != nil || size > coalescer.maxSize
+	f.started = true
+	f.cond.Broadcast()
+	f.Unlock()
+	if f.passThrough {
+		coalescer.Lock()
+		if coalescer.flights[f.key] == f {
+			delete(coalescer.flights, f.key)
+		}
+		coalescer.Unlock()
+	}
+}
+
+func (fw *flightWriter) Write(p []byte) (int, error) {
+	if !fw.wroteHeader {
+		fw.WriteHeader(http.StatusOK)
+	}
+	f := fw.f
+	if f.passThrough {
+		// 第一个请求的客户端离开后返回错误，停止获取
+		return f.pw.Write(p)
+	}
+	f.Lock()
+	f.body = append(f.body, p...)
+	f.cond.Broadcast()
+	f.Unlock()
+	return len(p), nil
+}
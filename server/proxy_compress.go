@@ -0,0 +1,164 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+	"github.com/wangfeiping/weeder/util"
+)
+
+var compression *util.CompressionConfig
+
+var gzipWriters sync.Pool
+
+func initCompression(ps *ProxyServer) {
+	c := &ps.Config.Compression
+	log.DebugS("main", "config: compression ", c.Enable)
+	if !c.Enable {
+		return
+	}
+	if len(c.Types) == 0 {
+		c.Types = []string{"text/", "application/json", "application/javascript",
+			"application/xml", "image/svg+xml"}
+	}
+	if c.MinSize <= 0 {
+		c.MinSize = 1024
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = 64 << 20
+	}
+	if c.Level < gzip.BestSpeed || c.Level > gzip.BestCompression {
+		c.Level = 6
+	}
+	compression = c
+	log.DebugS("main", "config: compression types ", c.Types,
+		" minSize ", c.MinSize, " maxSize ", c.MaxSize, " level ", c.Level)
+}
+
+/**
+ * 判断是否压缩响应内容并设置响应头，必须在WriteHeader 之前调用。
+ * 只压缩完整的（200）文件，206 等Range 响应、已压缩或按gzip 保存的文件原样返回；
+ * 可压缩类型的响应总是设置Vary: Accept-Encoding。
+ */
+func compressResponse(resp *http.Response, w http.ResponseWriter, r *http.Request) bool {
+	if resp.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	return compressHeader(resp.StatusCode, w, r)
+}
+
+// 按已设置的响应头判断是否压缩，Content-Length 未设置时不检查大小
+func compressHeader(status int, w http.ResponseWriter, r *http.Request) bool {
+	header := w.Header()
+	if status != http.StatusOK || header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mtype := strings.ToLower(header.Get("Content-Type"))
+	compressible := false
+	for _, prefix := range compression.Types {
+		if strings.HasPrefix(mtype, prefix) {
+			compressible = true
+			break
+		}
+	}
+	if !compressible {
+		return false
+	}
+	if size, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64); err == nil &&
+		(size < compression.MinSize || size > compression.MaxSize) {
+		return false
+	}
+	addVary(header, "Accept-Encoding")
+	if !util.AcceptsEncoding(r.Header.Get("Accept-Encoding"), "gzip") {
+		return false
+	}
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+	header.Set("Content-Encoding", "gzip")
+	// 压缩后的内容与原文件不同，强ETag 改为弱ETag
+	if etag := header.Get("ETag"); strings.HasPrefix(etag, `"`) {
+		header.Set("ETag", "W/"+etag)
+	}
+	stats.Incr("compression.gzip")
+	return true
+}
+
+// 合并请求的响应头中可能已经包含Vary，不重复添加
+func addVary(header http.Header, name string) {
+	for _, v := range header["Vary"] {
+		for _, f := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), name) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", name)
+}
+
+/**
+ * 缓存命中时使用的ResponseWriter，写出响应状态时按响应头判断是否压缩，
+ * 与直接转发seaweedfs 响应时的压缩规则相同；写出完成后必须调用Close
+ */
+type compressWriter struct {
+	http.ResponseWriter
+	r           *http.Request
+	gz          *gzip.Writer
+	wroteHeader bool
+}
+
+func newCompressWriter(w http.ResponseWriter, r *http.Request) *compressWriter {
+	return &compressWriter{ResponseWriter: w, r: r}
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	if compression != nil && compressHeader(status, cw.ResponseWriter, cw.r) &&
+		!strings.EqualFold(cw.r.Method, "head") {
+		cw.gz = getGzipWriter(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.gz != nil {
+		return cw.gz.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+func (cw *compressWriter) Close() error {
+	if cw.gz == nil {
+		return nil
+	}
+	err := cw.gz.Close()
+	putGzipWriter(cw.gz)
+	cw.gz = nil
+	return err
+}
+
+func getGzipWriter(w io.Writer) *gzip.Writer {
+	if gz, ok := gzipWriters.Get().(*gzip.Writer); ok {
+		gz.Reset(w)
+		return gz
+	}
+	gz, _ := gzip.NewWriterLevel(w, compression.Level)
+	return gz
+}
+
+func putGzipWriter(gz *gzip.Writer) {
+	gz.Reset(ioutil.Discard)
+	gzipWriters.Put(gz)
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"path/filepath"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+	"github.com/wangfeiping/weeder/util"
+)
+
+// 去重索引的key 前缀
+const (
+	dedupHashKey = "sha256:" // sha256[?存储位置] -> fid
+	dedupFidKey  = "fid:"    // fid -> sha256[?存储位置]，fid 是否为去重上传的文件
+	dedupPathKey = "path:"   // filer 路径 -> fid
+)
+
+type deduplicator struct {
+	maxSize int64
+}
+
+var dedup *deduplicator
+
+func initDedup(ps *ProxyServer) {
+	c := &ps.Config.Dedup
+	log.DebugS("main", "config: dedup ", c.Enable)
+	if !c.Enable {
+		return
+	}
+	if metaClient() == nil {
+		log.DebugS("main", "config: dedup requires redis or mysql")
+		return
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = 4 << 20
+	}
+	dedup = &deduplicator{maxSize: c.MaxSize}
+	log.DebugS("main", "config: dedup maxSize ", c.MaxSize)
+}
+
+/**
+ * 读取不超过maxSize 的文件内容到内存，大小已知且超过maxSize 时不读取；
+ * 返回的reader 包含已读取的内容，data 为nil 时文件不参与去重
+ */
+func (d *deduplicator) buffer(src io.Reader, size int64) (io.Reader, []byte, error) {
+	if size > d.maxSize {
+		return src, nil, nil
+	}
+	head := new(bytes.Buffer)
+	_, err := io.CopyN(head, src, d.maxSize+1)
+	if err == io.EOF {
+		return bytes.NewReader(head.Bytes()), head.Bytes(), nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return io.MultiReader(head, src), nil, nil
+}
+
+// 存储位置不同的文件不共用，指定了存储位置时内容的key 包含存储位置
+func dedupContentKey(digest *util.FileDigest, placement *util.Placement) string {
+	if placement == nil || placement.IsEmpty() {
+		return digest.Sha256
+	}
+	values := make(url.Values)
+	placement.AddTo(values)
+	return digest.Sha256 + "?" + values.Encode()
+}
+
+/**
+ * 查找内容与存储位置相同的已上传文件，找到时增加其引用计数并返回fid
+ */
+func (ps *ProxyServer) dedupLookup(digest *util.FileDigest, placement *util.Placement,
+	logHeader *log.LogHeader) string {
+	client := metaClient()
+	key := dedupContentKey(digest, placement)
+	fid, err := client.GetDedupIndex(dedupHashKey + key)
+	if err != nil || fid == "" {
+		stats.Incr("dedup.misses")
+		return ""
+	}
+	refs, err := client.IncrFileRef(fid, 1)
+	if err != nil {
+		log.Error(logHeader, "dedup incr ref error: ", fid, " ", err.Error())
+		return ""
+	}
+	if refs == 1 {
+		// 文件正在被删除，重新上传
+		client.IncrFileRef(fid, -1)
+		stats.Incr("dedup.misses")
+		return ""
+	}
+	stats.Incr("dedup.hits")
+	log.Debug(logHeader, "dedup: ", key, " -> ", fid, " refs ", refs)
+	return fid
+}
+
+/**
+ * 记录上传文件的去重索引，newFile 为false 时fid 为已存在的文件，引用计数已增加
+ */
+func (ps *ProxyServer) indexDedup(digest *util.FileDigest, placement *util.Placement,
+	fid string, path string, newFile bool, logHeader *log.LogHeader) {
+	client := metaClient()
+	var err error
+	if newFile {
+		key := dedupContentKey(digest, placement)
+		if err = client.SetDedupIndex(dedupFidKey+fid, key); err == nil {
+			if _, err = client.IncrFileRef(fid, 1); err == nil {
+				err = client.SetDedupIndex(dedupHashKey+key, fid)
+			}
+		}
+	}
+	if err == nil && path != "" {
+		err = client.SetDedupIndex(dedupPathKey+path, fid)
+	}
+	if err != nil {
+		log.Error(logHeader, "dedup index error: ", fid, " ", path, " ", err.Error())
+	}
+}
+
+type dedupRef struct {
+	fid  string
+	hash string
+	refs int64 // 减少后的引用计数
+}
+
+/**
+ * 减少filer 路径或fid 对应文件的引用计数，不是去重上传的文件返回nil
+ */
+func (ps *ProxyServer) releaseDedupRef(key string, isFiler bool,
+	logHeader *log.LogHeader) (*dedupRef, error) {
+	client := metaClient()
+	fid := pathFid(key)
+	if isFiler {
+		var err error
+		if fid, err = client.GetDedupIndex(dedupPathKey + key); err != nil {
+			return nil, nil
+		}
+	}
+	hash, err := client.GetDedupIndex(dedupFidKey + fid)
+	if err != nil {
+		return nil, nil
+	}
+	refs, err := client.IncrFileRef(fid, -1)
+	if err != nil {
+		log.Error(logHeader, "dedup decr ref error: ", fid, " ", err.Error())
+		return nil, err
+	}
+	log.Debug(logHeader, "dedup release: ", key, " -> ", fid, " refs ", refs)
+	return &dedupRef{fid: fid, hash: hash, refs: refs}, nil
+}
+
+// 删除失败时恢复引用计数
+func (ps *ProxyServer) restoreDedupRef(ref *dedupRef, logHeader *log.LogHeader) {
+	if _, err := metaClient().IncrFileRef(ref.fid, 1); err != nil {
+		log.Error(logHeader, "dedup restore ref error: ", ref.fid, " ", err.Error())
+	}
+}
+
+/**
+ * 删除成功后清理索引，引用计数为0 时删除fid 与内容的索引
+ */
+func (ps *ProxyServer) dropDedupRef(ref *dedupRef, path string) {
+	client := metaClient()
+	if path != "" {
+		client.DeleteDedupIndex(dedupPathKey + path)
+	}
+	if ref.refs > 0 {
+		return
+	}
+	client.DeleteDedupIndex(dedupFidKey + ref.fid)
+	// 并发上传相同内容时索引可能已指向其他fid
+	if fid, err := client.GetDedupIndex(dedupHashKey + ref.hash); err == nil &&
+		fid == ref.fid {
+		client.DeleteDedupIndex(dedupHashKey + ref.hash)
+	}
+	stats.Incr("dedup.released")
+}
+
+/**
+ * filer 删除或覆盖路径时会删除对应的fid，
+ * 其他路径仍在引用的文件先将路径映射到一个空文件，由filer 删除空文件
+ */
+func (ps *ProxyServer) detachFilerPath(path string, logHeader *log.LogHeader) error {
+	placeholder, err := ps.uploadChunkContent(filepath.Base(path), "", nil,
+		bytes.NewReader(nil), logHeader)
+	if err != nil {
+		return err
+	}
+	if err = ps.registerFilerPath(placeholder.Fid, path, logHeader); err != nil {
+		ps.deleteFids([]string{placeholder.Fid}, logHeader)
+		return err
+	}
+	log.Debug(logHeader, "dedup detach: ", path, " -> ", placeholder.Fid)
+	return nil
+}
+
+// filer 路径当前是否映射到去重上传的文件
+func (ps *ProxyServer) dedupPathTracked(path string) bool {
+	_, err := metaClient().GetDedupIndex(dedupPathKey + path)
+	return err == nil
+}
+
+/**
+ * filer 路径映射到新文件后释放原文件的引用：
+ * 新文件通过/admin/register 映射，filer 不删除原fid，引用计数为0 时由weeder 删除
+ */
+func (ps *ProxyServer) replaceDedupPath(path string, logHeader *log.LogHeader) error {
+	ref, err := ps.releaseDedupRef(path, true, logHeader)
+	if err != nil || ref == nil {
+		return err
+	}
+	if ref.refs <= 0 {
+		ps.deleteFids([]string{ref.fid}, logHeader)
+	}
+	ps.dropDedupRef(ref, path)
+	return nil
+}
+
+/**
+ * 删除文件前释放引用：返回的shared 为true 时文件仍被其他路径引用，不删除fid；
+ * filer 路径先映射到空文件，删除路径时只删除空文件
+ */
+func (ps *ProxyServer) releaseDeletedFile(path string, isFiler bool,
+	logHeader *log.LogHeader) (ref *dedupRef, shared bool, err error) {
+	if ref, err = ps.releaseDedupRef(path, isFiler, logHeader); err != nil || ref == nil {
+		return
+	}
+	if ref.refs <= 0 {
+		return ref, false, nil
+	}
+	if isFiler {
+		if err = ps.detachFilerPath(path, logHeader); err != nil {
+			ps.restoreDedupRef(ref, logHeader)
+			return nil, false, err
+		}
+		// 路径已映射到空文件，仍由filer 删除
+		return ref, false, nil
+	}
+	return ref, true, nil
+}
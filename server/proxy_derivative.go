@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/wangfeiping/weeder/imaging"
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+	"github.com/wangfeiping/weeder/util"
+)
+
+/**
+ * 上传图片到filer 时按路径前缀规则生成缩略图等衍生图片，
+ * 衍生图片保存在原图所在目录：/app/img/car.jpg -> /app/img/car.thumb.jpg，
+ * 删除原图时同时删除衍生图片。
+ */
+var derivatives *util.DerivativesConfig
+
+func initDerivatives(ps *ProxyServer) {
+	c := &ps.Config.Derivatives
+	log.DebugS("main", "config: derivatives ", c.Enable)
+	if !c.Enable {
+		return
+	}
+	if c.MaxSourceSize <= 0 {
+		c.MaxSourceSize = 20 << 20
+	}
+	if c.MaxSourcePixels <= 0 {
+		c.MaxSourcePixels = 40000000
+	}
+	for _, rule := range c.Rules {
+		log.DebugS("main", "config: derivatives ", rule.Prefix, " ", rule.Sizes)
+	}
+	derivatives = c
+}
+
+// 匹配最长路径前缀的规则
+func derivativeRule(filepath string) *util.DerivativeRule {
+	var ret *util.DerivativeRule
+	for i, rule := range derivatives.Rules {
+		if strings.HasPrefix(filepath, rule.Prefix) &&
+			(ret == nil || len(rule.Prefix) > len(ret.Prefix)) {
+			ret = &derivatives.Rules[i]
+		}
+	}
+	return ret
+}
+
+func derivativePath(filepath string, name string) string {
+	ext := path.Ext(filepath)
+	return strings.TrimSuffix(filepath, ext) + "." + name + ext
+}
+
+// 衍生图片本身不再生成衍生图片
+func isDerivativePath(filepath string, rule *util.DerivativeRule) bool {
+	base := strings.TrimSuffix(filepath, path.Ext(filepath))
+	for _, size := range rule.Sizes {
+		if strings.HasSuffix(base, "."+size.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * 生成并上传衍生图片，单个衍生图片失败不影响原图上传，错误记录在返回结果中
+ */
+func (ps *ProxyServer) generateDerivatives(data []byte, filepath string,
+	ttl string, placement *util.Placement, logHeader *log.LogHeader) []*log.Derivative {
+	rule := derivativeRule(filepath)
+	if rule == nil || len(rule.Sizes) == 0 || isDerivativePath(filepath, rule) {
+		return nil
+	}
+	img, format, err := imaging.Decode(data, derivatives.MaxSourcePixels)
+	if err == imaging.ErrUnsupportedFormat {
+		return nil
+	} else if err != nil {
+		log.Error(logHeader, "derivatives decode error: ", filepath, " ", err.Error())
+		return nil
+	}
+	ret := make([]*log.Derivative, 0, len(rule.Sizes))
+	for _, size := range rule.Sizes {
+		d := &log.Derivative{
+			Name: size.Name,
+			Path: derivativePath(filepath, size.Name),
+		}
+		ret = append(ret, d)
+		out, mtype, err := imaging.Encode(imaging.Process(img, &imaging.Options{
+			Width:  size.Width,
+			Height: size.Height,
+			Mode:   size.Mode,
+		}), format, size.Quality)
+		if err == nil {
+			err = ps.uploadDerivative(d, out, mtype, ttl, placement, logHeader)
+		}
+		if err != nil {
+			stats.Incr("derivatives.errors")
+			d.Error = err.Error()
+			log.Error(logHeader, "derivative error: ", d.Path, " ", err.Error())
+			continue
+		}
+		stats.Incr("derivatives.generated")
+	}
+	return ret
+}
+
+/**
+ * 与原图使用相同的ttl 与存储位置上传到filer，
+ * 衍生图片路径的上传规则设置了writeOnce 且已存在时不覆盖
+ */
+func (ps *ProxyServer) uploadDerivative(d *log.Derivative, content []byte,
+	mtype string, ttl string, placement *util.Placement, logHeader *log.LogHeader) error {
+	unlock, err := ps.checkPathCondition(d.Path, "", "",
+		ps.uploadPolicy(d.Path, logHeader.UserId), logHeader)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	i := strings.LastIndex(d.Path, "/")
+	dir, filename := d.Path[:i+1], d.Path[i+1:]
+	query := make(url.Values)
+	if ttl != "" {
+		query.Set("ttl", ttl)
+	}
+	if placement != nil {
+		placement.AddTo(query)
+	}
+	uploadUrl := ps.getFileUrl(dir, true, 0)
+	if len(query) > 0 {
+		uploadUrl = uploadUrl + "?" + query.Encode()
+	}
+	ret, err := ps.Upload(uploadUrl, filename, bytes.NewReader(content), false,
+		mtype, nil, logHeader)
+	if err != nil {
+		return err
+	}
+	d.Fid = ret.Fid
+	d.Size = len(content)
+	digester := util.NewDigester()
+	digester.Write(content)
+	saveFileDigest(digester.Sum(), ret.Fid, d.Path, logHeader)
+	if ps.Config.RedisCacheTtl != "" && ret.Fid != "" {
+		redisclient.CacheFilePath(d.Path, ret.Fid, ps.Config.RedisCacheTtl)
+	}
+	invalidateCache(d.Path)
+	ps.mirrorUpload(d.Path, true, filename, ttl, placement,
+		bytes.NewReader(content), logHeader)
+	log.Debug(logHeader, "derivative uploaded: ", d.Path, " -> ", ret.Fid)
+	return nil
+}
+
+// 删除原图时删除衍生图片，错误只记录日志
+func (ps *ProxyServer) deleteDerivatives(filepath string, logHeader *log.LogHeader) {
+	rule := derivativeRule(filepath)
+	if rule == nil || isDerivativePath(filepath, rule) {
+		return
+	}
+	for _, size := range rule.Sizes {
+		dpath := derivativePath(filepath, size.Name)
+		if err := ps.weedDelete(nil, dpath, true, logHeader, 0); err != nil {
+			log.Error(logHeader, "derivative delete error: ", dpath, " ", err.Error())
+			continue
+		}
+		deleteFileDigest(dpath, logHeader)
+		invalidateCache(dpath)
+		ps.mirrorDelete(dpath, true, logHeader)
+	}
+}
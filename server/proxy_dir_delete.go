@@ -0,0 +1,343 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+)
+
+var ErrFilerDirNotFound = errors.New("Directory not found!")
+var ErrFilerDirTooLarge = errors.New("Too many files in the directory!")
+
+// 每次从filer 获取的文件数
+const filerListLimit = 1000
+
+// filer 目录列表，兼容Subdirectories 与Directories 两种格式
+type filerListing struct {
+	Files []struct {
+		Name string `json:"name"`
+	}
+	Subdirectories        json.RawMessage
+	Directories           json.RawMessage
+	LastFileName          string
+	ShouldDisplayLoadMore bool
+}
+
+type DirDeleteProgress struct {
+	Path   string `json:"path"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Done   int    `json:"done"`
+	Total  int    `json:"total"`
+}
+
+type DirDeleteResult struct {
+	Path      string             `json:"path"`
+	DryRun    bool               `json:"dryRun"`
+	Files     []string           `json:"files,omitempty"` // dryRun 时返回将要删除的文件与目录
+	Dirs      []string           `json:"dirs,omitempty"`
+	FileCount int                `json:"fileCount"`
+	DirCount  int                `json:"dirCount"`
+	Deleted   int                `json:"deleted"`
+	Failed    []*BatchDeleteItem `json:"failed,omitempty"`
+	Message   string             `json:"message"`
+	Status    int                `json:"status"`
+	Detail    string             `json:"detail,omitempty"`
+}
+
+/**
+ * 递归删除filer 目录：
+ *	POST /delete/dir?path=/app/dir/&dryRun=true
+ * dryRun 时只返回将要删除的文件与目录；否则先删除文件再由深到浅删除目录，
+ * 按行返回每个文件与目录的删除进度，最后一行为删除结果；
+ * 与设置ttl 的规则相同，不允许删除根目录与一级目录（如/public/）
+ */
+func (ps *ProxyServer) dirDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	logHeader := &log.LogHeader{
+		TraceId:    checkGid(r),
+		Caddress:   checkRealIp(r),
+		UserId:     checkUniSource(r),
+		Key:        "request",
+		ThreadName: r.URL.Path,
+		ClassName:  "dir_delete",
+		MethodName: r.Method,
+	}
+	log.Info(logHeader, `{"uri":"`, r.RequestURI, `"}`)
+	logHeader.Key = "response"
+	ret := &DirDeleteResult{Message: "error"}
+	if !strings.EqualFold(r.Method, "post") {
+		ret.Status = http.StatusMethodNotAllowed
+		ret.Detail = "Only delete via POST!"
+		writeDirDeleteResult(w, ret, logHeader)
+		return
+	}
+	if ps.Config.UniSourceCheck && logHeader.UserId == "" {
+		ret.Status = http.StatusNotAcceptable
+		ret.Detail = "It's not allowed to delete without Uni-Source header."
+		writeDirDeleteResult(w, ret, logHeader)
+		return
+	}
+	if ip, ok := ps.isWritable(r.RemoteAddr); !ok {
+		ret.Status = http.StatusNotAcceptable
+		ret.Detail = fmt.Sprintf("It's not allowed to delete by whitelist (%s).", ip)
+		writeDirDeleteResult(w, ret, logHeader)
+		return
+	}
+	r.ParseForm()
+	dir := r.Form.Get("path")
+	ret.DryRun, _ = strconv.ParseBool(r.Form.Get("dryRun"))
+	stopOnError, _ := strconv.ParseBool(r.Form.Get("stopOnError"))
+	// 包含. 或.. 的路径可能绕过一级目录的保护
+	if !strings.HasPrefix(dir, "/") || hasDotSegment(dir) {
+		ret.Status = http.StatusBadRequest
+		ret.Detail = "Bad request, path is invalid!"
+		writeDirDeleteResult(w, ret, logHeader)
+		return
+	}
+	if dir = path.Clean(dir); dir != "/" {
+		dir = dir + "/"
+	}
+	ret.Path = dir
+	if !isPathCanBeSetTtl(dir) {
+		ret.Status = http.StatusForbidden
+		ret.Detail = fmt.Sprintf("It's not allowed to delete the directory %s.", dir)
+		writeDirDeleteResult(w, ret, logHeader)
+		return
+	}
+	files, dirs, err := ps.listFilerTree(dir, logHeader)
+	if err != nil {
+		log.Error(logHeader, "list dir error: ", dir, " ", err.Error())
+		ret.Status = http.StatusBadGateway
+		if err == ErrFilerDirNotFound {
+			ret.Status = http.StatusNotFound
+		} else if err == ErrFilerDirTooLarge {
+			ret.Status = http.StatusRequestEntityTooLarge
+		}
+		ret.Detail = err.Error()
+		writeDirDeleteResult(w, ret, logHeader)
+		return
+	}
+	ret.FileCount, ret.DirCount = len(files), len(dirs)
+	if ret.DryRun {
+		ret.Files, ret.Dirs = files, dirs
+		ret.Status = http.StatusOK
+		ret.Message = "ok"
+		writeDirDeleteResult(w, ret, logHeader)
+		return
+	}
+	stats.Incr("dirDelete.requests")
+	ps.deleteDirTree(w, ret, files, dirs, stopOnError, logHeader)
+}
+
+/**
+ * 删除目录下的文件后由深到浅删除目录，有文件删除失败时不删除目录；
+ * 每删除一个文件或目录写入一行进度
+ */
+func (ps *ProxyServer) deleteDirTree(w http.ResponseWriter, ret *DirDeleteResult,
+	files []string, dirs []string, stopOnError bool, logHeader *log.LogHeader) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	total := len(files) + len(dirs)
+	report := func(item *BatchDeleteItem) {
+		mu.Lock()
+		defer mu.Unlock()
+		if item.Status == http.StatusOK {
+			ret.Deleted++
+		} else {
+			ret.Failed = append(ret.Failed, item)
+		}
+		enc.Encode(&DirDeleteProgress{
+			Path:   item.Path,
+			Status: item.Status,
+			Detail: item.Detail,
+			Done:   ret.Deleted + len(ret.Failed),
+			Total:  total,
+		})
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	items := make([]*BatchDeleteItem, len(files))
+	for i, file := range files {
+		items[i] = &BatchDeleteItem{Path: file}
+	}
+	failed := ps.deleteItems(items, stopOnError, report, logHeader)
+	stats.Add("dirDelete.files", int64(len(files)))
+	// 目录列表中父目录在前，倒序删除
+	for i := len(dirs) - 1; i >= 0; i-- {
+		item := &BatchDeleteItem{Path: dirs[i], Status: http.StatusOK}
+		if failed > 0 {
+			item.Status = http.StatusFailedDependency
+			item.Detail = ErrBatchDeleteSkipped.Error()
+		} else if err := ps.deleteFilerDir(dirs[i], logHeader); err != nil {
+			log.Error(logHeader, "delete dir error: ", dirs[i], " ", err.Error())
+			item.Status = http.StatusInternalServerError
+			item.Detail = err.Error()
+			failed++
+		}
+		report(item)
+	}
+	ret.Status = http.StatusOK
+	ret.Message = "ok"
+	if failed > 0 {
+		stats.Incr("dirDelete.errors")
+		ret.Status = http.StatusMultiStatus
+		ret.Message = "error"
+	}
+	enc.Encode(ret)
+	if ret.Status == http.StatusOK {
+		logHeader.Status = "ok"
+		log.Info(logHeader, `{"message":"ok","path":"`, ret.Path,
+			`","deleted":`, ret.Deleted, `}`)
+	} else {
+		logHeader.Status = "err"
+		log.Error(logHeader, "delete dir ", ret.Path, " deleted ", ret.Deleted,
+			" failed ", len(ret.Failed))
+	}
+}
+
+// 目录下的文件直接删除，只删除空目录
+func (ps *ProxyServer) deleteFilerDir(dir string, logHeader *log.LogHeader) error {
+	uri := (&url.URL{Path: dir}).EscapedPath()
+	return deleteRequest(logHeader, ps.getFileUrl(uri, true, 0))
+}
+
+/**
+ * 递归获取目录下的所有文件与目录，目录以'/'结尾且父目录在前；
+ * 文件与目录总数超过dirDeleteMaxFiles 时返回ErrFilerDirTooLarge
+ */
+func (ps *ProxyServer) listFilerTree(root string,
+	logHeader *log.LogHeader) (files []string, dirs []string, err error) {
+	queue := []string{root}
+	for len(queue) > 0 {
+		dir := queue[0]
+		queue = queue[1:]
+		dirs = append(dirs, dir)
+		names, subdirs, err := ps.listFilerDir(dir)
+		if err != nil {
+			if err == ErrFilerDirNotFound && dir != root {
+				// 列目录期间已被删除
+				continue
+			}
+			return nil, nil, err
+		}
+		for _, name := range names {
+			files = append(files, dir+name)
+		}
+		for _, name := range subdirs {
+			queue = append(queue, dir+name+"/")
+		}
+		if len(files)+len(dirs)+len(queue) > dirDeleteMaxFiles {
+			return nil, nil, ErrFilerDirTooLarge
+		}
+	}
+	log.Debug(logHeader, "list dir ", root, " files ", len(files), " dirs ", len(dirs))
+	return files, dirs, nil
+}
+
+// 获取目录下的文件名与子目录名，文件分页获取
+func (ps *ProxyServer) listFilerDir(dir string) (files []string, dirs []string, err error) {
+	uri := (&url.URL{Path: dir}).EscapedPath()
+	lastFileName := ""
+	for page := 0; ; page++ {
+		query := url.Values{}
+		query.Set("limit", strconv.Itoa(filerListLimit))
+		if lastFileName != "" {
+			query.Set("lastFileName", lastFileName)
+		}
+		req, err := http.NewRequest("GET", ps.getFileUrl(uri, true, 0)+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		resp, err := weedHttpClient.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		var listing filerListing
+		if resp.StatusCode == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&listing)
+		} else if resp.StatusCode == http.StatusNotFound {
+			err = ErrFilerDirNotFound
+		} else {
+			err = fmt.Errorf("filer returned %s", resp.Status)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if page == 0 {
+			dirs = filerDirNames(listing.Subdirectories)
+			dirs = append(dirs, filerDirNames(listing.Directories)...)
+		}
+		for _, f := range listing.Files {
+			files = append(files, f.Name)
+		}
+		n := len(listing.Files)
+		if n == 0 || (n < filerListLimit && !listing.ShouldDisplayLoadMore) ||
+			listing.Files[n-1].Name == lastFileName {
+			return files, dirs, nil
+		}
+		lastFileName = listing.Files[n-1].Name
+	}
+}
+
+// 子目录为名称列表或{"Name":...}对象列表，名称可能是完整路径
+func filerDirNames(raw json.RawMessage) []string {
+	if len(raw) == 0 {
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(raw, &names); err != nil {
+		var entries []struct {
+			Name string
+		}
+		json.Unmarshal(raw, &entries)
+		for _, e := range entries {
+			names = append(names, e.Name)
+		}
+	}
+	for i, name := range names {
+		name = strings.TrimSuffix(name, "/")
+		if j := strings.LastIndex(name, "/"); j >= 0 {
+			name = name[j+1:]
+		}
+		names[i] = name
+	}
+	return names
+}
+
+func writeDirDeleteResult(w http.ResponseWriter, ret *DirDeleteResult,
+	logHeader *log.LogHeader) {
+	bs, err := json.Marshal(ret)
+	if err != nil {
+		logHeader.Status = "err"
+		log.Error(logHeader, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(ret.Status)
+	w.Write(bs)
+	w.Write([]byte("\n"))
+	if ret.Status == http.StatusOK {
+		logHeader.Status = "ok"
+		log.Info(logHeader, `{"message":"ok","path":"`, ret.Path,
+			`","files":`, ret.FileCount, `,"dirs":`, ret.DirCount, `}`)
+	} else {
+		logHeader.Status = "err"
+		log.Error(logHeader, string(bs))
+	}
+}
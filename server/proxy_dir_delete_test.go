@@ -0,0 +1,85 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/wangfeiping/weeder/log"
+)
+
+// 返回最后一行的删除结果
+func doTestDirDelete(ps *ProxyServer, dir string) *DirDeleteResult {
+	r := httptest.NewRequest("POST", "/delete/dir?path="+url.QueryEscape(dir), nil)
+	w := httptest.NewRecorder()
+	ps.dirDeleteHandler(w, r)
+	lines := bytes.Split(bytes.TrimSpace(w.Body.Bytes()), []byte("\n"))
+	ret := &DirDeleteResult{}
+	json.Unmarshal(lines[len(lines)-1], ret)
+	return ret
+}
+
+func Test_DirDelete(t *testing.T) {
+	weed := newFakeWeed()
+	defer weed.Close()
+	ps := newTestProxy(weed)
+	weed.put("/app/dir/100%.txt", "a")
+	weed.put("/app/dir/sub/b.txt", "b")
+	weed.put("/app/other.txt", "c")
+
+	ret := doTestDirDelete(ps, "/app/dir")
+	if ret.Status != http.StatusOK || ret.Deleted != 4 {
+		t.Fatal("Test_DirDelete: ", ret.Status, " ", ret.Deleted, " ", ret.Detail)
+	}
+	if _, ok := weed.get("/app/dir/100%.txt"); ok {
+		t.Error("Test_DirDelete: file is not deleted")
+	}
+	if !weed.called("DELETE /app/dir/100%25.txt") || !weed.called("DELETE /app/dir/sub/") {
+		t.Error("Test_DirDelete: ", weed.calls)
+	}
+	if _, ok := weed.get("/app/other.txt"); !ok {
+		t.Error("Test_DirDelete: other.txt is deleted")
+	}
+}
+
+func Test_DirDeleteProtected(t *testing.T) {
+	weed := newFakeWeed()
+	defer weed.Close()
+	ps := newTestProxy(weed)
+	weed.put("/app/a.txt", "a")
+
+	if ret := doTestDirDelete(ps, "/app/dir/../"); ret.Status != http.StatusBadRequest {
+		t.Error("Test_DirDeleteProtected: dot segment ", ret.Status)
+	}
+	if ret := doTestDirDelete(ps, "/app/"); ret.Status != http.StatusForbidden {
+		t.Error("Test_DirDeleteProtected: first level ", ret.Status)
+	}
+	if _, ok := weed.get("/app/a.txt"); !ok {
+		t.Error("Test_DirDeleteProtected: a.txt is deleted")
+	}
+}
+
+// DELETE 以'/'结尾的filer 路径只由filer 删除空目录
+func Test_DeleteFilerDir(t *testing.T) {
+	weed := newFakeWeed()
+	defer weed.Close()
+	ps := newTestProxy(weed)
+	weed.put("/app/full/a.txt", "a")
+
+	w := httptest.NewRecorder()
+	ps.deleteFile(w, "/app/empty/", "127.0.0.1:1", true, &log.LogHeader{})
+	if w.Code != http.StatusOK || !weed.called("DELETE /app/empty/") {
+		t.Error("Test_DeleteFilerDir: empty ", w.Code)
+	}
+	w = httptest.NewRecorder()
+	ps.deleteFile(w, "/app/full/", "127.0.0.1:1", true, &log.LogHeader{})
+	if w.Code != http.StatusInternalServerError {
+		t.Error("Test_DeleteFilerDir: not empty ", w.Code)
+	}
+	if _, ok := weed.get("/app/full/a.txt"); !ok {
+		t.Error("Test_DeleteFilerDir: a.txt is deleted")
+	}
+}
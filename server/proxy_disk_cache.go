@@ -0,0 +1,216 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wangfeiping/weeder/cache"
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+)
+
+var diskCache *cache.DiskCache
+
+type diskCacheBody struct {
+	io.ReadCloser
+	writer   *cache.EntryWriter
+	complete bool
+}
+
+func initDiskCache(ps *ProxyServer) {
+	c := &ps.Config.DiskCache
+	log.DebugS("main", "config: diskCache ", c.Enable)
+	if !c.Enable {
+		return
+	}
+	if c.Dir == "" {
+		c.Dir = "./cache"
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = 1 << 30
+	}
+	if c.MaxFileSize <= 0 {
+		c.MaxFileSize = 16 << 20
+	}
+	if c.Ttl <= 0 {
+		c.Ttl = 300
+	}
+	if len(c.Prefixes) == 0 {
+		c.Prefixes = []string{"/public/"}
+	}
+	var err error
+	diskCache, err = cache.NewDiskCache(c.Dir, c.MaxSize)
+	if err != nil {
+		log.ErrorS("main", "config: diskCache error: ", err.Error())
+		return
+	}
+	log.DebugS("main", "config: diskCache ", c.Dir, " maxSize ", c.MaxSize,
+		" maxFileSize ", c.MaxFileSize, " ttl ", c.Ttl,
+		" prefixes ", c.Prefixes, " serveStale ", c.ServeStale)
+}
+
+/**
+ * 按路径前缀判断请求是否使用磁盘缓存，缓存以请求路径（fid 或filer 路径）为key
+ */
+func (ps *ProxyServer) diskCacheKey(r *http.Request) (string, bool) {
+	if diskCache == nil || r.URL.RawQuery != "" {
+		return "", false
+	}
+	if !strings.EqualFold(r.Method, "get") && !strings.EqualFold(r.Method, "head") {
+		return "", false
+	}
+	for _, prefix := range ps.Config.DiskCache.Prefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return r.URL.Path, true
+		}
+	}
+	return "", false
+}
+
+/**
+ * 按上游Cache-Control、Expires 响应头计算缓存过期时间，未设置时使用ttl，
+ * 上游不允许缓存时返回false
+ */
+func cacheExpire(header http.Header, ttl time.Duration) (time.Time, bool) {
+	now := time.Now()
+	maxAge := -1
+	for _, directive := range strings.Split(header.Get("Cache-Control"), ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "no-cache" ||
+			directive == "private":
+			return now, false
+		case strings.HasPrefix(directive, "s-maxage="):
+			if age, err := strconv.Atoi(directive[9:]); err == nil {
+				maxAge = age
+			}
+		case strings.HasPrefix(directive, "max-age=") && maxAge < 0:
+			if age, err := strconv.Atoi(directive[8:]); err == nil {
+				maxAge = age
+			}
+		}
+	}
+	if maxAge == 0 {
+		return now, false
+	} else if maxAge > 0 {
+		return now.Add(time.Duration(maxAge) * time.Second), true
+	}
+	if expires := header.Get("Expires"); expires != "" {
+		t, err := http.ParseTime(expires)
+		if err != nil || !t.After(now) {
+			return now, false
+		}
+		return t, true
+	}
+	return now.Add(ttl), true
+}
+
+/**
+ * 使用磁盘缓存响应请求，stale 为true 时允许使用已过期的缓存；
+ * Range 与条件请求由http.ServeContent 处理
+ */
+func (ps *ProxyServer) serveDiskCache(w http.ResponseWriter, r *http.Request,
+	stale bool) bool {
+	key, ok := ps.diskCacheKey(r)
+	if !ok {
+		return false
+	}
+	entry, f := diskCache.Get(key)
+	if entry == nil {
+		if !stale {
+			stats.Incr("cache.disk.misses")
+		}
+		return false
+	}
+	defer f.Close()
+	status := "HIT"
+	if stale {
+		status = "STALE"
+		stats.Incr("cache.disk.stale")
+	} else if !entry.Fresh() {
+		stats.Incr("cache.disk.expired")
+		return false
+	} else {
+		stats.Incr("cache.disk.hits")
+	}
+	ps.writeResponseHeader(entry.Header, w, r)
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Cache", status)
+	modtime := entry.Stored
+	if t, err := http.ParseTime(entry.Header.Get("Last-Modified")); err == nil {
+		modtime = t
+	}
+	cw := newCompressWriter(w, r)
+	defer cw.Close()
+	http.ServeContent(cw, r, "", modtime, f)
+	return true
+}
+
+/**
+ * 包装上游响应，客户端读取完成后将文件保存到磁盘缓存
+ */
+func (ps *ProxyServer) diskCacheBody(resp *http.Response, r *http.Request) {
+	// seaweedfs 按客户端的Accept-Encoding 返回的压缩内容不缓存
+	if resp.StatusCode != http.StatusOK || !strings.EqualFold(r.Method, "get") ||
+		resp.Header.Get("Content-Encoding") != "" ||
+		resp.ContentLength > ps.Config.DiskCache.MaxFileSize {
+		return
+	}
+	key, ok := ps.diskCacheKey(r)
+	if !ok {
+		return
+	}
+	expire, ok := cacheExpire(resp.Header,
+		time.Duration(ps.Config.DiskCache.Ttl)*time.Second)
+	if !ok {
+		return
+	}
+	header := make(http.Header, len(resp.Header))
+	for k, v := range resp.Header {
+		header[k] = append([]string(nil), v...)
+	}
+	writer := diskCache.NewWriter(key, header, ps.Config.DiskCache.MaxFileSize, expire)
+	if writer == nil {
+		return
+	}
+	resp.Body = &diskCacheBody{ReadCloser: resp.Body, writer: writer}
+}
+
+func (b *diskCacheBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if n > 0 {
+		b.writer.Write(p[:n])
+	}
+	if err == io.EOF {
+		b.complete = true
+	}
+	return
+}
+
+func (b *diskCacheBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.complete {
+		if e := b.writer.Commit(); e != nil {
+			log.DebugS("cache", "disk cache commit: ", e.Error())
+		}
+	} else {
+		b.writer.Abort()
+	}
+	return err
+}
+
+// 通过weeder 删除或覆盖文件后清除对应缓存
+func invalidateCache(path string) {
+	if diskCache != nil {
+		diskCache.Delete(path)
+	}
+	if memoryCache != nil {
+		memoryCache.Delete(path)
+	}
+	if imageResize != nil {
+		imageResize.cache.DeletePrefix(path + "?")
+	}
+}
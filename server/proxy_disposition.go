@@ -0,0 +1,119 @@
+package server
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/util"
+)
+
+// 下载参数：download=1 作为附件下载，download=0 在浏览器中打开；filename 为下载文件名
+var dispositionParams = []string{"download", "filename"}
+
+/**
+ * 发送响应头前按请求参数或路径前缀规则修改Content-Disposition，
+ * 适用于所有下载方式（缓存、合并请求、图片处理等）
+ */
+type dispositionWriter struct {
+	http.ResponseWriter
+	dtype       string
+	filename    string
+	rule        *util.DispositionRule
+	wroteHeader bool
+}
+
+func initDisposition(ps *ProxyServer) {
+	for _, rule := range ps.Config.Disposition {
+		log.DebugS("main", "config: disposition ", rule.Prefix, " ",
+			rule.Disposition, " inlineTypes ", rule.InlineTypes)
+	}
+}
+
+// 匹配最长路径前缀的规则
+func (ps *ProxyServer) dispositionRule(path string) *util.DispositionRule {
+	var ret *util.DispositionRule
+	for i, rule := range ps.Config.Disposition {
+		if strings.HasPrefix(path, rule.Prefix) &&
+			(ret == nil || len(rule.Prefix) > len(ret.Prefix)) {
+			ret = &ps.Config.Disposition[i]
+		}
+	}
+	return ret
+}
+
+/**
+ * 请求带有下载参数或匹配路径规则时返回包装后的ResponseWriter
+ * 与去除下载参数后的请求
+ */
+func (ps *ProxyServer) withDisposition(w http.ResponseWriter,
+	r *http.Request) (http.ResponseWriter, *http.Request) {
+	query := r.URL.Query()
+	dw := &dispositionWriter{
+		ResponseWriter: w,
+		filename:       query.Get("filename"),
+		rule:           ps.dispositionRule(r.URL.Path),
+	}
+	switch query.Get("download") {
+	case "":
+	case "0", "false":
+		dw.dtype = util.DispositionInline
+	default:
+		dw.dtype = util.DispositionAttachment
+	}
+	_, hasDownload := query["download"]
+	_, hasFilename := query["filename"]
+	if !hasDownload && !hasFilename && dw.rule == nil {
+		return w, r
+	}
+	if hasDownload || hasFilename {
+		r = stripQuery(r, dispositionParams...)
+	}
+	return dw, r
+}
+
+func (dw *dispositionWriter) WriteHeader(status int) {
+	if !dw.wroteHeader {
+		dw.wroteHeader = true
+		if status < http.StatusBadRequest {
+			dw.setDisposition()
+		}
+	}
+	dw.ResponseWriter.WriteHeader(status)
+}
+
+func (dw *dispositionWriter) Write(p []byte) (int, error) {
+	if !dw.wroteHeader {
+		dw.WriteHeader(http.StatusOK)
+	}
+	return dw.ResponseWriter.Write(p)
+}
+
+func (dw *dispositionWriter) setDisposition() {
+	header := dw.Header()
+	cd := header.Get("Content-Disposition")
+	filename := dw.filename
+	if filename == "" {
+		filename = util.DispositionFilename(cd)
+	}
+	dtype := dw.dtype
+	if dtype == "" && dw.rule != nil {
+		dtype = dw.rule.Disposition
+		mtype := header.Get("Content-Type")
+		for _, prefix := range dw.rule.InlineTypes {
+			if strings.HasPrefix(mtype, prefix) {
+				dtype = util.DispositionInline
+				break
+			}
+		}
+	}
+	if dtype == "" {
+		// 只修改文件名时保留seaweedfs 返回的类型
+		dtype = util.DispositionInline
+		if t, _, err := mime.ParseMediaType(cd); err == nil {
+			dtype = t
+		}
+	}
+	header.Set("Content-Disposition", util.ContentDisposition(dtype, filename))
+}
@@ -0,0 +1,260 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+	"github.com/wangfeiping/weeder/util"
+)
+
+var ErrFetchHostNotAllowed = errors.New("Source host is not allowed!")
+
+type urlFetcher struct {
+	allowHosts []string
+	maxSize    int64
+	timeout    time.Duration
+	client     *http.Client
+}
+
+var fetcher *urlFetcher
+
+func initFetch(ps *ProxyServer) {
+	c := &ps.Config.Fetch
+	log.DebugS("main", "config: fetch ", c.Enable)
+	if !c.Enable {
+		return
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = 100 << 20
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 60
+	}
+	if c.MaxRedirects <= 0 {
+		c.MaxRedirects = 5
+	}
+	f := &urlFetcher{
+		allowHosts: c.AllowHosts,
+		maxSize:    c.MaxSize,
+		timeout:    time.Duration(c.Timeout) * time.Second,
+	}
+	maxRedirects := c.MaxRedirects
+	f.client = &http.Client{
+		Transport: &http.Transport{
+			// 不使用环境变量中的代理，不请求压缩内容，保存原始文件
+			Proxy:                 nil,
+			DialContext:           (&net.Dialer{Timeout: 10 * time.Second}).DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: f.timeout,
+			DisableCompression:    true,
+			MaxIdleConnsPerHost:   4,
+		},
+		// 重定向的目标同样需要在允许的主机中
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			if !f.allowed(req.URL) {
+				return ErrFetchHostNotAllowed
+			}
+			return nil
+		},
+	}
+	fetcher = f
+	log.DebugS("main", "config: fetch allowHosts ", c.AllowHosts,
+		" maxSize ", c.MaxSize, " timeout ", c.Timeout,
+		" maxRedirects ", c.MaxRedirects)
+}
+
+func (f *urlFetcher) allowed(u *url.URL) bool {
+	return (u.Scheme == "http" || u.Scheme == "https") &&
+		util.MatchHost(f.allowHosts, u.Host)
+}
+
+/**
+ * 从url 获取文件上传到seaweedfs：
+ *	POST /fetch?url=http://host/a.jpg&path=/app/dir/name.jpg&ttl=3d
+ * 可以与上传相同指定replication、collection 等存储位置参数；
+ * path 以'/'结尾时文件名使用源文件的Content-Disposition 或url 中的文件名，
+ * path 为空时与/submit 相同只返回fid；参数也可以通过表单提交
+ */
+func (ps *ProxyServer) fetchHandler(w http.ResponseWriter, r *http.Request) {
+	logHeader := &log.LogHeader{
+		TraceId:    checkGid(r),
+		Caddress:   checkRealIp(r),
+		UserId:     checkUniSource(r),
+		Key:        "request",
+		ThreadName: r.URL.Path,
+		ClassName:  "fetch",
+		MethodName: r.Method,
+	}
+	log.Info(logHeader, `{"uri":"`, r.RequestURI, `"}`)
+	result := &log.ApiResult{
+		Result:  make([]*log.FileMeta, 0, 0),
+		Message: "error",
+	}
+	if fetcher == nil {
+		writeFetchError(w, result, http.StatusNotFound,
+			errors.New("Fetch is not enabled."), logHeader)
+		return
+	}
+	if !strings.EqualFold(r.Method, "post") {
+		writeFetchError(w, result, http.StatusMethodNotAllowed,
+			errors.New("Only fetch via POST!"), logHeader)
+		return
+	}
+	if addr, ok := ps.isWritable(r.RemoteAddr); !ok {
+		writeFetchError(w, result, http.StatusNotAcceptable, fmt.Errorf(
+			"It's not allowed to upload by whitelist (%s).", addr), logHeader)
+		return
+	}
+	if ps.Config.UniSourceCheck && logHeader.UserId == "" {
+		writeFetchError(w, result, http.StatusNotAcceptable,
+			errors.New("It's not allowed to upload without Uni-Source header."), logHeader)
+		return
+	}
+	r.ParseForm()
+	stats.Incr("fetch.requests")
+	fileUploaded, status, err := ps.fetch(w, r, logHeader)
+	if err != nil {
+		stats.Incr("fetch.errors")
+		writeFetchError(w, result, status, err, logHeader)
+		return
+	}
+	fileUploaded.Url = ps.Config.FileUrlPrefix + fileUploaded.Fid
+	result.Result = append(result.Result, fileUploaded)
+	logHeader.Key = "response"
+	logHeader.Status = "ok"
+	result.Message = "ok"
+	result.Status = http.StatusOK
+	log.InfoResponse(logHeader, result, w)
+}
+
+func (ps *ProxyServer) fetch(w http.ResponseWriter, r *http.Request,
+	logHeader *log.LogHeader) (*log.FileMeta, int, error) {
+	source, err := url.Parse(r.Form.Get("url"))
+	if err != nil || source.Host == "" {
+		return nil, http.StatusBadRequest, errors.New("Bad request, invalid source url!")
+	}
+	if !fetcher.allowed(source) {
+		log.Error(logHeader, "fetch host not allowed: ", source.Host)
+		return nil, http.StatusForbidden, ErrFetchHostNotAllowed
+	}
+	target := r.Form.Get("path")
+	isFiler := target != ""
+	if isFiler && !strings.HasPrefix(target, "/") {
+		target = "/" + target
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), fetcher.timeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", source.String(), nil)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", "weeder-fetch")
+	resp, err := fetcher.client.Do(req)
+	if err != nil {
+		log.Error(logHeader, "fetch error: ", source.String(), " ", err.Error())
+		return nil, fetchErrorStatus(ctx, err), err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, http.StatusBadGateway,
+			fmt.Errorf("Source returned %s!", resp.Status)
+	}
+	if resp.ContentLength > fetcher.maxSize {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf(
+			"Source size %d exceeds the limit %d!", resp.ContentLength, fetcher.maxSize)
+	}
+	// 目标路径最后一级为文件名，以'/'结尾时使用源文件名
+	dir, filename := "/submit", ""
+	if isFiler {
+		i := strings.LastIndex(target, "/")
+		dir, filename = "/filer"+target[:i+1], target[i+1:]
+	}
+	if filename == "" {
+		// 源文件名只取最后一级，作为路径的一部分上传
+		filename = util.DispositionFilename(resp.Header.Get("Content-Disposition"))
+		if filename == "" {
+			filename = resp.Request.URL.Path
+		}
+		if filename = path.Base(filename); filename == "/" || filename == "." {
+			filename = ""
+		}
+		if filename == ".." || strings.ContainsAny(filename, "?#") {
+			return nil, http.StatusBadRequest,
+				fmt.Errorf("Source filename %s is invalid!", filename)
+		}
+	}
+	if filename == "" {
+		if isFiler {
+			return nil, http.StatusBadRequest, ErrNullFilename
+		}
+		filename = "file"
+	}
+	mtype, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		mtype = ""
+	}
+	// 按上传请求的格式构造请求，使用与上传相同的流程
+	u := *r.URL
+	u.Path = dir
+	u.RawQuery = ""
+	up := r.WithContext(ctx)
+	up.URL = &u
+	up.Form = url.Values{}
+	if ttl := r.Form.Get("ttl"); ttl != "" {
+		up.Form.Set("ttl", ttl)
+	}
+	requested := util.PlacementFromValues(r.Form)
+	requested.AddTo(up.Form)
+	limit := &policyLimitReader{Reader: resp.Body, max: fetcher.maxSize}
+	submitRootUrl, hasPath, fullpath := ps.submitUrl(up, isFiler, 0)
+	log.Debug(logHeader, "fetch ", source.String(), " -> ", submitRootUrl, " ", filename)
+	fileUploaded, err := ps.doSubmitFile(limit, resp.ContentLength, filename, mtype,
+		nil, submitRootUrl, hasPath, fullpath, w, up, isFiler, logHeader)
+	stats.Add("fetch.bytes", limit.n)
+	if err != nil && limit.exceeded {
+		return nil, http.StatusRequestEntityTooLarge,
+			fmt.Errorf("Source size exceeds the limit %d!", fetcher.maxSize)
+	} else if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, http.StatusGatewayTimeout, err
+		}
+		return nil, submitErrorStatus(err), err
+	}
+	return fileUploaded, http.StatusOK, nil
+}
+
+// 获取源文件失败时返回的http 状态码
+func fetchErrorStatus(ctx context.Context, err error) int {
+	if e, ok := err.(*url.Error); ok && e.Err == ErrFetchHostNotAllowed {
+		return http.StatusForbidden
+	}
+	if e, ok := err.(net.Error); (ok && e.Timeout()) ||
+		ctx.Err() == context.DeadlineExceeded {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusBadGateway
+}
+
+func writeFetchError(w http.ResponseWriter, result *log.ApiResult, status int,
+	err error, logHeader *log.LogHeader) {
+	logHeader.Key = "response"
+	logHeader.Status = "err"
+	result.Message = "error"
+	result.Status = status
+	result.Detail = err.Error()
+	log.ErrorResponse(logHeader, result, w)
+}
@@ -0,0 +1,135 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+	"github.com/wangfeiping/weeder/util"
+)
+
+// 是否保存上传文件的摘要并在获取文件时返回
+var fileDigestStore bool
+
+func initFileDigest(ps *ProxyServer) {
+	fileDigestStore = ps.Config.FileDigest.Enable
+	log.DebugS("main", "config: fileDigest ", fileDigestStore)
+	if fileDigestStore && metaClient() == nil {
+		log.DebugS("main", "config: fileDigest requires redis or mysql")
+		fileDigestStore = false
+	}
+}
+
+/**
+ * 读取Content-MD5 与Digest 请求头，multipart 上传时使用各文件部分的头
+ */
+func expectedDigest(header http.Header) (*util.FileDigest, error) {
+	expected, err := util.ParseExpectedDigest(header.Get("Content-MD5"),
+		header.Get("Digest"))
+	if err != nil {
+		stats.Incr("fileDigest.invalid")
+		return nil, &policyError{status: http.StatusBadRequest,
+			err: fmt.Errorf("Invalid Content-MD5 or Digest header: %s", err.Error())}
+	}
+	return expected, nil
+}
+
+/**
+ * 校验上传内容的摘要，不一致时删除已上传的文件，uploadedPath 为空时文件尚未上传
+ */
+func (ps *ProxyServer) verifyFileDigest(expected *util.FileDigest,
+	actual *util.FileDigest, uploadedPath string, isFiler bool, name string,
+	logHeader *log.LogHeader) error {
+	if expected == nil || expected.Verify(actual) == nil {
+		return nil
+	}
+	stats.Incr("fileDigest.mismatch")
+	log.Error(logHeader, "digest mismatch: ", name, " md5 ", actual.Md5,
+		" sha256 ", actual.Sha256)
+	if uploadedPath != "" {
+		if err := ps.weedDelete(nil, uploadedPath, isFiler, logHeader, 0); err != nil {
+			log.Error(logHeader, "delete mismatched file error: ", uploadedPath,
+				" ", err.Error())
+		}
+	}
+	return &policyError{status: http.StatusBadRequest,
+		err: fmt.Errorf("Content of %s does not match the digest!", name)}
+}
+
+/**
+ * 摘要按fid 保存，filer 上传时同时按路径保存
+ */
+func saveFileDigest(digest *util.FileDigest, fid string, path string,
+	logHeader *log.LogHeader) {
+	if !fileDigestStore {
+		return
+	}
+	client := metaClient()
+	keys := []string{fid}
+	if path != "" {
+		keys = append(keys, path)
+	}
+	for _, key := range keys {
+		if err := client.SetFileDigest(key, digest.String()); err != nil {
+			log.Error(logHeader, "save file digest error: ", key, " ", err.Error())
+		}
+	}
+}
+
+/**
+ * 删除或以无法计算摘要的方式（如注册chunks manifest）写入文件后删除保存的摘要，
+ * 避免返回原文件的ETag
+ */
+func deleteFileDigest(key string, logHeader *log.LogHeader) {
+	if !fileDigestStore {
+		return
+	}
+	if err := metaClient().DeleteFileDigest(key); err != nil {
+		log.Error(logHeader, "delete file digest error: ", key, " ", err.Error())
+	}
+}
+
+/**
+ * 设置ETag 与Digest 响应头，If-None-Match 与保存的摘要一致时返回304；
+ * 只处理完整的文件内容，缩放等处理后的内容摘要不同
+ */
+func (ps *ProxyServer) setDigestHeader(resp *http.Response, r *http.Request,
+	isFiler bool) {
+	if !fileDigestStore || (resp.StatusCode != http.StatusOK &&
+		resp.StatusCode != http.StatusNotModified) {
+		return
+	}
+	key := r.URL.Path
+	if !isFiler {
+		key = pathFid(r.URL.Path)
+	}
+	value, err := metaClient().GetFileDigest(key)
+	if err != nil {
+		return
+	}
+	digest, err := util.ParseFileDigest(value)
+	if err != nil {
+		return
+	}
+	etag := digest.ETag()
+	resp.Header.Set("ETag", etag)
+	resp.Header.Set("Digest", digest.DigestHeader())
+	if resp.StatusCode == http.StatusOK && etagMatches(r.Header.Get("If-None-Match"), etag) {
+		resp.Body.Close()
+		resp.Body = http.NoBody
+		resp.StatusCode = http.StatusNotModified
+		resp.Header.Del("Content-Length")
+	}
+}
+
+func etagMatches(ifNoneMatch string, etag string) bool {
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		v = strings.TrimPrefix(strings.TrimSpace(v), "W/")
+		if v == etag || v == "*" {
+			return true
+		}
+	}
+	return false
+}
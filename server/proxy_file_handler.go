@@ -23,9 +23,19 @@ import (
 var ErrBadRequest = errors.New(`Bad request!`)
 var ErrNotFound = errors.New(`File not found!`)
 var ErrNullFilename = errors.New(`Bad request, file's name is null!`)
+var ErrBadGateway = errors.New(`Bad gateway!`)
 
 var fileNameEscaper = strings.NewReplacer("\\", "\\\\", "\"", "\\\"")
 
+var forwardedDownloadHeaders = []string{
+	"Range",
+	"If-Range",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Match",
+	"If-Unmodified-Since",
+}
+
 type VolumeAssignRequest struct {
 	Count       uint64
 	Replication string
@@ -45,6 +55,7 @@ type AssignResult struct {
 }
 
 type UploadResult struct {
+	Fid   string `json:"fid,omitempty"`
 	Name  string `json:"name,omitempty"`
 	Size  uint32 `json:"size,omitempty"`
 	Error string `json:"error,omitempty"`
@@ -58,8 +69,19 @@ type FilerMeta struct {
 
 func (ps *ProxyServer) accessCheckAndGetFiler(w http.ResponseWriter, r *http.Request,
 	logHeader *log.LogHeader) {
-	if ps.isAccessible(logHeader.Caddress) {
+	// 有效的签名url 只允许访问签名的路径，不需要白名单许可
+	r, signed, err := ps.checkSignedUrl(r, logHeader)
+	if signed || ps.isAccessible(logHeader.Caddress) {
 		ps.getFileHandler(w, r, true, logHeader)
+	} else if err != nil {
+		logHeader.Key = "response"
+		logHeader.Status = "denied"
+		log.ErrorResponse(logHeader, &log.ApiResult{
+			Result:  make([]*log.FileMeta, 0, 0),
+			Message: "Does not allow access.",
+			Status:  http.StatusForbidden,
+			Detail:  err.Error(),
+		}, w)
 	} else {
 		logHeader.Key = "response"
 		logHeader.Status = "denied"
@@ -100,24 +122,45 @@ func (ps *ProxyServer) getFileHandler(w http.ResponseWriter, r *http.Request,
 		log.Error(logHeader, ret)
 		return
 	}
-	//	err := ps.download(w, r, 0, isFiler, logHeader)
-	retry := int32(0)
-	err := ps.download(w, r, retry, isFiler, logHeader)
-	for err != nil && retry < ps.Config.Retry {
-		retry++
-		log.Debug(logHeader, err.Error(), " retry: ", retry)
-		err = ps.download(w, r, retry, isFiler, logHeader)
+	w, r = ps.withDisposition(w, r)
+	w = ps.throttleDownload(w, r, logHeader)
+	if ps.serveDiskCache(w, r, false) {
+		logHeader.Key = "response"
+		logHeader.Status = "ok"
+		log.Info(logHeader, `{"detail":"disk cache"}`)
+		return
+	}
+	var err error
+	if imageResize != nil && isResizeRequest(r) {
+		err = ps.resizedDownload(w, r, isFiler, logHeader)
+	} else if coalescer != nil && ps.coalescable(r) {
+		err = ps.coalescedDownload(w, r, isFiler, logHeader)
+	} else {
+		err = ps.downloadWithRetry(w, r, isFiler, logHeader)
 	}
 	r.Body.Close()
 	//	var err error = nil
 	if err == nil {
-		w.WriteHeader(http.StatusOK)
 		logHeader.Key = "response"
 		logHeader.ClassName = "getfile"
 		logHeader.Status = "ok"
 		log.Info(logHeader)
 		return
 	}
+	if isWrittenError(err) {
+		// 响应状态已经返回给客户端，只记录错误
+		logHeader.Key = "response"
+		logHeader.Status = "err"
+		log.Error(logHeader, err.Error())
+		return
+	}
+	if err != ErrNotFound && ps.Config.DiskCache.ServeStale &&
+		ps.serveDiskCache(w, r, true) {
+		logHeader.Key = "response"
+		logHeader.Status = "ok"
+		log.Info(logHeader, `{"detail":"stale disk cache - `, err.Error(), `"}`)
+		return
+	}
 	var p *log.ApiResult
 	// 使用ab 进行压力测试，反复测试后，还是会发生reset by peer 的err，
 	// 但发生比较偶然，还没有确定具体原因。
@@ -133,6 +176,14 @@ func (ps *ProxyServer) getFileHandler(w http.ResponseWriter, r *http.Request,
 			Status:  1000,
 			Detail:  err.Error(),
 		}
+	} else if ie, ok := err.(*imageError); ok {
+		w.WriteHeader(ie.status)
+		p = &log.ApiResult{
+			Result:  make([]*log.FileMeta, 0, 0),
+			Message: "Can't process the image! " + r.RequestURI,
+			Status:  ie.status,
+			Detail:  err.Error(),
+		}
 	} else if err == ErrNotFound {
 		w.WriteHeader(http.StatusNotFound)
 		p = &log.ApiResult{
@@ -258,36 +309,105 @@ func (ps *ProxyServer) deleteFile(w http.ResponseWriter,
 		log.ErrorResponse(logHeader, result, w)
 		return
 	}
+	var status int
+	var err error
+	if isFiler && strings.HasSuffix(filepath, "/") {
+		status, err = ps.removeFilerDir(filepath, logHeader)
+	} else {
+		status, err = ps.removeFile(filepath, isFiler, logHeader)
+	}
+	if err != nil {
+		logHeader.Status = "err"
+		result.Status = status
+		result.Message = "error"
+		result.Detail = err.Error()
+		log.ErrorResponse(logHeader, result, w)
+		return
+	}
+	logHeader.Status = "ok"
+	log.InfoResponse(logHeader, result, w)
+}
+
+/**
+ * 删除文件及镜像、衍生图片与缓存，返回失败时的http 状态码；
+ * 调用前已检查白名单与Uni-Source
+ */
+func (ps *ProxyServer) removeFile(filepath string, isFiler bool,
+	logHeader *log.LogHeader) (int, error) {
 	err := ps.qiniuDelete(filepath[1:])
 	if err != nil {
 		if strings.Contains(err.Error(), "no such file") {
 			log.Debug(logHeader, "qiniu delete error - ", err.Error())
 		} else {
-			logHeader.Status = "err"
-			result.Status = http.StatusInternalServerError
-			result.Message = "error"
-			result.Detail = fmt.Sprint("qiniu delete error - ", err.Error())
-			log.ErrorResponse(logHeader, result, w)
-			return
+			return http.StatusInternalServerError,
+				fmt.Errorf("qiniu delete error - %s", err.Error())
+		}
+	}
+	// 去重上传的文件仍被其他路径引用时只减少引用计数
+	var ref *dedupRef
+	var shared bool
+	if dedup != nil {
+		if ref, shared, err = ps.releaseDeletedFile(filepath, isFiler, logHeader); err != nil {
+			return http.StatusInternalServerError,
+				fmt.Errorf("dedup release error - %s", err.Error())
 		}
 	}
 	retry := int32(0)
-	err = ps.weedDelete(w, filepath, isFiler, logHeader, retry)
+	if !shared {
+		err = ps.weedDelete(nil, filepath, isFiler, logHeader, retry)
+	}
 	for err != nil && retry < ps.Config.Retry {
 		retry++
 		log.Debug(logHeader, err.Error(), " retry: ", retry)
-		err = ps.weedDelete(w, filepath, isFiler, logHeader, retry)
+		err = ps.weedDelete(nil, filepath, isFiler, logHeader, retry)
+	}
+	if err != nil && ref != nil {
+		ps.restoreDedupRef(ref, logHeader)
+		if isFiler && ref.refs > 0 {
+			ps.registerFilerPath(ref.fid, filepath, logHeader)
+		}
+	} else if ref != nil {
+		dedupPath := ""
+		if isFiler {
+			dedupPath = filepath
+		}
+		ps.dropDedupRef(ref, dedupPath)
 	}
 	if err != nil {
-		logHeader.Status = "err"
-		result.Status = http.StatusInternalServerError
-		result.Message = "error"
-		result.Detail = fmt.Sprint("seaweedfs delete error - ", err.Error())
-		log.ErrorResponse(logHeader, result, w)
-		return
+		return http.StatusInternalServerError,
+			fmt.Errorf("seaweedfs delete error - %s", err.Error())
 	}
-	logHeader.Status = "ok"
-	log.InfoResponse(logHeader, result, w)
+	if isFiler {
+		deleteFileDigest(filepath, logHeader)
+	} else {
+		deleteFileDigest(pathFid(filepath), logHeader)
+	}
+	invalidateCache(filepath)
+	ps.mirrorDelete(filepath, isFiler, logHeader)
+	if isFiler && derivatives != nil {
+		ps.deleteDerivatives(filepath, logHeader)
+	}
+	return http.StatusOK, nil
+}
+
+/**
+ * 目录直接由filer 删除，不带recursive 参数时filer 只删除空目录；
+ * 递归删除目录及其中的文件需要通过/delete/dir
+ */
+func (ps *ProxyServer) removeFilerDir(dir string, logHeader *log.LogHeader) (int, error) {
+	retry := int32(0)
+	err := ps.weedDelete(nil, dir, true, logHeader, retry)
+	for err != nil && retry < ps.Config.Retry {
+		retry++
+		log.Debug(logHeader, err.Error(), " retry: ", retry)
+		err = ps.weedDelete(nil, dir, true, logHeader, retry)
+	}
+	if err != nil {
+		return http.StatusInternalServerError,
+			fmt.Errorf("seaweedfs delete error - %s", err.Error())
+	}
+	ps.mirrorDelete(dir, true, logHeader)
+	return http.StatusOK, nil
 }
 
 func (ps *ProxyServer) qiniuDelete(filepath string) error {
@@ -304,8 +424,12 @@ func (ps *ProxyServer) qiniuDelete(filepath string) error {
 	return nil
 }
 
+// uri 为未转义的路径，filer 路径中的文件名可能包含%、? 等字符
 func (ps *ProxyServer) weedDelete(w http.ResponseWriter, uri string,
 	isFiler bool, logHeader *log.LogHeader, retry int32) error {
+	if isFiler {
+		uri = (&url.URL{Path: uri}).EscapedPath()
+	}
 	targetUrl := ps.getFileUrl(uri, isFiler, retry)
 	if isFiler {
 		return deleteRequest(logHeader, targetUrl)
@@ -356,6 +480,10 @@ func deleteRequest(logHeader *log.LogHeader, targetUrl string) (err error) {
 		Detail:  fmt.Sprint(resp.Status, " - ", string(respBytes)),
 	}
 	log.DebugResponse(logHeader, result)
+	// 文件不存在等4xx 响应按删除成功处理，服务端错误时重试
+	if resp.StatusCode >= http.StatusInternalServerError {
+		err = errors.New(result.Detail)
+	}
 	return
 }
 
@@ -416,8 +544,9 @@ func (ps *ProxyServer) submit(w http.ResponseWriter, r *http.Request,
 		log.ErrorResponse(logHeader, result, w)
 		return
 	}
-	if !strings.EqualFold(r.Method, "post") {
-		ret := `{\"result\":[], \"message\":\"Only submit via POST!\", \"status\":405}`
+	if !strings.EqualFold(r.Method, "post") &&
+		!(isFiler && strings.EqualFold(r.Method, "put")) {
+		ret := `{"result":[], "message":"Only submit via POST or PUT!", "status":405}`
 		w.WriteHeader(http.StatusMethodNotAllowed)
 		w.Write([]byte(ret))
 		w.Write([]byte("\n"))
@@ -452,27 +581,51 @@ func (ps *ProxyServer) submit(w http.ResponseWriter, r *http.Request,
 	//	7M: 7 months
 	//	8y: 8 years
 	//
-	r.ParseForm()
-	err := util.ParseMultipartForm(r)
+	ps.throttleUpload(r, logHeader)
+	bodyLimit, err := ps.limitUploadRequest(r, isFiler, logHeader.UserId)
 	if err != nil {
 		logHeader.Key = "response"
 		logHeader.Status = "err"
 		result.Message = "error"
-		result.Status = http.StatusBadRequest
+		result.Status = submitErrorStatus(err)
 		result.Detail = err.Error()
-
 		log.ErrorResponse(logHeader, result, w)
 		return
 	}
-	// 检查并上传文件
-	//	fmt.Printf("the pointer is (&result.Result): %p \n", &result.Result)
-	//	fmt.Printf("the pointer is (result.Result): %p \n", result.Result)
-	retCode, err := ps.doSubmit(r.MultipartForm.File, w, r,
-		isFiler, logHeader, &result.Result)
+	var retCode, fileCount int
+	if isMultipartRequest(r) {
+		r.ParseForm()
+		// 逐个读取multipart 中的文件并直接上传，不需要先缓存整个请求
+		var reader *multipart.Reader
+		reader, err = r.MultipartReader()
+		if err != nil {
+			logHeader.Key = "response"
+			logHeader.Status = "err"
+			result.Message = "error"
+			result.Status = http.StatusBadRequest
+			result.Detail = err.Error()
+
+			log.ErrorResponse(logHeader, result, w)
+			return
+		}
+		// 检查并上传文件
+		//	fmt.Printf("the pointer is (&result.Result): %p \n", &result.Result)
+		//	fmt.Printf("the pointer is (result.Result): %p \n", result.Result)
+		retCode, fileCount, err = ps.doSubmit(reader, w, r,
+			isFiler, logHeader, &result.Result)
+	} else {
+		// 请求内容即文件内容
+		retCode, fileCount, err = ps.doSubmitRaw(w, r,
+			isFiler, logHeader, &result.Result)
+	}
+	if err != nil && bodyLimit != nil && bodyLimit.exceeded {
+		retCode = http.StatusRequestEntityTooLarge
+		err = fmt.Errorf("Request size exceeds the limit %d!", bodyLimit.max)
+	}
 	// 处理路径设置
 	if err == nil {
 		var neverUpload bool
-		if len(r.MultipartForm.File) == 0 {
+		if fileCount == 0 {
 			neverUpload = true
 		}
 		// 检查并保存path ttl 参数设置
@@ -481,7 +634,7 @@ func (ps *ProxyServer) submit(w http.ResponseWriter, r *http.Request,
 		//			log.Debug(gid, "MultipartForm.Value: ", p, "=", n, "=", val)
 		//		}
 		//	}
-		paths := r.MultipartForm.Value["path"]
+		paths := r.Form["path"]
 		var path, query, ttl string
 		var vals url.Values
 		for _, val := range paths {
@@ -536,83 +689,180 @@ func (ps *ProxyServer) submit(w http.ResponseWriter, r *http.Request,
 
 /**
  * 向master 服务器转发文件
+ *
+ * 按顺序读取multipart 中的各部分：表单参数保存到r.Form，文件读取后直接上传，
+ * 因此ttl 及存储位置参数需要在文件之前，在文件之后时返回400；
+ * 包含meta 部分时，其后的第一个文件为chunks manifest，注册后返回。
  */
-func (ps *ProxyServer) doSubmit(files map[string][]*multipart.FileHeader,
+func (ps *ProxyServer) doSubmit(reader *multipart.Reader,
 	w http.ResponseWriter, r *http.Request, isFiler bool,
-	logHeader *log.LogHeader, metas *[]*log.FileMeta) (int, error) {
+	logHeader *log.LogHeader, metas *[]*log.FileMeta) (int, int, error) {
 	// 普通上传操作
 	submitRootUrl, hasPath, fullpath := ps.submitUrl(r, isFiler, 0)
-	log.Debug(logHeader,
-		"files ", len(files), " ", submitRootUrl)
-	var err error
-	meta, file := checkMeta(files)
-	if meta != nil {
-		//		var fileUploaded *log.FileMeta
-		//		// 元数据按照指定路径上传并获取fid
-		//		fileUploaded, err = ps.doSubmitFile(file,
-		//			submitRootUrl, hasPath, fullpath, w, r, isFiler, logHeader)
-		//		if err == ErrNullFilename {
-		//			return http.StatusBadRequest, err
-		//		} else if err != nil {
-		//			return http.StatusInternalServerError, err
-		//		}
-		//		// 元数据上传注册
-		//		var bs []byte
-		//		bs, err = metaUploadRequest(meta, file, fileUploaded, logHeader)
-		//		if err != nil {
-		//			return http.StatusInternalServerError, err
-		//		}
-		//		metaResp := string(bs)
-		//		if ps.Config.DebugDetailLog {
-		//			log.Debug(logHeader, "meta upload result: ", metaResp)
-		//		}
-		//		if strings.Contains(metaResp, `"error"`) {
-		//			return http.StatusBadRequest, ErrBadRequest
-		//		}
-		//		*metas = append(*metas, fileUploaded)
-		//		fileUploaded.Url = ps.Config.FileUrlPrefix + fileUploaded.Fid
-		//		//		fmt.Printf("the pointer is (metas) 2: %p \n", metas)
-		//		return http.StatusOK, nil
-		fileMeta := &log.FileMeta{}
-		var status int
-		status, err = ps.registerChunkedFileMeta(meta, file, fullpath,
-			fileMeta, w, r, logHeader)
-		//		fileUploaded.Fid = fid
-		if err != nil {
-			return status, err
+	log.Debug(logHeader, "submit ", submitRootUrl)
+	policy := ps.uploadPolicy(requestPolicyPath(r, isFiler), logHeader.UserId)
+	fileCount := 0
+	hasMeta := false
+	// 请求失败时删除之前已上传的文件（及衍生图片），不返回已删除的fid；
+	// filer 路径只删除本次请求新建的，覆盖的已有文件保留
+	uploaded := len(*metas)
+	var paths []string
+	fail := func(status int, err error) (int, int, error) {
+		for i, meta := range (*metas)[uploaded:] {
+			path := "/" + meta.Fid
+			if isFiler {
+				if paths[i] == "" {
+					continue
+				}
+				path = paths[i]
+			}
+			if _, e := ps.removeFile(path, isFiler, logHeader); e != nil {
+				log.Error(logHeader, "remove uploaded file error: ", path, " ", e.Error())
+			}
+		}
+		*metas = (*metas)[:uploaded]
+		return status, fileCount, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fail(http.StatusBadRequest, err)
 		}
-		*metas = append(*metas, fileMeta)
-		return status, nil
-	}
-	var fileUploaded *log.FileMeta
-	for _, fhs := range files {
-		if len(fhs) > 0 {
-			fileUploaded, err = ps.doSubmitFile(fhs[0],
-				submitRootUrl, hasPath, fullpath, w, r, isFiler, logHeader)
-			if err == ErrNullFilename {
-				return http.StatusBadRequest, err
-			} else if err != nil {
-				return http.StatusInternalServerError, err
+		name := part.FormName()
+		if strings.EqualFold("meta", name) {
+			hasMeta = true
+			io.Copy(ioutil.Discard, part)
+			continue
+		}
+		if part.FileName() == "" {
+			value, e := readFormValue(part)
+			if e != nil {
+				return fail(http.StatusBadRequest, e)
 			}
-			*metas = append(*metas, fileUploaded)
-			fileUploaded.Url = ps.Config.FileUrlPrefix + fileUploaded.Fid
-		} else {
-			return http.StatusBadRequest, ErrBadRequest
+			if fileCount > 0 && (name == "ttl" || util.IsPlacementParam(name)) {
+				e = &policyError{status: http.StatusBadRequest,
+					err: fmt.Errorf("Parameter %s must precede the files!", name)}
+				return fail(http.StatusBadRequest, e)
+			}
+			r.Form.Add(name, value)
+			continue
+		}
+		fileCount++
+		if policy != nil && policy.MaxFiles > 0 && fileCount > policy.MaxFiles {
+			err = newPolicyError(http.StatusBadRequest,
+				"Too many files, at most %d files per request!", policy.MaxFiles)
+			return fail(http.StatusBadRequest, err)
+		}
+		if hasMeta {
+			fileMeta := &log.FileMeta{}
+			status, e := ps.registerChunkedFileMeta(part, fullpath,
+				fileMeta, w, r, logHeader)
+			if e != nil {
+				return fail(status, e)
+			}
+			*metas = append(*metas, fileMeta)
+			return status, fileCount, nil
+		}
+		filename := partFilename(part)
+		var filePath string
+		if isFiler {
+			// 无法确定路径是否已存在时按已存在处理，失败时不删除
+			filePath = submitFilePath(fullpath, filename)
+			if exists, _, e := ps.filerETag(filePath); e != nil || exists {
+				filePath = ""
+			}
+		}
+		fileUploaded, e := ps.doSubmitFile(part, -1, filename, "",
+			http.Header(part.Header), submitRootUrl, hasPath, fullpath, w, r, isFiler, logHeader)
+		if e != nil {
+			return fail(submitErrorStatus(e), e)
+		}
+		*metas = append(*metas, fileUploaded)
+		paths = append(paths, filePath)
+		fileUploaded.Url = ps.Config.FileUrlPrefix + fileUploaded.Fid
+	}
+	return http.StatusOK, fileCount, nil
+}
+
+/**
+ * 请求内容即文件内容的上传：
+ *	PUT /filer/app/dir/name.ext 上传到指定路径与文件名；
+ *	POST /submit 上传并返回fid，文件名由filename 参数或Content-Disposition 请求头指定。
+ * 文件类型使用Content-Type 请求头，ttl 由查询参数或Ttl 请求头指定。
+ */
+func (ps *ProxyServer) doSubmitRaw(w http.ResponseWriter, r *http.Request,
+	isFiler bool, logHeader *log.LogHeader, metas *[]*log.FileMeta) (int, int, error) {
+	// 请求内容不是表单，只使用查询参数
+	r.Form = r.URL.Query()
+	if r.Form.Get("ttl") == "" && r.Header.Get("Ttl") != "" {
+		r.Form.Set("ttl", r.Header.Get("Ttl"))
+	}
+	filename := r.Form.Get("filename")
+	if filename == "" {
+		filename = util.DispositionFilename(r.Header.Get("Content-Disposition"))
+	}
+	if isFiler && !strings.HasSuffix(r.URL.Path, "/") {
+		// 路径最后一级为文件名，其余部分为上传路径
+		i := strings.LastIndex(r.URL.Path, "/")
+		filename = r.URL.Path[i+1:]
+		u := *r.URL
+		u.Path = r.URL.Path[:i+1]
+		r = r.WithContext(r.Context())
+		r.URL = &u
+	}
+	if filename == "" {
+		if isFiler {
+			return http.StatusBadRequest, 0, ErrNullFilename
 		}
+		filename = "file"
 	}
+	mtype, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mtype == "application/x-www-form-urlencoded" {
+		// curl --data-binary 等客户端默认使用表单类型
+		mtype = ""
+	}
+	submitRootUrl, hasPath, fullpath := ps.submitUrl(r, isFiler, 0)
+	log.Debug(logHeader, "submit ", submitRootUrl)
+	fileUploaded, err := ps.doSubmitFile(r.Body, r.ContentLength, filename, mtype,
+		r.Header, submitRootUrl, hasPath, fullpath, w, r, isFiler, logHeader)
+	if err != nil {
+		return submitErrorStatus(err), 1, err
+	}
+	*metas = append(*metas, fileUploaded)
+	fileUploaded.Url = ps.Config.FileUrlPrefix + fileUploaded.Fid
+	return http.StatusOK, 1, nil
+}
 
-	return http.StatusOK, nil
+// 上传文件对应的filer 路径，filename 可以包含路径及查询参数
+func submitFilePath(fullpath string, filename string) string {
+	if !strings.HasPrefix(filename, "/") {
+		filename = "/" + filename
+	}
+	fileUrl, err := url.ParseRequestURI(filename)
+	if err != nil {
+		return fullpath + filename
+	}
+	return fullpath + fileUrl.Path
 }
 
-func (ps *ProxyServer) doSubmitFile(file *multipart.FileHeader,
+/**
+ * 上传一个文件，filename 可以包含路径及?ttl=3m 参数，mtype 为空时使用application/octet-stream，
+ * size 为-1 时文件大小未知；header 中的Content-MD5 与Digest 用于校验文件内容
+ */
+func (ps *ProxyServer) doSubmitFile(file io.Reader, size int64,
+	filename string, mtype string, header http.Header,
 	submitRootUrl string, hasPath bool, fullpath string,
 	w http.ResponseWriter, r *http.Request,
 	isFiler bool, logHeader *log.LogHeader) (*log.FileMeta, error) {
-	retry := int32(0)
-	filename := file.Filename
 	if ps.Config.DebugDetailLog {
 		log.Debug(logHeader, " filename=", filename)
 	}
+	expected, err := expectedDigest(header)
+	if err != nil {
+		return nil, err
+	}
 	submitUrl, err := checkUrl(isFiler, submitRootUrl,
 		filename, hasPath, w)
 	if err != nil {
@@ -635,27 +885,210 @@ func (ps *ProxyServer) doSubmitFile(file *multipart.FileHeader,
 	if ttl == "" {
 		ttl = r.Form.Get("ttl")
 	}
+	policyPath := "/submit"
+	if isFiler {
+		policyPath = fullpath + fileUrl.Path
+	}
+	placement, err := ps.uploadPlacement(r.Form, policyPath, logHeader.UserId)
+	if err != nil {
+		return nil, err
+	}
+	query := make(url.Values)
 	if !strings.EqualFold(ps.Config.DevEnvEnforcedTtl, "") {
-		submitUrl = submitUrl + "?ttl=" + ps.Config.DevEnvEnforcedTtl
+		query.Set("ttl", ps.Config.DevEnvEnforcedTtl)
 	} else if !strings.EqualFold(ttl, "") {
-		submitUrl = submitUrl + "?ttl=" + ttl
+		query.Set("ttl", ttl)
+	}
+	placement.AddTo(query)
+	var submitQuery string
+	if len(query) > 0 {
+		submitQuery = "?" + query.Encode()
+	}
+	submitUrl = submitUrl + submitQuery
+	// 按上传规则检查文件，不符合规则的文件不写入镜像队列
+	var fileLimit *policyLimitReader
+	policy := ps.uploadPolicy(policyPath, logHeader.UserId)
+	if policy != nil {
+		file, fileLimit, err = checkUploadFile(policy, file, size, fileUrl.Path[1:], mtype)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// 条件上传与只写一次的路径，检查已存在的文件后再上传
+	if isFiler {
+		unlock, err := ps.checkUploadCondition(r, policyPath, policy, logHeader)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+	// 上传内容同时计算摘要，并写入镜像队列临时文件与衍生图片缓冲区
+	digester := util.NewDigester()
+	tees := []io.Writer{digester}
+	var spool *mirrorSpool
+	if mirror != nil {
+		if spool, err = mirror.spool(); err == nil {
+			defer spool.discard()
+			tees = append(tees, spool)
+		} else {
+			log.Error(logHeader, "mirror spool error: ", err.Error())
+		}
+	}
+	var image *limitedBuffer
+	if isFiler && derivatives != nil && derivativeRule(fullpath+fileUrl.Path) != nil {
+		image = &limitedBuffer{max: derivatives.MaxSourceSize}
+		tees = append(tees, image)
+	}
+	src := io.TeeReader(file, io.MultiWriter(tees...))
+	var filerPath string
+	if isFiler {
+		filerPath = fullpath + fileUrl.Path
 	}
-	msg, err := ps.doUpload(r, file, fileUrl.Path,
+	// 设置了ttl 的文件会过期，不参与去重
+	var dedupData []byte
+	var dupFid string
+	if dedup != nil && ttl == "" && strings.EqualFold(ps.Config.DevEnvEnforcedTtl, "") {
+		if src, dedupData, err = dedup.buffer(src, size); err != nil {
+			return nil, err
+		}
+		if dedupData != nil {
+			size = int64(len(dedupData))
+			// 内容已全部读取，使用已存在的文件前先校验摘要
+			if err = ps.verifyFileDigest(expected, digester.Sum(), "", isFiler,
+				fileUrl.Path[1:], logHeader); err != nil {
+				return nil, err
+			}
+			dupFid = ps.dedupLookup(digester.Sum(), placement, logHeader)
+		}
+	}
+	// 以下filer 上传先上传到fid，再通过/admin/register 映射路径，filer 不删除原fid：
+	// 需要校验摘要时校验通过后再映射，内容不一致时原文件不受影响；
+	// 原文件是去重上传的文件时，映射成功后再释放原文件的引用
+	registerLater := isFiler && dupFid == "" &&
+		(expected != nil || (dedup != nil && ps.dedupPathTracked(filerPath)))
+	chunked := false
+	if autoChunk != nil && dupFid == "" {
+		if src, chunked, err = autoChunk.detect(src, size); err != nil {
+			return nil, err
+		}
+	}
+	var fileJson *log.FileMeta
+	if dupFid != "" {
+		// 内容相同的文件已上传，只映射路径
+		if isFiler {
+			if err = ps.registerFilerPath(dupFid, filerPath, logHeader); err != nil {
+				metaClient().IncrFileRef(dupFid, -1)
+				return nil, err
+			}
+		}
+		fileJson = &log.FileMeta{
+			Name: filepath.Base(fileUrl.Path),
+			Fid:  dupFid,
+			Size: int(size),
+		}
+	} else if chunked {
+		// 大文件由weeder 分片上传，filer 路径通过/admin/register 注册
+		var registerPath string
+		if isFiler && !registerLater {
+			registerPath = filerPath
+		}
+		chunkTtl := ttl
+		if !strings.EqualFold(ps.Config.DevEnvEnforcedTtl, "") {
+			chunkTtl = ps.Config.DevEnvEnforcedTtl
+		}
+		fileJson, err = ps.autoChunkUpload(src, filepath.Base(fileUrl.Path), mtype,
+			chunkTtl, registerPath, placement, logHeader)
+	} else if registerLater {
+		submitRootUrl, _, _ := ps.submitUrl(r, false, 0)
+		fileJson, err = ps.uploadFile(src, filename, fileUrl.Path, mtype,
+			submitRootUrl+submitQuery, submitQuery, w, r, false, logHeader)
+	} else {
+		fileJson, err = ps.uploadFile(src, filename, fileUrl.Path, mtype,
+			submitUrl, submitQuery, w, r, isFiler, logHeader)
+	}
+	if err != nil && fileLimit != nil && fileLimit.exceeded {
+		return nil, newPolicyError(http.StatusRequestEntityTooLarge,
+			"File size of %s exceeds the limit %d!", fileUrl.Path[1:], fileLimit.max)
+	} else if err != nil {
+		return nil, err
+	}
+	uploadedPath := "/" + fileJson.Fid
+	if isFiler && !registerLater {
+		uploadedPath = filerPath
+	}
+	digest := digester.Sum()
+	if err = ps.verifyFileDigest(expected, digest, uploadedPath, isFiler && !registerLater,
+		fileUrl.Path[1:], logHeader); err != nil {
+		return nil, err
+	}
+	if registerLater {
+		if err = ps.registerFilerPath(fileJson.Fid, filerPath, logHeader); err != nil {
+			ps.deleteFids([]string{fileJson.Fid}, logHeader)
+			return nil, err
+		}
+		uploadedPath = filerPath
+	}
+	// 新文件映射成功后释放原文件的引用，需要在索引新文件之前
+	if isFiler && dedup != nil {
+		if e := ps.replaceDedupPath(filerPath, logHeader); e != nil {
+			log.Error(logHeader, "dedup release error: ", filerPath, " ", e.Error())
+		}
+	}
+	fileJson.Md5 = digest.Md5
+	fileJson.Sha256 = digest.Sha256
+	if dedupData != nil {
+		ps.indexDedup(digest, placement, fileJson.Fid, filerPath, dupFid == "", logHeader)
+	}
+	saveFileDigest(digest, fileJson.Fid, filerPath, logHeader)
+	if isFiler && ps.Config.RedisCacheTtl != "" {
+		redisclient.CacheFilePath(
+			filerPath, fileJson.Fid, ps.Config.RedisCacheTtl)
+		log.Debug(logHeader, "cache file path -> ", filerPath, ", ",
+			fileJson.Fid, ", ", ps.Config.RedisCacheTtl)
+	}
+	invalidateCache(uploadedPath)
+	if !strings.EqualFold(ps.Config.DevEnvEnforcedTtl, "") {
+		ttl = ps.Config.DevEnvEnforcedTtl
+	}
+	if spool != nil {
+		ps.mirrorUploadSpool(uploadedPath, isFiler, fileUrl.Path[1:], ttl, placement,
+			spool, logHeader)
+	}
+	if image != nil && !image.overflow {
+		fileJson.Derivatives = ps.generateDerivatives(image.Bytes(),
+			uploadedPath, ttl, placement, logHeader)
+	}
+	return fileJson, nil
+}
+
+/**
+ * 通过一次请求上传文件，读取的内容未超过重试缓冲区时失败重试，
+ * 重试时使用其他服务器并添加相同的ttl 与存储位置参数submitQuery
+ */
+func (ps *ProxyServer) uploadFile(src io.Reader, filename string, name string,
+	mtype string, submitUrl string, submitQuery string,
+	w http.ResponseWriter, r *http.Request,
+	isFiler bool, logHeader *log.LogHeader) (*log.FileMeta, error) {
+	retry := int32(0)
+	body := newReplayReader(src, uploadRetryBufferSize)
+	msg, err := ps.doUpload(r, body, name, mtype,
 		w, submitUrl, logHeader)
 	for err != nil {
-		if retry > ps.Config.Retry {
+		if retry > ps.Config.Retry || !body.Rewind() {
+			// 已读取的内容超过重试缓冲区时不能重试
 			log.Error(logHeader, "submit:", "file", err)
 			return nil, err
 		} else {
 			retry++
 			log.Error(logHeader, "submit: ", "retrying ", retry, " file ", err)
-			submitRootUrl, hasPath, fullpath = ps.submitUrl(r, isFiler, retry)
+			submitRootUrl, hasPath, _ := ps.submitUrl(r, isFiler, retry)
 			submitUrl, err = checkUrl(isFiler, submitRootUrl,
 				filename, hasPath, w)
 			if err != nil {
 				return nil, err
 			}
-			msg, err = ps.doUpload(r, file, fileUrl.Path,
+			submitUrl = submitUrl + submitQuery
+			msg, err = ps.doUpload(r, body, name, mtype,
 				w, submitUrl, logHeader)
 		}
 	}
@@ -668,77 +1101,34 @@ func (ps *ProxyServer) doSubmitFile(file *multipart.FileHeader,
 	if fileJson.Error != "" {
 		return nil, errors.New("Error uploading file(s)!")
 	}
-	if isFiler {
-		filepath := fullpath + fileUrl.Path
-		if ps.Config.RedisCacheTtl != "" {
-			redisclient.CacheFilePath(
-				filepath, fileJson.Fid, ps.Config.RedisCacheTtl)
-			log.Debug(logHeader, "cache file path -> ", filepath, ", ",
-				fileJson.Fid, ", ", ps.Config.RedisCacheTtl)
-		}
-	}
 	return &fileJson, nil
 }
 
-func (ps *ProxyServer) doUpload(r *http.Request, fh *multipart.FileHeader,
-	filename string, w http.ResponseWriter, submitUrl string,
+func (ps *ProxyServer) doUpload(r *http.Request, f io.Reader,
+	filename string, mtype string, w http.ResponseWriter, submitUrl string,
 	logHeader *log.LogHeader) (string, error) {
-	f, err := fh.Open()
-	if err != nil {
-		return `{"error":"Error parsing request!"}`, err
-	}
-	defer func() {
-		f.Close()
-	}()
 	if ps.Config.DebugDetailLog {
 		log.Debug(logHeader, " filename=", filename, " uploading... ", submitUrl)
 	}
-	return ps.upload(filename, f, submitUrl, r, logHeader)
+	return ps.upload(filename, f, mtype, submitUrl, r, logHeader)
 }
 
-func (ps *ProxyServer) upload(filename string, f multipart.File,
+func (ps *ProxyServer) upload(filename string, f io.Reader, mtype string,
 	submitUrl string, r *http.Request, logHeader *log.LogHeader) (string, error) {
-	buf := new(bytes.Buffer)
-	multipartWriter := multipart.NewWriter(buf)
 	// Create file field
-	formWriter, err := multipartWriter.CreateFormFile(filename, filename)
-	if err != nil {
-		return "", err
-	}
-	//	_, err = io.Copy(formWriter, f)
-	bufFile := make([]byte, 32*1024)
-	for {
-		nr, er := f.Read(bufFile)
-		if nr > 0 {
-			nw, ew := formWriter.Write(bufFile[0:nr])
-			if ew != nil {
-				err = ew
-				break
-			}
-			if nr != nw {
-				err = io.ErrShortWrite
-				break
-			}
-		}
-		if er == io.EOF {
-			break
-		}
-		if er != nil {
-			err = er
-			break
-		}
-	}
-	if err != nil {
-		return "", err
-	}
-	multipartWriter.Close()
-	req, err := http.NewRequest("POST", submitUrl, buf)
-	if err != nil {
-		return "", err
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+		fileNameEscaper.Replace(filename), fileNameEscaper.Replace(filename)))
+	if mtype == "" {
+		mtype = "application/octet-stream"
 	}
-	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	h.Set("Content-Type", mtype)
 	var client http.Client
-	resp, err := client.Do(req)
+	resp, err := postMultipart(&client, submitUrl, h, func(w io.Writer) error {
+		bufFile := make([]byte, 32*1024)
+		_, e := io.CopyBuffer(w, f, bufFile)
+		return e
+	}, nil)
 	if err != nil {
 		return "", err
 	}
@@ -765,6 +1155,19 @@ func (ps *ProxyServer) upload(filename string, f multipart.File,
 	return string(resultJson), nil
 }
 
+func (ps *ProxyServer) downloadWithRetry(w http.ResponseWriter, r *http.Request,
+	isFiler bool, logHeader *log.LogHeader) error {
+	//	err := ps.download(w, r, 0, isFiler, logHeader)
+	retry := int32(0)
+	err := ps.download(w, r, retry, isFiler, logHeader)
+	for err != nil && !isWrittenError(err) && retry < ps.Config.Retry {
+		retry++
+		log.Debug(logHeader, err.Error(), " retry: ", retry)
+		err = ps.download(w, r, retry, isFiler, logHeader)
+	}
+	return err
+}
+
 func (ps *ProxyServer) download(w http.ResponseWriter, r *http.Request,
 	retry int32, isFiler bool, logHeader *log.LogHeader) error {
 	url := ps.getFileUrl(r.RequestURI, isFiler, retry)
@@ -780,13 +1183,18 @@ func (ps *ProxyServer) download(w http.ResponseWriter, r *http.Request,
 	//  否则会输出 runtime error: invalid memory address or nil pointer dereference
 	//	resp, err := http.Get(url)
 	//  https: //studygolang.com/articles/9190
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := newDownloadRequest(url, r)
 	if err != nil {
 		return err
 	}
 	req.Close = false //true
 	//	resp, err := http.DefaultClient.Do(req)
-	resp, err := weedHttpClient.Do(req)
+	var resp *http.Response
+	if !isFiler && hedgedReads != nil {
+		resp, err = ps.hedgedDownload(req, r.RequestURI, logHeader)
+	} else {
+		resp, err = weedHttpClient.Do(req)
+	}
 	if err != nil {
 		log.Debug(logHeader, "getfile: ", err)
 		if retry < ps.Config.Retry {
@@ -794,9 +1202,17 @@ func (ps *ProxyServer) download(w http.ResponseWriter, r *http.Request,
 		}
 	} else {
 		if resp.StatusCode != http.StatusNotFound {
+			ps.setDigestHeader(resp, r, isFiler)
 			return ps.writeResponseContent(resp, w, r)
 		}
 		resp.Body.Close()
+		if !isFiler && readRepair != nil {
+			// 已从shadow 集群迁移到主集群的文件使用新的fid 获取
+			if resp = ps.downloadRepaired(r, retry, logHeader); resp != nil {
+				ps.setDigestHeader(resp, r, isFiler)
+				return ps.writeResponseContent(resp, w, r)
+			}
+		}
 		if !ps.ShadowAccess {
 			//			w.WriteHeader(http.StatusNotFound)
 			return ErrNotFound
@@ -812,9 +1228,65 @@ func (ps *ProxyServer) download(w http.ResponseWriter, r *http.Request,
 	if err != nil {
 		return err
 	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return ErrNotFound
+	}
+	if readRepair != nil {
+		ps.readRepairBody(resp, r, isFiler, logHeader)
+	}
+	ps.setDigestHeader(resp, r, isFiler)
 	return ps.writeResponseContent(resp, w, r)
 }
 
+/**
+ * 创建向seaweedfs 获取文件的请求，
+ * HEAD 请求只获取响应头，并转发Range 与条件请求相关的请求头，
+ * 由seaweedfs 返回206、304 或416 等状态。
+ */
+func newDownloadRequest(url string, r *http.Request) (*http.Request, error) {
+	method := "GET"
+	if strings.EqualFold(r.Method, "head") {
+		method = "HEAD"
+	}
+	// 客户端断开或合并请求全部离开时取消获取
+	req, err := http.NewRequestWithContext(r.Context(), method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range forwardedDownloadHeaders {
+		if v := r.Header.Get(k); v != "" {
+			req.Header.Set(k, v)
+		}
+	}
+	// 传输不自动解压，客户端接受的压缩格式转发给seaweedfs
+	if v := r.Header.Get("Accept-Encoding"); v != "" {
+		req.Header.Set("Accept-Encoding", v)
+	}
+	// If-None-Match 使用弱比较，压缩响应返回的弱ETag 去掉W/ 后转发
+	if v := req.Header.Get("If-None-Match"); strings.Contains(v, `W/"`) {
+		req.Header.Set("If-None-Match", strings.Replace(v, `W/"`, `"`, -1))
+	}
+	return req, nil
+}
+
+/**
+ * 复制请求并去除weeder 使用的查询参数，用于向seaweedfs 获取原文件
+ */
+func stripQuery(r *http.Request, names ...string) *http.Request {
+	ret := new(http.Request)
+	*ret = *r
+	u := *r.URL
+	query := u.Query()
+	for _, name := range names {
+		query.Del(name)
+	}
+	u.RawQuery = query.Encode()
+	ret.URL = &u
+	ret.RequestURI = u.RequestURI()
+	return ret
+}
+
 func (ps *ProxyServer) downloadShadow(w http.ResponseWriter, r *http.Request,
 	retry int32, isFiler bool, logHeader *log.LogHeader) (*http.Response, error) {
 	url := ps.getShadowFileUrl(r.RequestURI, isFiler, retry)
@@ -822,7 +1294,7 @@ func (ps *ProxyServer) downloadShadow(w http.ResponseWriter, r *http.Request,
 		return nil, ErrNotFound
 	}
 	log.Debug(logHeader, "download shadow... ", url)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := newDownloadRequest(url, r)
 	if err != nil {
 		return nil, err
 	}
@@ -858,60 +1330,114 @@ func isPathCanBeSetTtl(path string) bool {
 	return false
 }
 
-func (ps *ProxyServer) registerChunkedFileMeta(meta *multipart.FileHeader,
-	file *multipart.FileHeader, fullpath string, fileMeta *log.FileMeta,
+func (ps *ProxyServer) registerChunkedFileMeta(file *multipart.Part,
+	fullpath string, fileMeta *log.FileMeta,
 	w http.ResponseWriter, r *http.Request,
 	logHeader *log.LogHeader) (status int, err error) {
 
 	status = http.StatusInternalServerError
-
-	// 申请fid
-	ar := &VolumeAssignRequest{
-		Count: uint64(1),
-		//		Replication: fi.Replication,
-		Replication: "001",
-		//		Collection:  fi.Collection,
-		//		Ttl:         fi.Ttl,
+	filename := partFilename(file)
+	placement, err := ps.uploadPlacement(r.Form, filename, logHeader.UserId)
+	if err != nil {
+		return submitErrorStatus(err), err
+	}
+	policy := ps.uploadPolicy(filename, logHeader.UserId)
+	unlock, err := ps.checkUploadCondition(r, filename, policy, logHeader)
+	if err != nil {
+		return submitErrorStatus(err), err
+	}
+	defer unlock()
+	bs, err := ioutil.ReadAll(file)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	cm, err := checkChunkManifest(bs, filepath.Base(filename), policy)
+	if err != nil {
+		return submitErrorStatus(err), err
 	}
-
-	weed := getWeed(ps.Weeds, "master", 0)
 	var ret *AssignResult
-	ret, err = Assign(weed.Url, ar, logHeader)
+	ret, err = ps.registerChunkManifest(bytes.NewReader(bs),
+		filepath.Base(filename), filename, "", placement, logHeader)
 	if err != nil {
-		log.Error(logHeader, err.Error())
 		return
 	}
-	fileMeta.Name = filepath.Base(file.Filename)
+	// 通过/admin/register 映射，filer 不删除原fid，释放去重上传的原文件
+	if dedup != nil {
+		if e := ps.replaceDedupPath(filename, logHeader); e != nil {
+			log.Error(logHeader, "dedup release error: ", filename, " ", e.Error())
+		}
+	}
+	if ps.Config.RedisCacheTtl != "" {
+		redisclient.CacheFilePath(filename, ret.Fid, ps.Config.RedisCacheTtl)
+	}
+	deleteFileDigest(filename, logHeader)
+	invalidateCache(filename)
+	ps.mirrorUploadStored(filename, true, filepath.Base(filename), "", placement, logHeader)
+	fileMeta.Name = filepath.Base(filename)
+	fileMeta.Size = int(cm.Size)
 	fileMeta.Fid = ret.Fid
 	fileMeta.Url = ps.Config.FileUrlPrefix + ret.Fid
 	fileMeta.PublicUrl = ret.PublicUrl
 	fileMeta.Count = ret.Count
 	fileMeta.Error = ret.Error
+
+	status = http.StatusOK
+	return
+}
+
+/**
+ * 申请fid 上传chunks manifest，并将filer 路径映射到该fid，path 为空时不映射
+ */
+func (ps *ProxyServer) registerChunkManifest(manifest io.Reader, name string,
+	path string, ttl string, placement *util.Placement,
+	logHeader *log.LogHeader) (*AssignResult, error) {
+	// 申请fid，manifest 与分片使用相同的存储位置
+	ar := newAssignRequest(ttl, placement)
+	weed := getWeed(ps.Weeds, "master", 0)
+	ret, err := Assign(weed.Url, ar, logHeader)
+	if err != nil {
+		log.Error(logHeader, err.Error())
+		return nil, err
+	}
 	fileChunksMetaUrl := "http://" + ret.Url + "/" + ret.Fid
+	if ttl != "" {
+		fileChunksMetaUrl = fileChunksMetaUrl + "?ttl=" + ttl
+	}
 
 	// 注册chunks manifest
 	err = ps.upload_chunked_file_manifest(
-		fileChunksMetaUrl, file, fileMeta.Name, logHeader)
+		fileChunksMetaUrl, manifest, name, logHeader)
 	if err != nil {
 		log.Error(logHeader, err.Error())
-		return
+		return nil, err
 	}
 
 	// 映射path 与fid
-	weed = getWeed(ps.Weeds, "filer", 0)
+	if path == "" {
+		// 通过/submit 上传时只返回fid
+		return ret, nil
+	}
+	if err = ps.registerFilerPath(ret.Fid, path, logHeader); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// 通过filer 的/admin/register 将路径映射到已上传的fid
+func (ps *ProxyServer) registerFilerPath(fid string, path string,
+	logHeader *log.LogHeader) error {
+	weed := getWeed(ps.Weeds, "filer", 0)
 	values := make(url.Values)
-	values.Add("fileId", fileMeta.Fid)
-	values.Add("path", file.Filename)
-	_, err = util.Post(weed.Url+"/admin/register", values)
+	values.Add("fileId", fid)
+	values.Add("path", path)
+	_, err := util.Post(weed.Url+"/admin/register", values)
 	if err != nil {
-		return status, err
+		return err
 	}
 	if ps.Config.DebugDetailLog {
-		log.Debug(logHeader, "/admin/register ", fileMeta.Fid, " -> ", file.Filename)
+		log.Debug(logHeader, "/admin/register ", fid, " -> ", path)
 	}
-
-	status = http.StatusOK
-	return
+	return nil
 }
 
 func Assign(server string, r *VolumeAssignRequest,
@@ -965,8 +1491,6 @@ func (ps *ProxyServer) Upload(uploadUrl string, filename string, reader io.Reade
 func (ps *ProxyServer) upload_content(uploadUrl string, fillBufferFunction func(w io.Writer) error,
 	filename string, isGzipped bool, mtype string,
 	pairMap map[string]string, logHeader *log.LogHeader) (*UploadResult, error) {
-	body_buf := bytes.NewBufferString("")
-	body_writer := multipart.NewWriter(body_buf)
 	h := make(textproto.MIMEHeader)
 	h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, fileNameEscaper.Replace(filename)))
 	if mtype == "" {
@@ -986,34 +1510,9 @@ func (ps *ProxyServer) upload_content(uploadUrl string, fillBufferFunction func(
 	//		h.Set("Authorization", "BEARER "+string(jwt))
 	//	}
 
-	file_writer, cp_err := body_writer.CreatePart(h)
-	if cp_err != nil {
-		log.Error(logHeader, "error creating form file", cp_err.Error())
-		return nil, cp_err
-	}
-	if err := fillBufferFunction(file_writer); err != nil {
-		log.Error(logHeader, "error copying data", err)
-		return nil, err
-	}
-	content_type := body_writer.FormDataContentType()
-	if err := body_writer.Close(); err != nil {
-		log.Error(logHeader, "error closing body", err)
-		return nil, err
-	}
-
-	req, postErr := http.NewRequest("POST", uploadUrl, body_buf)
-	if postErr != nil {
-		log.Error(logHeader, "failing to upload to", uploadUrl, postErr.Error())
-		return nil, postErr
-	}
-	if ps.Config.DebugDetailLog {
-		log.Debug(logHeader, "content_type: ", content_type)
-	}
-	req.Header.Set("Content-Type", content_type)
-	for k, v := range pairMap {
-		req.Header.Set(k, v)
-	}
-	resp, post_err := weedHttpClient.Do(req)
+	// 文件内容通过管道直接写入请求
+	resp, post_err := postMultipart(weedHttpClient, uploadUrl, h,
+		fillBufferFunction, pairMap)
 	if post_err != nil {
 		log.Error(logHeader, "failing to upload to", uploadUrl, post_err.Error())
 		return nil, post_err
@@ -1036,60 +1535,15 @@ func (ps *ProxyServer) upload_content(uploadUrl string, fillBufferFunction func(
 }
 
 func (ps *ProxyServer) upload_chunked_file_manifest(fileUrl string,
-	file *multipart.FileHeader, filename string, logHeader *log.LogHeader) error {
-	f, err := file.Open()
-	if err != nil {
-		return err
-	}
-	defer func() {
-		f.Close()
-	}()
-
-	buf := new(bytes.Buffer)
-	//	multipartWriter := multipart.NewWriter(buf)
-	// Create file field
-	//	formWriter, err := multipartWriter.CreateFormFile(filename, filename)
-	//	if err != nil {
-	//		return err
-	//	}
-	//	readBuf := make([]byte, 32*1024)
-	//	var nw int
-	//	for {
-	//		nr, er := f.Read(readBuf)
-	//		if nr > 0 {
-	//			nw, err = formWriter.Write(readBuf[0:nr])
-	//			if err != nil {
-	//				break
-	//			}
-	//			if nr != nw {
-	//				err = io.ErrShortWrite
-	//				break
-	//			}
-	//		}
-	//		if er == io.EOF {
-	//			break
-	//		}
-	//		if er != nil {
-	//			err = er
-	//			break
-	//		}
-	//	}
-	//	if err != nil {
-	//		return err
-	//	}
-	//	multipartWriter.Close()
-	var written int64
-	written, err = io.Copy(buf, f)
-
-	bufReader := bytes.NewReader(buf.Bytes())
+	manifest io.Reader, filename string, logHeader *log.LogHeader) error {
 	if ps.Config.DebugDetailLog {
 		log.Debug(logHeader, "Uploading chunks manifest ", filename,
-			"[", written, "] to ", fileUrl, "...")
+			" to ", fileUrl, "...")
 	}
 	u, _ := url.Parse(fileUrl)
 	q := u.Query()
 	q.Set("cm", "true")
 	u.RawQuery = q.Encode()
-	_, err = ps.Upload(u.String(), filename, bufReader, false, "application/json", nil, logHeader)
+	_, err := ps.Upload(u.String(), filename, manifest, false, "application/json", nil, logHeader)
 	return err
 }
@@ -1,8 +1,16 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/util"
 )
 
 var submitApiMeta *FileMeta
@@ -67,3 +75,136 @@ func Test_FilerRestHubApi(t *testing.T) {
 		t.Error("Test_FilerRestHubApi error")
 	}
 }
+
+// multipart 表单的一部分，filename 为空时为表单参数
+type formPart struct {
+	name     string
+	filename string
+	content  string
+}
+
+// 按顺序写入表单各部分，上传到filer 路径path
+func doTestSubmit(ps *ProxyServer, path string, header http.Header,
+	parts ...formPart) (*httptest.ResponseRecorder, *log.ApiResult) {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	for _, p := range parts {
+		if p.filename == "" {
+			mw.WriteField(p.name, p.content)
+		} else {
+			fw, _ := mw.CreateFormFile(p.name, p.filename)
+			fw.Write([]byte(p.content))
+		}
+	}
+	mw.Close()
+	r := httptest.NewRequest("POST", "/filer"+path, body)
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	ps.submit(w, r, true, &log.LogHeader{})
+	result := &log.ApiResult{}
+	json.Unmarshal(w.Body.Bytes(), result)
+	return w, result
+}
+
+func Test_SubmitFiles(t *testing.T) {
+	weed := newFakeWeed()
+	defer weed.Close()
+	ps := newTestProxy(weed)
+
+	_, ret := doTestSubmit(ps, "/app/dir/", nil,
+		formPart{"file", "a.txt", "aaa"}, formPart{"file", "b.txt", "bbb"})
+	if ret.Status != http.StatusOK || len(ret.Result) != 2 {
+		t.Fatal("Test_SubmitFiles: ", ret.Status, " ", ret.Detail)
+	}
+	if content, _ := weed.get("/app/dir/a.txt"); content != "aaa" {
+		t.Error("Test_SubmitFiles: a.txt ", content)
+	}
+	if content, _ := weed.get("/app/dir/b.txt"); content != "bbb" {
+		t.Error("Test_SubmitFiles: b.txt ", content)
+	}
+	if ret.Result[0].Md5 == "" || ret.Result[1].Fid == "" {
+		t.Error("Test_SubmitFiles: result ", ret.Result[0], " ", ret.Result[1])
+	}
+}
+
+func Test_SubmitRollback(t *testing.T) {
+	weed := newFakeWeed()
+	defer weed.Close()
+	ps := newTestProxy(weed)
+	ps.Config.UploadPolicies = []util.UploadPolicy{{Prefix: "/app/", MaxFiles: 1}}
+	weed.put("/app/dir/old.txt", "old")
+
+	// 超过文件数时删除本次新建的文件
+	w, ret := doTestSubmit(ps, "/app/dir/", nil,
+		formPart{"file", "new.txt", "new"}, formPart{"file", "b.txt", "bbb"})
+	if w.Code != http.StatusBadRequest || len(ret.Result) != 0 {
+		t.Error("Test_SubmitRollback: ", w.Code, " ", ret.Result)
+	}
+	if _, ok := weed.get("/app/dir/new.txt"); ok {
+		t.Error("Test_SubmitRollback: new.txt is not removed")
+	}
+	// 覆盖的已有文件保留
+	w, _ = doTestSubmit(ps, "/app/dir/", nil,
+		formPart{"file", "old.txt", "update"}, formPart{"file", "b.txt", "bbb"})
+	if w.Code != http.StatusBadRequest {
+		t.Error("Test_SubmitRollback: ", w.Code)
+	}
+	if _, ok := weed.get("/app/dir/old.txt"); !ok {
+		t.Error("Test_SubmitRollback: old.txt is removed")
+	}
+}
+
+func Test_SubmitLateTtl(t *testing.T) {
+	weed := newFakeWeed()
+	defer weed.Close()
+	ps := newTestProxy(weed)
+
+	_, ret := doTestSubmit(ps, "/app/dir/", nil,
+		formPart{"ttl", "", "3m"}, formPart{"file", "a.txt", "aaa"})
+	if ret.Status != http.StatusOK {
+		t.Fatal("Test_SubmitLateTtl: ", ret.Status, " ", ret.Detail)
+	}
+	if ttl := weed.query("/app/dir/").Get("ttl"); ttl != "3m" {
+		t.Error("Test_SubmitLateTtl: ttl ", ttl)
+	}
+	// 文件之后的ttl 返回400，已上传的文件不保存
+	w, _ := doTestSubmit(ps, "/app/dir/", nil,
+		formPart{"file", "b.txt", "bbb"}, formPart{"ttl", "", "3m"})
+	if w.Code != http.StatusBadRequest {
+		t.Error("Test_SubmitLateTtl: ", w.Code)
+	}
+	if _, ok := weed.get("/app/dir/b.txt"); ok {
+		t.Error("Test_SubmitLateTtl: b.txt is not removed")
+	}
+}
+
+func Test_SubmitCondition(t *testing.T) {
+	weed := newFakeWeed()
+	defer weed.Close()
+	ps := newTestProxy(weed)
+	ps.Config.UploadPolicies = []util.UploadPolicy{{Prefix: "/app/once/", WriteOnce: true}}
+	weed.put("/app/dir/a.txt", "aaa")
+	weed.put("/app/once/a.txt", "aaa")
+
+	header := http.Header{"If-None-Match": {"*"}}
+	w, _ := doTestSubmit(ps, "/app/dir/", header, formPart{"file", "a.txt", "new"})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Error("Test_SubmitCondition: If-None-Match ", w.Code)
+	}
+	header = http.Header{"If-Match": {`"3"`}}
+	w, _ = doTestSubmit(ps, "/app/dir/", header, formPart{"file", "a.txt", "new"})
+	if w.Code != http.StatusOK {
+		t.Error("Test_SubmitCondition: If-Match ", w.Code)
+	}
+	// writeOnce 的路径不能通过If-Match 覆盖
+	w, _ = doTestSubmit(ps, "/app/once/", header, formPart{"file", "a.txt", "new"})
+	if w.Code != http.StatusPreconditionFailed {
+		t.Error("Test_SubmitCondition: writeOnce ", w.Code)
+	}
+	if content, _ := weed.get("/app/once/a.txt"); content != "aaa" {
+		t.Error("Test_SubmitCondition: writeOnce overwritten ", content)
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+	"github.com/wangfeiping/weeder/util"
+)
+
+const (
+	hedgeSampleSize   = 1024
+	hedgeMinSamples   = 20
+	hedgeUpdatePeriod = 32
+)
+
+/**
+ * 记录各副本响应头到达耗时，按配置的分位数计算对冲延迟，
+ * 并按maxHedgeRatio 限制对冲请求带来的额外负载。
+ */
+type hedgeTracker struct {
+	sync.Mutex
+	config  *util.HedgedReadConfig
+	samples []time.Duration
+	count   int
+	next    int
+	updates int
+	delay   time.Duration
+	reads   int64
+	hedges  int64
+}
+
+type hedgeResult struct {
+	resp    *http.Response
+	err     error
+	elapsed time.Duration
+	hedged  bool
+	index   int
+}
+
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+var hedgedReads *hedgeTracker
+
+func initHedgedRead(ps *ProxyServer) {
+	c := &ps.Config.HedgedRead
+	log.DebugS("main", "config: hedgedRead ", c.Enable)
+	if !c.Enable {
+		return
+	}
+	if c.Percentile <= 0 || c.Percentile > 100 {
+		c.Percentile = 95
+	}
+	if c.MinDelay <= 0 {
+		c.MinDelay = 10
+	}
+	if c.MaxDelay < c.MinDelay {
+		c.MaxDelay = 500
+		if c.MaxDelay < c.MinDelay {
+			c.MaxDelay = c.MinDelay
+		}
+	}
+	if c.MaxHedgeRatio <= 0 {
+		c.MaxHedgeRatio = 10
+	}
+	if c.LookupCacheTtl > 0 {
+		lookupCacheTtl = time.Duration(c.LookupCacheTtl) * time.Second
+	}
+	hedgedReads = &hedgeTracker{
+		config:  c,
+		samples: make([]time.Duration, hedgeSampleSize),
+		delay:   time.Duration(c.MaxDelay) * time.Millisecond,
+	}
+	log.DebugS("main", "config: hedgedRead percentile ", c.Percentile,
+		" delay ", c.MinDelay, "-", c.MaxDelay, "ms maxHedgeRatio ", c.MaxHedgeRatio, "%")
+}
+
+func (t *hedgeTracker) observe(d time.Duration) {
+	t.Lock()
+	defer t.Unlock()
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % len(t.samples)
+	if t.count < len(t.samples) {
+		t.count++
+	}
+	t.updates++
+	if t.count < hedgeMinSamples || t.updates < hedgeUpdatePeriod {
+		return
+	}
+	t.updates = 0
+	sorted := make([]time.Duration, t.count)
+	copy(sorted, t.samples[:t.count])
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	delay := sorted[int(float64(t.count-1)*t.config.Percentile/100)]
+	min := time.Duration(t.config.MinDelay) * time.Millisecond
+	max := time.Duration(t.config.MaxDelay) * time.Millisecond
+	if delay < min {
+		delay = min
+	} else if delay > max {
+		delay = max
+	}
+	t.delay = delay
+}
+
+func (t *hedgeTracker) hedgeDelay() time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	return t.delay
+}
+
+// 对冲请求数不能超过读请求数的maxHedgeRatio%
+func (t *hedgeTracker) allowHedge() bool {
+	reads := atomic.LoadInt64(&t.reads)
+	hedges := atomic.LoadInt64(&t.hedges)
+	if (hedges+1)*100 > reads*int64(t.config.MaxHedgeRatio) {
+		return false
+	}
+	atomic.AddInt64(&t.hedges, 1)
+	return true
+}
+
+/**
+ * 多副本对冲读取：
+ * 首个副本在对冲延迟内没有返回响应头时，向另一个副本发送第二个请求，
+ * 使用最先返回的响应并取消另一个请求。
+ * 只有一个副本或查询副本位置失败时，使用原请求通过master 获取。
+ */
+func (ps *ProxyServer) hedgedDownload(req *http.Request, uri string,
+	logHeader *log.LogHeader) (*http.Response, error) {
+	locations, err := lookupVolumeLocations(ps.getFileUrl("", false, 0), uri)
+	if err != nil || len(locations) < 2 {
+		if err != nil {
+			log.Debug(logHeader, "hedged read lookup: ", err.Error())
+		}
+		return weedHttpClient.Do(req)
+	}
+	atomic.AddInt64(&hedgedReads.reads, 1)
+	stats.Incr("hedge.reads")
+
+	order := rand.Perm(len(locations))
+	results := make(chan *hedgeResult, 2)
+	cancels := make([]context.CancelFunc, 0, 2)
+	attempt := func(loc VolumeLocation, hedged bool) {
+		ctx, cancel := context.WithCancel(context.Background())
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		replicaReq, err := http.NewRequest(req.Method, "http://"+loc.Url+uri, nil)
+		if err != nil {
+			results <- &hedgeResult{err: err, hedged: hedged, index: index}
+			return
+		}
+		for k, v := range req.Header {
+			replicaReq.Header[k] = v
+		}
+		replicaReq = replicaReq.WithContext(ctx)
+		// 耗时从该副本请求发送时开始计算，对冲请求的耗时不包含对冲延迟
+		start := time.Now()
+		go func() {
+			resp, err := weedHttpClient.Do(replicaReq)
+			results <- &hedgeResult{resp: resp, err: err, hedged: hedged,
+				elapsed: time.Since(start), index: index}
+		}()
+	}
+	attempt(locations[order[0]], false)
+	timer := time.NewTimer(hedgedReads.hedgeDelay())
+	defer timer.Stop()
+	pending := 1
+	hedged := false
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if hedged {
+				continue
+			}
+			hedged = true
+			if !hedgedReads.allowHedge() {
+				stats.Incr("hedge.denied")
+				continue
+			}
+			stats.Incr("hedge.sent")
+			log.Debug(logHeader, "hedged read: ", locations[order[1]].Url, uri)
+			pending++
+			attempt(locations[order[1]], true)
+		case ret := <-results:
+			pending--
+			if ret.err == nil && ret.resp.StatusCode < http.StatusInternalServerError {
+				hedgedReads.observe(ret.elapsed)
+				if ret.hedged {
+					stats.Incr("hedge.wins")
+				}
+				for i, cancel := range cancels {
+					if i != ret.index {
+						cancel()
+					}
+				}
+				if pending > 0 {
+					go closeHedgeResults(results, pending)
+				}
+				ret.resp.Body = &cancelReadCloser{
+					ReadCloser: ret.resp.Body,
+					cancel:     cancels[ret.index],
+				}
+				return ret.resp, nil
+			}
+			cancels[ret.index]()
+			if ret.err == nil {
+				ret.resp.Body.Close()
+				err = ErrBadGateway
+			} else {
+				err = ret.err
+			}
+			log.Debug(logHeader, "hedged read error: ", err.Error())
+			if !hedged {
+				// 首个副本请求失败，立即请求另一个副本，同样计入对冲请求数
+				hedged = true
+				if !hedgedReads.allowHedge() {
+					stats.Incr("hedge.denied")
+					continue
+				}
+				stats.Incr("hedge.failover")
+				pending++
+				attempt(locations[order[1]], true)
+			}
+		}
+	}
+	return nil, err
+}
+
+func closeHedgeResults(results chan *hedgeResult, pending int) {
+	for ; pending > 0; pending-- {
+		ret := <-results
+		if ret.resp != nil {
+			ret.resp.Body.Close()
+		}
+	}
+}
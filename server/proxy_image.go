@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/wangfeiping/weeder/cache"
+	"github.com/wangfeiping/weeder/imaging"
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+	"github.com/wangfeiping/weeder/util"
+)
+
+var ErrImageTooLarge = errors.New(`Image is too large!`)
+
+// 图片处理使用的查询参数，获取原图时去除
+var imageResizeParams = []string{"w", "h", "mode", "q"}
+
+/**
+ * 下载图片时按参数缩放、裁剪：
+ * w、h 为输出宽高，mode 为fit（等比缩放，默认）、fill（缩放后居中裁剪）、crop（居中裁剪），
+ * q 为jpeg 质量参数；
+ * 只允许配置中的尺寸与质量参数，处理结果保存到内存缓存。
+ */
+type imageResizer struct {
+	config    *util.ImageResizeConfig
+	presets   map[string]bool
+	qualities map[int]bool
+	sem       chan struct{}
+	cache     *cache.MemoryCache
+}
+
+// 参数错误或无法处理的图片，status 为响应状态
+type imageError struct {
+	status int
+	err    error
+}
+
+func (e *imageError) Error() string {
+	return e.err.Error()
+}
+
+// 获取原图时使用的ResponseWriter，响应内容保存到内存
+type imageSourceWriter struct {
+	header   http.Header
+	status   int
+	body     bytes.Buffer
+	max      int64
+	tooLarge bool
+}
+
+var imageResize *imageResizer
+
+func initImageResize(ps *ProxyServer) {
+	c := &ps.Config.ImageResize
+	log.DebugS("main", "config: imageResize ", c.Enable)
+	if !c.Enable {
+		return
+	}
+	if len(c.Presets) == 0 {
+		c.Presets = []string{"100x100", "200x200", "400x0", "800x0"}
+	}
+	if len(c.Qualities) == 0 {
+		c.Qualities = []int{60, 75, 85}
+	}
+	if c.MaxWidth <= 0 {
+		c.MaxWidth = 2048
+	}
+	if c.MaxHeight <= 0 {
+		c.MaxHeight = 2048
+	}
+	if c.MaxSourceSize <= 0 {
+		c.MaxSourceSize = 20 << 20
+	}
+	if c.MaxSourcePixels <= 0 {
+		c.MaxSourcePixels = 40000000
+	}
+	if c.MaxConcurrent <= 0 {
+		c.MaxConcurrent = runtime.NumCPU()
+	}
+	if c.CacheSize <= 0 {
+		c.CacheSize = 64 << 20
+	}
+	if c.CacheTtl <= 0 {
+		c.CacheTtl = 3600
+	}
+	ir := &imageResizer{
+		config:    c,
+		presets:   make(map[string]bool),
+		qualities: make(map[int]bool),
+		sem:       make(chan struct{}, c.MaxConcurrent),
+		cache:     cache.NewMemoryCache(c.CacheSize),
+	}
+	for _, preset := range c.Presets {
+		ir.presets[preset] = true
+	}
+	ir.qualities[imaging.DefaultQuality] = true
+	for _, q := range c.Qualities {
+		ir.qualities[q] = true
+	}
+	imageResize = ir
+	log.DebugS("main", "config: imageResize presets ", c.Presets,
+		" qualities ", c.Qualities, " max ", c.MaxWidth, "x", c.MaxHeight,
+		" maxSourceSize ", c.MaxSourceSize, " maxSourcePixels ", c.MaxSourcePixels,
+		" maxConcurrent ", c.MaxConcurrent, " cacheSize ", c.CacheSize,
+		" cacheTtl ", c.CacheTtl)
+}
+
+// 请求中带有w 或h 参数时处理图片
+func isResizeRequest(r *http.Request) bool {
+	query := r.URL.Query()
+	return query.Get("w") != "" || query.Get("h") != ""
+}
+
+func (ir *imageResizer) options(r *http.Request) (*imaging.Options, error) {
+	query := r.URL.Query()
+	opt := &imaging.Options{
+		Mode:      imaging.ModeFit,
+		Quality:   imaging.DefaultQuality,
+		MaxPixels: ir.config.MaxSourcePixels,
+	}
+	var err error
+	if v := query.Get("w"); v != "" {
+		if opt.Width, err = strconv.Atoi(v); err != nil || opt.Width < 0 {
+			return nil, fmt.Errorf("invalid w: %s", v)
+		}
+	}
+	if v := query.Get("h"); v != "" {
+		if opt.Height, err = strconv.Atoi(v); err != nil || opt.Height < 0 {
+			return nil, fmt.Errorf("invalid h: %s", v)
+		}
+	}
+	if opt.Width > ir.config.MaxWidth || opt.Height > ir.config.MaxHeight {
+		return nil, fmt.Errorf("size exceeds %dx%d", ir.config.MaxWidth, ir.config.MaxHeight)
+	}
+	if !ir.presets[fmt.Sprintf("%dx%d", opt.Width, opt.Height)] {
+		return nil, fmt.Errorf("size %dx%d is not allowed", opt.Width, opt.Height)
+	}
+	switch mode := query.Get("mode"); mode {
+	case "":
+	case imaging.ModeFit, imaging.ModeFill, imaging.ModeCrop:
+		opt.Mode = mode
+	default:
+		return nil, fmt.Errorf("invalid mode: %s", mode)
+	}
+	if v := query.Get("q"); v != "" {
+		if opt.Quality, err = strconv.Atoi(v); err != nil || !ir.qualities[opt.Quality] {
+			return nil, fmt.Errorf("quality %s is not allowed", v)
+		}
+	}
+	return opt, nil
+}
+
+// 处理结果缓存key，参数顺序固定，与原图路径前缀相同以便删除时清除
+func imageCacheKey(path string, opt *imaging.Options) string {
+	return fmt.Sprintf("%s?w=%d&h=%d&mode=%s&q=%d",
+		path, opt.Width, opt.Height, opt.Mode, opt.Quality)
+}
+
+/**
+ * 获取原图并按参数处理后返回，
+ * 原图的获取与普通下载相同（磁盘缓存、合并请求、shadow 集群等）
+ */
+func (ps *ProxyServer) resizedDownload(w http.ResponseWriter, r *http.Request,
+	isFiler bool, logHeader *log.LogHeader) error {
+	opt, err := imageResize.options(r)
+	if err != nil {
+		return &imageError{status: http.StatusBadRequest, err: err}
+	}
+	key := imageCacheKey(r.URL.Path, opt)
+	if e := imageResize.cache.Get(key); e != nil {
+		stats.Incr("image.cache.hits")
+		ps.serveImage(w, r, e.Header, e.Body, "HIT")
+		return nil
+	}
+	stats.Incr("image.cache.misses")
+
+	src := stripQuery(r, imageResizeParams...)
+	src.Method = "GET"
+	src.Header = make(http.Header)
+	sw := &imageSourceWriter{
+		header: make(http.Header),
+		max:    imageResize.config.MaxSourceSize,
+	}
+	if !ps.serveDiskCache(sw, src, false) {
+		if coalescer != nil && ps.coalescable(src) {
+			err = ps.coalescedDownload(sw, src, isFiler, logHeader)
+		} else {
+			err = ps.downloadWithRetry(sw, src, isFiler, logHeader)
+		}
+	}
+	if sw.tooLarge {
+		return &imageError{status: http.StatusRequestEntityTooLarge, err: ErrImageTooLarge}
+	}
+	if err != nil {
+		// 原图写入内存时发生的错误，还没有响应客户端
+		if we, ok := err.(*writtenError); ok {
+			err = we.err
+		}
+		return err
+	}
+	if sw.status != http.StatusOK {
+		ps.writeResponseHeader(sw.header, w, r)
+		w.WriteHeader(sw.status)
+		w.Write(sw.body.Bytes())
+		return nil
+	}
+
+	imageResize.sem <- struct{}{}
+	start := time.Now()
+	out, mtype, err := imaging.Transform(sw.body.Bytes(), opt)
+	<-imageResize.sem
+	if err == imaging.ErrTooManyPixels {
+		stats.Incr("image.errors")
+		return &imageError{status: http.StatusRequestEntityTooLarge, err: err}
+	} else if err != nil {
+		stats.Incr("image.errors")
+		return &imageError{status: http.StatusUnsupportedMediaType, err: err}
+	}
+	stats.Incr("image.resized")
+	log.Debug(logHeader, "image resized: ", key, " ", sw.body.Len(), " -> ",
+		len(out), " bytes in ", time.Since(start))
+
+	header := make(http.Header)
+	for _, k := range []string{"Last-Modified", "Cache-Control", "Expires"} {
+		if v := sw.header.Get(k); v != "" {
+			header.Set(k, v)
+		}
+	}
+	header.Set("Content-Type", mtype)
+	header.Set("ETag", fmt.Sprintf("\"%x\"", md5.Sum(out)))
+	if expire, ok := cacheExpire(header,
+		time.Duration(imageResize.config.CacheTtl)*time.Second); ok {
+		imageResize.cache.Put(key, header, out, expire)
+	}
+	ps.serveImage(w, r, header, out, "MISS")
+	return nil
+}
+
+// Range 与条件请求由http.ServeContent 处理
+func (ps *ProxyServer) serveImage(w http.ResponseWriter, r *http.Request,
+	header http.Header, body []byte, cacheStatus string) {
+	ps.writeResponseHeader(header, w, r)
+	w.Header().Set("X-Cache", cacheStatus)
+	modtime, _ := http.ParseTime(header.Get("Last-Modified"))
+	http.ServeContent(w, r, "", modtime, bytes.NewReader(body))
+}
+
+func (sw *imageSourceWriter) Header() http.Header {
+	return sw.header
+}
+
+func (sw *imageSourceWriter) WriteHeader(status int) {
+	if sw.status != 0 {
+		return
+	}
+	sw.status = status
+	size, err := strconv.ParseInt(sw.header.Get("Content-Length"), 10, 64)
+	if status == http.StatusOK && err == nil && size > sw.max {
+		sw.tooLarge = true
+	}
+}
+
+func (sw *imageSourceWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.WriteHeader(http.StatusOK)
+	}
+	if sw.tooLarge || int64(sw.body.Len()+len(p)) > sw.max {
+		sw.tooLarge = true
+		return 0, ErrImageTooLarge
+	}
+	return sw.body.Write(p)
+}
@@ -0,0 +1,592 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+	"github.com/wangfeiping/weeder/util"
+)
+
+const (
+	mirrorActionUpload = "upload"
+	mirrorActionDelete = "delete"
+	mirrorTaskExt      = ".task"
+	mirrorDataExt      = ".data"
+	mirrorSpoolExt     = ".spool"
+	mirrorDivergence   = "divergence.log"
+	mirrorReportLimit  = 1000
+)
+
+/**
+ * 镜像任务，持久化保存在queueDir 目录下：
+ * {id}.task 保存任务描述，{id}.data 保存上传文件内容
+ */
+type MirrorTask struct {
+	Id       string `json:"id"`
+	Action   string `json:"action"`
+	Path     string `json:"path"`
+	IsFiler  bool   `json:"filer"`
+	Filename string `json:"filename,omitempty"`
+	Ttl      string `json:"ttl,omitempty"`
+	// 主集群上传时使用的存储位置，shadow 集群按相同位置保存
+	Placement *util.Placement `json:"placement,omitempty"`
+	Attempts  int             `json:"attempts"`
+	Created   int64           `json:"created"`
+	Next      int64           `json:"next"`
+	Error     string          `json:"error,omitempty"`
+}
+
+/**
+ * 主集群与shadow 集群之间的不一致记录
+ */
+type MirrorDivergence struct {
+	Action   string `json:"action"`
+	Path     string `json:"path"`
+	Attempts int    `json:"attempts"`
+	Created  int64  `json:"created"`
+	Time     int64  `json:"time"`
+	Error    string `json:"error"`
+}
+
+type MirrorReport struct {
+	Status      int                 `json:"status"`
+	Pending     int                 `json:"pending"`
+	Divergences []*MirrorDivergence `json:"divergences"`
+}
+
+type mirrorQueue struct {
+	dir        string
+	maxRetry   int
+	retryDelay time.Duration
+	seq        int64
+	wake       chan struct{}
+	reportLock sync.Mutex
+}
+
+var mirror *mirrorQueue
+
+func initMirror(ps *ProxyServer) {
+	c := &ps.Config.Mirror
+	log.DebugS("main", "config: mirror ", c.Enable)
+	if !c.Enable {
+		return
+	}
+	if !ps.ShadowAccess {
+		log.ErrorS("main", "config: mirror is enabled without shadow servers")
+		return
+	}
+	if c.QueueDir == "" {
+		c.QueueDir = "./mirror"
+	}
+	if c.MaxRetry <= 0 {
+		c.MaxRetry = 10
+	}
+	if c.RetryDelay <= 0 {
+		c.RetryDelay = 30
+	}
+	if err := os.MkdirAll(c.QueueDir, 0755); err != nil {
+		log.ErrorS("main", "config: mirror queue dir error: ", err.Error())
+		return
+	}
+	// 进程退出时未完成上传的临时文件
+	if spools, err := filepath.Glob(filepath.Join(c.QueueDir, "*"+mirrorSpoolExt)); err == nil {
+		for _, name := range spools {
+			os.Remove(name)
+		}
+	}
+	mirror = &mirrorQueue{
+		dir:        c.QueueDir,
+		maxRetry:   c.MaxRetry,
+		retryDelay: time.Duration(c.RetryDelay) * time.Second,
+		wake:       make(chan struct{}, 1),
+	}
+	log.DebugS("main", "config: mirror queue ", c.QueueDir,
+		" maxRetry ", c.MaxRetry, " retryDelay ", c.RetryDelay)
+	go ps.mirrorJob()
+}
+
+/**
+ * 上传成功后将文件内容保存到本地队列，异步上传到shadow 集群
+ */
+func (ps *ProxyServer) mirrorUpload(path string, isFiler bool, filename string,
+	ttl string, placement *util.Placement, content io.Reader, logHeader *log.LogHeader) {
+	if mirror == nil {
+		return
+	}
+	task := mirror.newTask(mirrorActionUpload, path, isFiler)
+	task.Filename = filename
+	task.Ttl = ttl
+	task.Placement = placement
+	mirror.enqueueUpload(task, mirror.writeData(task.Id, content), logHeader)
+}
+
+/**
+ * 上传时同时写入的临时文件，上传成功后改名为任务数据文件，
+ * 写入失败不影响上传
+ */
+type mirrorSpool struct {
+	f      *os.File
+	err    error
+	closed bool
+}
+
+func (q *mirrorQueue) spool() (*mirrorSpool, error) {
+	f, err := ioutil.TempFile(q.dir, "upload-*"+mirrorSpoolExt)
+	if err != nil {
+		return nil, err
+	}
+	return &mirrorSpool{f: f}, nil
+}
+
+func (s *mirrorSpool) Write(p []byte) (int, error) {
+	if s.err == nil {
+		_, s.err = s.f.Write(p)
+	}
+	return len(p), nil
+}
+
+func (s *mirrorSpool) close() error {
+	if s.closed {
+		return s.err
+	}
+	s.closed = true
+	if e := s.f.Close(); s.err == nil {
+		s.err = e
+	}
+	return s.err
+}
+
+// 上传失败或已加入队列后删除临时文件
+func (s *mirrorSpool) discard() {
+	s.close()
+	os.Remove(s.f.Name())
+}
+
+func (ps *ProxyServer) mirrorUploadSpool(path string, isFiler bool, filename string,
+	ttl string, placement *util.Placement, spool *mirrorSpool, logHeader *log.LogHeader) {
+	task := mirror.newTask(mirrorActionUpload, path, isFiler)
+	task.Filename = filename
+	task.Ttl = ttl
+	task.Placement = placement
+	err := spool.close()
+	if err == nil {
+		err = os.Rename(spool.f.Name(), mirror.file(task.Id, mirrorDataExt))
+	}
+	mirror.enqueueUpload(task, err, logHeader)
+}
+
+/**
+ * 客户端分片上传的文件weeder 没有读取内容，注册后从主集群读取写入镜像队列
+ */
+func (ps *ProxyServer) mirrorUploadStored(path string, isFiler bool, filename string,
+	ttl string, placement *util.Placement, logHeader *log.LogHeader) {
+	if mirror == nil {
+		return
+	}
+	task := mirror.newTask(mirrorActionUpload, path, isFiler)
+	task.Filename = filename
+	task.Ttl = ttl
+	task.Placement = placement
+	uri := path
+	if isFiler {
+		uri = (&url.URL{Path: path}).EscapedPath()
+	}
+	resp, err := weedHttpClient.Get(ps.getFileUrl(uri, isFiler, 0))
+	if err == nil {
+		if resp.StatusCode == http.StatusOK {
+			err = mirror.writeData(task.Id, resp.Body)
+		} else {
+			err = errors.New("mirror read error: " + resp.Status)
+		}
+		resp.Body.Close()
+	}
+	mirror.enqueueUpload(task, err, logHeader)
+}
+
+func (q *mirrorQueue) enqueueUpload(task *MirrorTask, err error,
+	logHeader *log.LogHeader) {
+	if err == nil {
+		err = q.save(task)
+	}
+	if err != nil {
+		os.Remove(q.file(task.Id, mirrorDataExt))
+		log.Error(logHeader, "mirror enqueue error: ", task.Path, " ", err.Error())
+		q.diverge(task, err)
+		return
+	}
+	stats.Incr("mirror.enqueued")
+	q.notify()
+}
+
+/**
+ * 删除成功后异步删除shadow 集群中对应的文件
+ */
+func (ps *ProxyServer) mirrorDelete(path string, isFiler bool,
+	logHeader *log.LogHeader) {
+	if mirror == nil {
+		return
+	}
+	task := mirror.newTask(mirrorActionDelete, path, isFiler)
+	if err := mirror.save(task); err != nil {
+		log.Error(logHeader, "mirror enqueue error: ", path, " ", err.Error())
+		mirror.diverge(task, err)
+		return
+	}
+	stats.Incr("mirror.enqueued")
+	mirror.notify()
+}
+
+func (q *mirrorQueue) newTask(action string, path string, isFiler bool) *MirrorTask {
+	now := time.Now()
+	return &MirrorTask{
+		Id: fmt.Sprintf("%019d-%06d", now.UnixNano(),
+			atomic.AddInt64(&q.seq, 1)%1000000),
+		Action:  action,
+		Path:    path,
+		IsFiler: isFiler,
+		Created: now.Unix(),
+		Next:    now.Unix(),
+	}
+}
+
+func (q *mirrorQueue) file(id string, ext string) string {
+	return filepath.Join(q.dir, id+ext)
+}
+
+func (q *mirrorQueue) writeData(id string, content io.Reader) error {
+	f, err := os.Create(q.file(id, mirrorDataExt))
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, content)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// 先写入临时文件再改名，避免进程退出时留下不完整的任务文件
+func (q *mirrorQueue) save(task *MirrorTask) error {
+	bs, err := json.Marshal(task)
+	if err != nil {
+		return err
+	}
+	tmp := q.file(task.Id, ".tmp")
+	if err = ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.file(task.Id, mirrorTaskExt))
+}
+
+func (q *mirrorQueue) remove(task *MirrorTask) {
+	os.Remove(q.file(task.Id, mirrorTaskExt))
+	os.Remove(q.file(task.Id, mirrorDataExt))
+}
+
+func (q *mirrorQueue) notify() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *mirrorQueue) pending() ([]string, error) {
+	names, err := filepath.Glob(filepath.Join(q.dir, "*"+mirrorTaskExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (q *mirrorQueue) diverge(task *MirrorTask, err error) {
+	stats.Incr("mirror.divergences")
+	d := &MirrorDivergence{
+		Action:   task.Action,
+		Path:     task.Path,
+		Attempts: task.Attempts,
+		Created:  task.Created,
+		Time:     time.Now().Unix(),
+		Error:    err.Error(),
+	}
+	bs, e := json.Marshal(d)
+	if e != nil {
+		log.ErrorS("mirror", "divergence marshal error: ", e.Error())
+		return
+	}
+	log.ErrorS("mirror", "divergence: ", string(bs))
+	q.reportLock.Lock()
+	defer q.reportLock.Unlock()
+	f, e := os.OpenFile(filepath.Join(q.dir, mirrorDivergence),
+		os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if e != nil {
+		log.ErrorS("mirror", "divergence write error: ", e.Error())
+		return
+	}
+	defer f.Close()
+	f.Write(bs)
+	f.Write([]byte("\n"))
+}
+
+// 读取最近的不一致记录
+func (q *mirrorQueue) divergences() ([]*MirrorDivergence, error) {
+	q.reportLock.Lock()
+	defer q.reportLock.Unlock()
+	ret := make([]*MirrorDivergence, 0)
+	f, err := os.Open(filepath.Join(q.dir, mirrorDivergence))
+	if os.IsNotExist(err) {
+		return ret, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		d := &MirrorDivergence{}
+		if json.Unmarshal(scanner.Bytes(), d) != nil {
+			continue
+		}
+		ret = append(ret, d)
+		if len(ret) > mirrorReportLimit {
+			ret = ret[1:]
+		}
+	}
+	return ret, scanner.Err()
+}
+
+func (ps *ProxyServer) mirrorJob() {
+	log.DebugS("mirror", "mirror job start...")
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		names, err := mirror.pending()
+		if err != nil {
+			log.ErrorS("mirror", "list queue error: ", err.Error())
+		}
+		// 同一路径的任务按顺序执行，之前的任务等待重试时跳过之后的任务
+		blocked := make(map[string]bool)
+		for _, name := range names {
+			ps.mirrorProcess(name, blocked)
+		}
+		select {
+		case <-mirror.wake:
+		case <-tick.C:
+		}
+	}
+}
+
+func (ps *ProxyServer) mirrorProcess(name string, blocked map[string]bool) {
+	bs, err := ioutil.ReadFile(name)
+	if err != nil {
+		log.ErrorS("mirror", "read task error: ", name, " ", err.Error())
+		return
+	}
+	task := &MirrorTask{}
+	if err = json.Unmarshal(bs, task); err != nil {
+		log.ErrorS("mirror", "broken task: ", name, " ", err.Error())
+		os.Remove(name)
+		return
+	}
+	key := fmt.Sprint(task.IsFiler, ":", task.Path)
+	if blocked[key] {
+		return
+	}
+	if task.Next > time.Now().Unix() {
+		blocked[key] = true
+		return
+	}
+	switch task.Action {
+	case mirrorActionUpload:
+		err = ps.mirrorUploadTask(task)
+	case mirrorActionDelete:
+		err = ps.mirrorDeleteTask(task)
+	default:
+		err = fmt.Errorf("unknown action: %s", task.Action)
+		task.Attempts = mirror.maxRetry
+	}
+	if err == nil {
+		log.DebugS("mirror", task.Action, " ", task.Path, " ok")
+		stats.Incr("mirror.done")
+		mirror.remove(task)
+		return
+	}
+	task.Attempts++
+	task.Error = err.Error()
+	log.ErrorS("mirror", task.Action, " ", task.Path, " attempts ",
+		task.Attempts, " error: ", task.Error)
+	if task.Attempts >= mirror.maxRetry {
+		mirror.diverge(task, err)
+		mirror.remove(task)
+		return
+	}
+	stats.Incr("mirror.retries")
+	blocked[key] = true
+	task.Next = time.Now().Add(
+		mirror.retryDelay * time.Duration(task.Attempts)).Unix()
+	if err = mirror.save(task); err != nil {
+		log.ErrorS("mirror", "save task error: ", task.Id, " ", err.Error())
+	}
+}
+
+func (ps *ProxyServer) mirrorLogHeader(task *MirrorTask) *log.LogHeader {
+	return &log.LogHeader{
+		TraceId:    task.Id,
+		Key:        "mirror",
+		ThreadName: task.Path,
+		ClassName:  "mirror",
+		MethodName: task.Action,
+	}
+}
+
+func (ps *ProxyServer) mirrorUploadTask(task *MirrorTask) error {
+	f, err := os.Open(mirror.file(task.Id, mirrorDataExt))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var uploadUrl, filename string
+	if task.IsFiler {
+		i := strings.LastIndex(task.Path, "/")
+		dir := (&url.URL{Path: task.Path[:i+1]}).EscapedPath()
+		uploadUrl = ps.getShadowFileUrl(dir, true, 0)
+		filename = task.Path[i+1:]
+	} else {
+		uploadUrl, err = ps.shadowVolumeUrl(task.Path)
+		if err != nil {
+			return err
+		}
+		filename = task.Filename
+	}
+	if uploadUrl == "" {
+		return ErrNotFound
+	}
+	query := url.Values{}
+	if task.Ttl != "" {
+		query.Set("ttl", task.Ttl)
+	}
+	if task.Placement != nil {
+		task.Placement.AddTo(query)
+	}
+	if len(query) > 0 {
+		uploadUrl = uploadUrl + "?" + query.Encode()
+	}
+	_, err = ps.Upload(uploadUrl, filename, f, false, "", nil,
+		ps.mirrorLogHeader(task))
+	return err
+}
+
+func (ps *ProxyServer) mirrorDeleteTask(task *MirrorTask) error {
+	var targetUrl string
+	var err error
+	if task.IsFiler {
+		targetUrl = ps.getShadowFileUrl(
+			(&url.URL{Path: task.Path}).EscapedPath(), true, 0)
+	} else {
+		targetUrl, err = ps.shadowVolumeUrl(task.Path)
+		if err != nil {
+			return err
+		}
+	}
+	if targetUrl == "" {
+		return ErrNotFound
+	}
+	req, err := http.NewRequest("DELETE", targetUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := weedHttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	// shadow 集群中不存在该文件，删除结果与主集群一致
+	if resp.StatusCode >= http.StatusBadRequest &&
+		resp.StatusCode != http.StatusNotFound {
+		return errors.New("shadow delete error: " + resp.Status)
+	}
+	return nil
+}
+
+/**
+ * shadow 集群中fid 对应的volume 地址，
+ * 迁移期间shadow 集群与主集群使用相同的volume 编号
+ */
+func (ps *ProxyServer) shadowVolumeUrl(fid string) (string, error) {
+	master := ps.getShadowFileUrl("", false, 0)
+	if master == "" {
+		return "", ErrNotFound
+	}
+	locations, err := lookupVolumeLocations(master, fid)
+	if err != nil {
+		return "", err
+	}
+	if len(locations) == 0 {
+		return "", ErrNotFound
+	}
+	return "http://" + locations[0].Url + "/" + strings.TrimPrefix(fid, "/"), nil
+}
+
+/**
+ * 镜像状态查询接口，需要filerWhite 白名单许可：
+ * {"status":200, "pending":3, "divergences":[{"action":"upload","path":"/app/a.png",...}]}
+ */
+func (ps *ProxyServer) mirrorReportHandler(w http.ResponseWriter, r *http.Request) {
+	logHeader := &log.LogHeader{
+		TraceId:    checkGid(r),
+		Caddress:   checkRealIp(r),
+		UserId:     checkUniSource(r),
+		Key:        "request",
+		ThreadName: r.URL.Path,
+		ClassName:  "mirror",
+		MethodName: r.Method,
+	}
+	log.Info(logHeader, `{"uri":"`, r.RequestURI, `"}`)
+	logHeader.Key = "response"
+	if !ps.isAccessible(logHeader.Caddress) {
+		logHeader.Status = "denied"
+		log.Info(logHeader, `{"detail":"Does not allow access."}`)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	ret := &MirrorReport{Status: http.StatusOK}
+	var err error
+	if mirror != nil {
+		var names []string
+		if names, err = mirror.pending(); err == nil {
+			ret.Pending = len(names)
+			ret.Divergences, err = mirror.divergences()
+		}
+	}
+	var bs []byte
+	if err == nil {
+		bs, err = json.Marshal(ret)
+	}
+	if err != nil {
+		logHeader.Status = "err"
+		log.Error(logHeader, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bs)
+	w.Write([]byte("\n"))
+	logHeader.Status = "ok"
+	log.Info(logHeader)
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/util"
+)
+
+// 使用临时目录作为镜像队列，shadow 作为shadow 集群
+func newTestMirror(t *testing.T, ps *ProxyServer, shadow *fakeWeed) func() {
+	dir, err := ioutil.TempDir("", "weeder-mirror-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.Shadows = []Weed{{shadow.URL, "filer"}, {shadow.URL, "master"}}
+	mirror = &mirrorQueue{
+		dir:        dir,
+		maxRetry:   1,
+		retryDelay: time.Second,
+		wake:       make(chan struct{}, 1),
+	}
+	return func() {
+		mirror = nil
+		os.RemoveAll(dir)
+	}
+}
+
+// 执行队列中的所有任务，返回剩余的任务数
+func runTestMirror(ps *ProxyServer) int {
+	names, _ := mirror.pending()
+	blocked := make(map[string]bool)
+	for _, name := range names {
+		ps.mirrorProcess(name, blocked)
+	}
+	names, _ = mirror.pending()
+	return len(names)
+}
+
+func Test_MirrorUploadDelete(t *testing.T) {
+	weed, shadow := newFakeWeed(), newFakeWeed()
+	defer weed.Close()
+	defer shadow.Close()
+	ps := newTestProxy(weed)
+	defer newTestMirror(t, ps, shadow)()
+	shadow.put("/app/100%/old.txt", "old")
+	logHeader := &log.LogHeader{}
+
+	ps.mirrorUpload("/app/100%/a b.txt", true, "a b.txt", "3d",
+		&util.Placement{Collection: "pics"}, strings.NewReader("hello"), logHeader)
+	ps.mirrorDelete("/app/100%/old.txt", true, logHeader)
+	if n := runTestMirror(ps); n != 0 {
+		t.Error("Test_MirrorUploadDelete: pending ", n)
+	}
+	if content, _ := shadow.get("/app/100%/a b.txt"); content != "hello" {
+		t.Error("Test_MirrorUploadDelete: upload ", content)
+	}
+	query := shadow.query("/app/100%25/")
+	if query.Get("ttl") != "3d" || query.Get("collection") != "pics" {
+		t.Error("Test_MirrorUploadDelete: query ", query)
+	}
+	if _, ok := shadow.get("/app/100%/old.txt"); ok {
+		t.Error("Test_MirrorUploadDelete: old.txt is not deleted")
+	}
+}
+
+func Test_MirrorSubmit(t *testing.T) {
+	weed, shadow := newFakeWeed(), newFakeWeed()
+	defer weed.Close()
+	defer shadow.Close()
+	ps := newTestProxy(weed)
+	defer newTestMirror(t, ps, shadow)()
+
+	_, ret := doTestSubmit(ps, "/app/dir/", nil, formPart{"file", "a.txt", "aaa"})
+	if ret.Status != 200 {
+		t.Fatal("Test_MirrorSubmit: ", ret.Status, " ", ret.Detail)
+	}
+	runTestMirror(ps)
+	if content, _ := shadow.get("/app/dir/a.txt"); content != "aaa" {
+		t.Error("Test_MirrorSubmit: ", content)
+	}
+}
+
+// 超过重试次数的任务记录为不一致
+func Test_MirrorDivergence(t *testing.T) {
+	weed, shadow := newFakeWeed(), newFakeWeed()
+	defer weed.Close()
+	defer shadow.Close()
+	ps := newTestProxy(weed)
+	defer newTestMirror(t, ps, shadow)()
+	shadow.put("/app/full/a.txt", "a")
+
+	ps.mirrorDelete("/app/full/", true, &log.LogHeader{})
+	if n := runTestMirror(ps); n != 0 {
+		t.Error("Test_MirrorDivergence: pending ", n)
+	}
+	divergences, err := mirror.divergences()
+	if err != nil || len(divergences) != 1 || divergences[0].Path != "/app/full/" {
+		t.Error("Test_MirrorDivergence: ", divergences, err)
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/wangfeiping/weeder/stats"
+	"github.com/wangfeiping/weeder/util"
+)
+
+/**
+ * 上传使用的存储位置：路径前缀的默认值，由请求参数中允许的值覆盖；
+ * 请求指定了Uni-Source 不允许的值时返回403
+ */
+func (ps *ProxyServer) uploadPlacement(values url.Values, path string,
+	uniSource string) (*util.Placement, error) {
+	c := &ps.Config.Placement
+	requested := util.PlacementFromValues(values)
+	if !requested.IsEmpty() {
+		err := util.MatchPlacementAllow(c.Allow, uniSource).Check(&requested)
+		if err != nil {
+			stats.Incr("placement.rejected")
+			return nil, &policyError{status: http.StatusForbidden, err: err}
+		}
+	}
+	p := util.MatchPlacementDefault(c.Defaults, path)
+	p.Override(&requested)
+	return &p, nil
+}
+
+// 申请fid 的参数，未指定备份策略时使用001
+func newAssignRequest(ttl string, p *util.Placement) *VolumeAssignRequest {
+	ar := &VolumeAssignRequest{
+		Count:       uint64(1),
+		Replication: "001",
+		Ttl:         ttl,
+	}
+	if p == nil {
+		return ar
+	}
+	if p.Replication != "" {
+		ar.Replication = p.Replication
+	}
+	ar.Collection = p.Collection
+	ar.DataCenter = p.DataCenter
+	ar.Rack = p.Rack
+	ar.DataNode = p.DataNode
+	return ar
+}
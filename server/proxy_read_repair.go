@@ -0,0 +1,284 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+	"github.com/wangfeiping/weeder/util"
+)
+
+const readRepairSweepSize = 10000
+
+/**
+ * 读修复：从shadow 集群读取成功的文件在返回给客户端的同时保存到临时文件，
+ * 读取完成后异步上传到主集群，使旧集群中的文件随访问逐步迁移。
+ */
+type readRepairer struct {
+	sync.Mutex
+	config  *util.ReadRepairConfig
+	limiter *util.TokenBucket
+	dedup   time.Duration
+	// 正在迁移的文件对应零值时间，迁移成功的文件对应完成时间
+	repaired map[string]time.Time
+}
+
+type readRepairBody struct {
+	io.ReadCloser
+	spool    *os.File
+	written  int64
+	max      int64
+	failed   bool
+	complete bool
+	done     func(ok bool)
+}
+
+var readRepair *readRepairer
+
+func initReadRepair(ps *ProxyServer) {
+	c := &ps.Config.ReadRepair
+	log.DebugS("main", "config: readRepair ", c.Enable)
+	if !c.Enable {
+		return
+	}
+	if !ps.ShadowAccess {
+		log.ErrorS("main", "config: readRepair is enabled without shadow servers")
+		return
+	}
+	if c.Rate <= 0 {
+		c.Rate = 5
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = 64 << 20
+	}
+	if c.DedupTtl <= 0 {
+		c.DedupTtl = 3600
+	}
+	if c.TempDir == "" {
+		c.TempDir = os.TempDir()
+	}
+	readRepair = &readRepairer{
+		config:   c,
+		limiter:  util.NewTokenBucket(c.Rate, c.Rate),
+		dedup:    time.Duration(c.DedupTtl) * time.Second,
+		repaired: make(map[string]time.Time),
+	}
+	log.DebugS("main", "config: readRepair rate ", c.Rate, "/s maxSize ", c.MaxSize,
+		" dedupTtl ", c.DedupTtl, " tempDir ", c.TempDir)
+}
+
+// 去除fid 中的扩展名，/3,01637037d6.jpg -> 3,01637037d6
+func pathFid(path string) string {
+	fid := strings.TrimPrefix(path, "/")
+	if i := strings.Index(fid, "."); i > 0 {
+		fid = fid[:i]
+	}
+	return fid
+}
+
+// 已在迁移中或刚刚迁移成功的文件不重复迁移，之后按速率限制
+func (rr *readRepairer) acquire(key string) bool {
+	rr.Lock()
+	defer rr.Unlock()
+	now := time.Now()
+	if t, ok := rr.repaired[key]; ok && (t.IsZero() || now.Sub(t) < rr.dedup) {
+		stats.Incr("readRepair.deduped")
+		return false
+	}
+	if !rr.limiter.Allow(1) {
+		stats.Incr("readRepair.limited")
+		return false
+	}
+	if len(rr.repaired) > readRepairSweepSize {
+		for k, t := range rr.repaired {
+			if !t.IsZero() && now.Sub(t) >= rr.dedup {
+				delete(rr.repaired, k)
+			}
+		}
+	}
+	rr.repaired[key] = time.Time{}
+	return true
+}
+
+func (rr *readRepairer) release(key string, ok bool) {
+	rr.Lock()
+	defer rr.Unlock()
+	if ok {
+		rr.repaired[key] = time.Now()
+	} else {
+		delete(rr.repaired, key)
+	}
+}
+
+func (b *readRepairBody) Read(p []byte) (n int, err error) {
+	n, err = b.ReadCloser.Read(p)
+	if n > 0 && !b.failed {
+		b.written += int64(n)
+		if b.written > b.max {
+			b.failed = true
+		} else if _, e := b.spool.Write(p[:n]); e != nil {
+			b.failed = true
+		}
+	}
+	if err == io.EOF {
+		b.complete = true
+	}
+	return
+}
+
+func (b *readRepairBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.done(b.complete && !b.failed)
+	return err
+}
+
+/**
+ * 包装shadow 集群的响应，客户端读取完成后将文件迁移到主集群
+ */
+func (ps *ProxyServer) readRepairBody(resp *http.Response, r *http.Request,
+	isFiler bool, logHeader *log.LogHeader) {
+	if !strings.EqualFold(r.Method, "get") || resp.StatusCode != http.StatusOK ||
+		resp.ContentLength > readRepair.config.MaxSize {
+		return
+	}
+	// shadow 集群返回压缩后的内容时不能作为原文件保存
+	if resp.Header.Get("Content-Encoding") != "" {
+		return
+	}
+	if !isFiler && metaClient() == nil {
+		return
+	}
+	key := r.URL.Path
+	if !isFiler {
+		key = pathFid(key)
+	}
+	if !readRepair.acquire(key) {
+		return
+	}
+	spool, err := ioutil.TempFile(readRepair.config.TempDir, "weeder-repair-")
+	if err != nil {
+		log.Error(logHeader, "read repair temp file error: ", err.Error())
+		readRepair.release(key, false)
+		return
+	}
+	filename := util.DispositionFilename(resp.Header.Get("Content-Disposition"))
+	mtype := resp.Header.Get("Content-Type")
+	repairHeader := *logHeader
+	repairHeader.ClassName = "readRepair"
+	resp.Body = &readRepairBody{
+		ReadCloser: resp.Body,
+		spool:      spool,
+		max:        readRepair.config.MaxSize,
+		done: func(ok bool) {
+			if !ok {
+				spool.Close()
+				os.Remove(spool.Name())
+				readRepair.release(key, false)
+				return
+			}
+			go ps.repair(key, isFiler, filename, mtype, spool, &repairHeader)
+		},
+	}
+}
+
+func (ps *ProxyServer) repair(key string, isFiler bool, filename string,
+	mtype string, spool *os.File, logHeader *log.LogHeader) {
+	defer func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}()
+	_, err := spool.Seek(0, io.SeekStart)
+	if err == nil {
+		if isFiler {
+			err = ps.repairFiler(key, mtype, spool, logHeader)
+		} else {
+			err = ps.repairFid(key, filename, mtype, spool, logHeader)
+		}
+	}
+	if err != nil {
+		stats.Incr("readRepair.errors")
+		log.Error(logHeader, "read repair error: ", key, " ", err.Error())
+		readRepair.release(key, false)
+		return
+	}
+	stats.Incr("readRepair.repaired")
+	readRepair.release(key, true)
+}
+
+// 按原路径上传到主集群filer
+func (ps *ProxyServer) repairFiler(path string, mtype string, f io.Reader,
+	logHeader *log.LogHeader) error {
+	i := strings.LastIndex(path, "/")
+	uploadUrl := ps.getFileUrl((&url.URL{Path: path[:i+1]}).EscapedPath(), true, 0)
+	ret, err := ps.Upload(uploadUrl, path[i+1:], f, false, mtype, nil, logHeader)
+	if err != nil {
+		return err
+	}
+	if ps.Config.RedisCacheTtl != "" && ret.Fid != "" {
+		redisclient.CacheFilePath(path, ret.Fid, ps.Config.RedisCacheTtl)
+	}
+	log.Debug(logHeader, "read repair: ", path, " -> ", ret.Fid)
+	return nil
+}
+
+// 在主集群申请新的fid 上传，并记录原fid 与新fid 的对应关系
+func (ps *ProxyServer) repairFid(fid string, filename string, mtype string,
+	f io.Reader, logHeader *log.LogHeader) error {
+	if filename == "" {
+		filename = fid
+	}
+	ret, err := Assign(ps.getFileUrl("", false, 0),
+		&VolumeAssignRequest{Count: 1}, logHeader)
+	if err != nil {
+		return err
+	}
+	_, err = ps.Upload("http://"+ret.Url+"/"+ret.Fid, filename, f, false,
+		mtype, nil, logHeader)
+	if err != nil {
+		return err
+	}
+	log.Debug(logHeader, "read repair: ", fid, " -> ", ret.Fid)
+	return metaClient().SetFileIdAlias(fid, ret.Fid)
+}
+
+/**
+ * 使用读修复记录的新fid 从主集群获取文件
+ */
+func (ps *ProxyServer) downloadRepaired(r *http.Request, retry int32,
+	logHeader *log.LogHeader) *http.Response {
+	client := metaClient()
+	if client == nil {
+		return nil
+	}
+	fid := pathFid(r.URL.Path)
+	newFid, err := client.GetFileIdAlias(fid)
+	if err != nil || newFid == "" {
+		return nil
+	}
+	uri := "/" + newFid
+	if r.URL.RawQuery != "" {
+		uri = uri + "?" + r.URL.RawQuery
+	}
+	req, err := newDownloadRequest(ps.getFileUrl(uri, false, retry), r)
+	if err != nil {
+		return nil
+	}
+	resp, err := weedHttpClient.Do(req)
+	if err != nil {
+		log.Debug(logHeader, "download repaired: ", err.Error())
+		return nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil
+	}
+	log.Debug(logHeader, "download repaired: ", fid, " -> ", newFid)
+	return resp
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/util"
+)
+
+// 主集群filer，记录读修复上传的路径
+func newRepairFiler(uploaded chan string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ioutil.ReadAll(r.Body)
+			uploaded <- r.URL.EscapedPath()
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"name":"a","size":5,"fid":"3,01637037d6"}`))
+		}))
+}
+
+func newRepairProxy(url string) *ProxyServer {
+	weedHttpClient = http.DefaultClient
+	readRepair = &readRepairer{
+		config:   &util.ReadRepairConfig{Enable: true, MaxSize: 1 << 20},
+		limiter:  util.NewTokenBucket(100, 100),
+		dedup:    time.Hour,
+		repaired: make(map[string]time.Time),
+	}
+	ps := &ProxyServer{Config: &util.WeederConfig{}}
+	ps.Weeds = []Weed{{url, "filer"}, {url, "master"}}
+	return ps
+}
+
+func readShadowResponse(ps *ProxyServer, path string, encoding string) {
+	r := httptest.NewRequest("GET", "http://weeder"+path, nil)
+	resp := &http.Response{
+		StatusCode:    http.StatusOK,
+		Header:        http.Header{},
+		Body:          ioutil.NopCloser(strings.NewReader("hello")),
+		ContentLength: 5,
+	}
+	if encoding != "" {
+		resp.Header.Set("Content-Encoding", encoding)
+	}
+	ps.readRepairBody(resp, r, true, &log.LogHeader{})
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+}
+
+func Test_ReadRepairFilerPath(t *testing.T) {
+	uploaded := make(chan string, 1)
+	filer := newRepairFiler(uploaded)
+	defer filer.Close()
+	ps := newRepairProxy(filer.URL)
+
+	readShadowResponse(ps, "/app/100%25/a.txt", "")
+	select {
+	case p := <-uploaded:
+		if p != "/app/100%25/" {
+			t.Error("Test_ReadRepairFilerPath: ", p)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Test_ReadRepairFilerPath: not repaired")
+	}
+	if !waitRepaired("/app/100%/a.txt") {
+		t.Error("Test_ReadRepairFilerPath: not released")
+	}
+}
+
+// 等待迁移完成，避免之后的测试替换readRepair 时仍在访问
+func waitRepaired(key string) bool {
+	for i := 0; i < 500; i++ {
+		readRepair.Lock()
+		repaired := readRepair.repaired[key]
+		readRepair.Unlock()
+		if !repaired.IsZero() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func Test_ReadRepairSkipEncoded(t *testing.T) {
+	uploaded := make(chan string, 1)
+	filer := newRepairFiler(uploaded)
+	defer filer.Close()
+	ps := newRepairProxy(filer.URL)
+
+	readShadowResponse(ps, "/app/b.txt", "gzip")
+	select {
+	case p := <-uploaded:
+		t.Error("Test_ReadRepairSkipEncoded: encoded content repaired ", p)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bufio"
 	"encoding/json"
 	"io"
 	"math/rand"
@@ -45,6 +46,8 @@ var weedHttpClient *http.Client
 var redisclient util.DbAdaptor
 var dbclient util.DbAdaptor
 
+var mimeTypes *util.MimeTypes
+
 /**
  * 初始化api处理路由（映射）
  */
@@ -55,8 +58,10 @@ func NewProxyServer(c *util.WeederConfig) *ProxyServer {
 	if cph < 1 {
 		cph = 100
 	}
+	// 不自动解压seaweedfs 的gzip 响应，由客户端的Accept-Encoding 决定是否压缩
 	var tr = &http.Transport{
 		MaxIdleConnsPerHost: cph,
+		DisableCompression:  true,
 	}
 	weedHttpClient = &http.Client{Transport: tr}
 	if c.UnkonwnUriChecker == "" {
@@ -88,6 +93,24 @@ func NewProxyServer(c *util.WeederConfig) *ProxyServer {
 	initFilerWhite(ps)
 	initRedisClient(ps)
 	initMysqlClient(ps)
+	initHedgedRead(ps)
+	initMirror(ps)
+	initReadRepair(ps)
+	initDiskCache(ps)
+	initCoalesce(ps)
+	initImageResize(ps)
+	initDerivatives(ps)
+	initMimeTypes(ps)
+	initDisposition(ps)
+	initCompression(ps)
+	initSignedUrl(ps)
+	initThrottle(ps)
+	initUploadSession(ps)
+	initAutoChunk(ps)
+	initFileDigest(ps)
+	initDedup(ps)
+	initFetch(ps)
+	initBatchDelete(ps)
 	log.DebugS("main", "config: volumeCheckDuration ", c.VolumeCheckDuration)
 	log.DebugS("main", "config: volumeCheckUrl ", c.VolumeCheckUrl)
 	log.DebugS("main", "config: nodeCheckBaseLine ", c.NodeCheckBaseLine)
@@ -97,8 +120,15 @@ func NewProxyServer(c *util.WeederConfig) *ProxyServer {
 	//按照配置顺序匹配
 	http.HandleFunc("/health", ps.healthHandler)
 	http.HandleFunc("/echo", ps.echoHandler)
+	http.HandleFunc("/stats", ps.statsHandler)
 	http.HandleFunc("/submit", ps.submitHandler)
 	http.HandleFunc("/delete", ps.deleteHandler)
+	http.HandleFunc("/delete/batch", ps.batchDeleteHandler)
+	http.HandleFunc("/delete/dir", ps.dirDeleteHandler)
+	http.HandleFunc("/mirror/report", ps.mirrorReportHandler)
+	http.HandleFunc("/sign", ps.signHandler)
+	http.HandleFunc("/split", ps.splitHandler)
+	http.HandleFunc("/fetch", ps.fetchHandler)
 	http.HandleFunc("/", ps.reRouting)
 
 	StartScheduleJob(c)
@@ -139,6 +169,12 @@ func initFilerWhite(ps *ProxyServer) {
 	log.DebugS("main", "config: filer whites ", len(ps.FilerWhites))
 }
 
+func initMimeTypes(ps *ProxyServer) {
+	mimeTypes = util.NewMimeTypes(ps.Config.MimeTypes.Types)
+	log.DebugS("main", "config: mimeTypes ", ps.Config.MimeTypes.Types,
+		" sniff ", ps.Config.MimeTypes.Sniff)
+}
+
 func initRedisClient(ps *ProxyServer) {
 	if ps.Config.RedisCacheTtl == "" || ps.Config.Redis.Addr == "" {
 		return
@@ -176,6 +212,14 @@ func initMysqlClient(ps *ProxyServer) {
 	}
 }
 
+// 路径映射等元数据优先保存到mysql，未配置mysql 时保存到redis
+func metaClient() util.DbAdaptor {
+	if dbclient != nil {
+		return dbclient
+	}
+	return redisclient
+}
+
 /**
  * 根据路径规范调用指定方法。
  */
@@ -210,24 +254,25 @@ func (ps *ProxyServer) reRouting(w http.ResponseWriter, r *http.Request) {
 		// 访问根路径需要白名单许可
 		ps.accessCheckAndGetFiler(w, r, logHeader)
 	case strings.HasPrefix(r.URL.Path, "/filer") &&
-		strings.EqualFold(r.Method, "post"):
-		// 通过filer 指定路径与文件名上传文件
+		(strings.EqualFold(r.Method, "post") || strings.EqualFold(r.Method, "put")):
+		// 通过filer 指定路径与文件名上传文件，PUT 请求内容即文件内容
 		ps.submit(w, r, true, logHeader)
 	case fidChecker.MatchString(r.URL.Path):
 		// fid 获取文件 - 不包含任何路径，认为是fid，文件不允许上传到根目录下，只允许GET 获取文件
 		if _, exist := r.URL.Query()["filepath"]; exist &&
 			strings.EqualFold(r.Method, "get") {
 			ps.queryFilePathHandler(w, r, logHeader)
-		} else if strings.EqualFold(r.Method, "get") {
+		} else if isReadMethod(r) {
 			ps.getFileHandler(w, r, false, logHeader)
 		} else if strings.EqualFold(r.Method, "delete") {
 			ps.deleteFile(w, r.URL.Path, r.RemoteAddr, false, logHeader)
 		}
 	case strings.HasSuffix(r.URL.Path, "/"):
 		// 访问路径需要白名单许可
-		if strings.EqualFold(r.Method, "get") {
+		if isReadMethod(r) {
 			ps.accessCheckAndGetFiler(w, r, logHeader)
 		} else if strings.EqualFold(r.Method, "delete") {
+			// 只删除空目录，递归删除使用/delete/dir
 			ps.deleteFile(w, r.URL.Path, r.RemoteAddr, true, logHeader)
 		}
 	case strings.HasPrefix(r.URL.Path, "/public/"):
@@ -235,7 +280,7 @@ func (ps *ProxyServer) reRouting(w http.ResponseWriter, r *http.Request) {
 		if _, exist := r.URL.Query()["fid"]; exist &&
 			strings.EqualFold(r.Method, "get") {
 			ps.queryFileIdHandler(w, r, logHeader)
-		} else if strings.EqualFold(r.Method, "get") {
+		} else if isReadMethod(r) {
 			ps.getFileHandler(w, r, true, logHeader)
 		} else if strings.EqualFold(r.Method, "delete") {
 			ps.deleteFile(w, r.URL.Path, r.RemoteAddr, true, logHeader)
@@ -245,7 +290,7 @@ func (ps *ProxyServer) reRouting(w http.ResponseWriter, r *http.Request) {
 		if _, exist := r.URL.Query()["fid"]; exist &&
 			strings.EqualFold(r.Method, "get") {
 			ps.queryFileIdHandler(w, r, logHeader)
-		} else if strings.EqualFold(r.Method, "get") {
+		} else if isReadMethod(r) {
 			ps.accessCheckAndGetFiler(w, r, logHeader)
 		} else if strings.EqualFold(r.Method, "delete") {
 			ps.deleteFile(w, r.URL.Path, r.RemoteAddr, true, logHeader)
@@ -253,6 +298,11 @@ func (ps *ProxyServer) reRouting(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// 获取文件的请求，HEAD 与GET 使用相同的处理
+func isReadMethod(r *http.Request) bool {
+	return strings.EqualFold(r.Method, "get") || strings.EqualFold(r.Method, "head")
+}
+
 func checkGid(r *http.Request) string {
 	//根据resthub 规范，通过resthub 的请求，可以获取API请求响应的唯一串号（Request-Id）作为唯一id
 	gid := r.Header.Get("Request-Id")
@@ -266,50 +316,133 @@ func checkGid(r *http.Request) string {
 
 func (ps *ProxyServer) writeResponseContent(resp *http.Response,
 	w http.ResponseWriter, r *http.Request) (err error) {
-	if resp != nil {
-		for k, v := range resp.Header {
-			for _, vv := range v {
-				if ps.Config.DebugDetailLog {
-					log.DebugS("detail", "response header - ", k, " : ", vv)
-				}
-				w.Header().Add(k, vv)
+	if resp.StatusCode >= http.StatusInternalServerError &&
+		ps.Config.DiskCache.ServeStale && ps.serveDiskCache(w, r, true) {
+		resp.Body.Close()
+		return
+	}
+	if ps.Config.MimeTypes.Sniff {
+		sniffContentType(resp, r)
+	}
+	ps.writeResponseHeader(resp.Header, w, r)
+	if diskCache != nil {
+		ps.diskCacheBody(resp, r)
+	}
+
+	// seaweedfs 按Accept-Encoding 返回的压缩内容原样转发
+	if resp.Header.Get("Content-Encoding") != "" {
+		addVary(w.Header(), "Accept-Encoding")
+	}
+	compress := compression != nil && compressResponse(resp, w, r)
+
+	// 传输代码必须放在最后？否则前面判断文件类型的代码失效！！！
+	// 响应头必须在WriteHeader 之前设置完成，之后的修改不会生效。
+	defer resp.Body.Close()
+	w.WriteHeader(resp.StatusCode)
+	if strings.EqualFold(r.Method, "head") ||
+		resp.StatusCode == http.StatusNotModified ||
+		resp.StatusCode == http.StatusNoContent {
+		return
+	}
+	var dst io.Writer = w
+	if compress {
+		gz := getGzipWriter(w)
+		defer putGzipWriter(gz)
+		dst = gz
+		defer func() {
+			if e := gz.Close(); e != nil && err == nil {
+				err = &writtenError{err: e}
 			}
-		}
-		cd := resp.Header.Get("Content-Disposition")
-		cd = isXlsFile(cd)
-		if cd != "" {
-			// 业务开发使用的某种excel 生成sdk 生成的xls 文件实际为zip 压缩文件，
-			// 访问此类文件时出现Content-Type 为application/zip 的情况。
-			// 导致在ie 8 下载该文件时自动将文件名改为*.zip 下载，
-			// 造成无法通过excel 软件打开的问题。
-			// 因此通过检查文件扩展名.xls，
-			// 并强行设置Content-Type 为application/vnd.ms-excel
-			// 或者
-			// *.xlsx
-			// application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
-			w.Header().Set("Content-Type", cd)
-		}
+		}()
+	}
+	buf := make([]byte, util.GET_FILE_BUF_SIZE)
+	_, err = io.CopyBuffer(dst, resp.Body, buf)
+	if err != nil {
+		err = &writtenError{err: err}
+	}
+	return
+}
+
+/**
+ * 上游返回通用类型时读取文件开始的512 字节识别Content-Type，
+ * 只处理完整的未压缩文件
+ */
+func sniffContentType(resp *http.Response, r *http.Request) {
+	if resp.StatusCode != http.StatusOK || strings.EqualFold(r.Method, "head") ||
+		resp.Header.Get("Content-Encoding") != "" ||
+		!util.IsGenericMimeType(resp.Header.Get("Content-Type")) {
+		return
+	}
+	br := bufio.NewReaderSize(resp.Body, 512)
+	peek, _ := br.Peek(512)
+	if len(peek) == 0 {
+		return
+	}
+	resp.Header.Set("Content-Type", http.DetectContentType(peek))
+	resp.Body = &sniffedBody{Reader: br, Closer: resp.Body}
+}
+
+type sniffedBody struct {
+	io.Reader
+	io.Closer
+}
 
+/**
+ * 设置文件响应头：复制seaweedfs 响应头，修正Content-Type 并设置跨域访问响应头
+ */
+func (ps *ProxyServer) writeResponseHeader(header http.Header,
+	w http.ResponseWriter, r *http.Request) {
+	for k, v := range header {
+		for _, vv := range v {
+			if ps.Config.DebugDetailLog {
+				log.DebugS("detail", "response header - ", k, " : ", vv)
+			}
+			w.Header().Add(k, vv)
+		}
+	}
+	// 业务开发使用的某种excel 生成sdk 生成的xls 文件实际为zip 压缩文件，
+	// 访问此类文件时出现Content-Type 为application/zip 的情况。
+	// 导致在ie 8 下载该文件时自动将文件名改为*.zip 下载，
+	// 造成无法通过excel 软件打开的问题。
+	// 因此按Content-Disposition 中的文件名或请求路径的扩展名，
+	// 强行设置配置中对应的Content-Type。
+	filename := util.DispositionFilename(header.Get("Content-Disposition"))
+	mtype := mimeTypes.ByFilename(filename)
+	if mtype == "" {
+		mtype = mimeTypes.ByFilename(r.URL.Path)
+	}
+	if mtype != "" {
+		w.Header().Set("Content-Type", mtype)
 	}
+	setCorsHeader(w, r)
+}
+
+func setCorsHeader(w http.ResponseWriter, r *http.Request) {
 	origin := r.Header.Get("origin")
 	if strings.EqualFold("", origin) {
 		origin = "*"
 	}
 	w.Header().Set("Access-Control-Allow-Origin", origin)
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
-	w.Header().Set("Access-Control-Expose-Headers", "Request-Id")
-	w.Header().Set("Access-Control-Allow-Headers", "X-Requested-With,Content-Type")
-	w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,DELETE,PATCH")
+	w.Header().Set("Access-Control-Expose-Headers", "Request-Id,ETag,Digest")
+	w.Header().Set("Access-Control-Allow-Headers", "X-Requested-With,Content-Type,Content-MD5,Digest,If-Match,If-None-Match")
+	w.Header().Set("Access-Control-Allow-Methods", "GET,HEAD,POST,PUT,DELETE,PATCH")
+}
 
-	// 传输代码必须放在最后？否则前面判断文件类型的代码失效！！！
-	buf := make([]byte, util.GET_FILE_BUF_SIZE)
-	written, err := io.CopyBuffer(w, resp.Body, buf)
-	defer resp.Body.Close()
-	if written == 0 {
-		err = ErrNotFound
-		return
-	}
-	return
+/**
+ * 响应状态已经返回给客户端之后发生的错误，不能重试或修改响应状态
+ */
+type writtenError struct {
+	err error
+}
+
+func (e *writtenError) Error() string {
+	return e.err.Error()
+}
+
+func isWrittenError(err error) bool {
+	_, ok := err.(*writtenError)
+	return ok
 }
 
 // 是否可上传/可删除，对应文件中的uploadWhite 配置
@@ -361,6 +494,14 @@ func checkRealIp(r *http.Request) (realIp string) {
 	return
 }
 
+// 去掉客户端地址中的端口，与白名单检查相同
+func clientIp(addr string) string {
+	if i := strings.Index(addr, ":"); i > -1 {
+		return addr[:i]
+	}
+	return addr
+}
+
 /**
  * http://wiki.qianbaoqm.com/pages/viewpage.action?pageId=14190569
  * RestHub API 规范
@@ -371,40 +512,6 @@ func checkUniSource(r *http.Request) string {
 	return r.Header.Get("Uni-Source")
 }
 
-func isXlsFile(cd string) string {
-	// return strings.Contains(cd, ".xls")
-	i := strings.Index(cd, "filename")
-	begin := -1
-	end := -1
-	cds := []rune(cd)
-	l := len(cds)
-	for i = i + 8; i < l; i++ {
-		// log.DebugS("isXlsFile", "cds[", i, "]: ", cds[i])
-		if cds[i] == '"' {
-			if begin < 0 {
-				begin = i
-			} else {
-				end = i
-				break
-			}
-		}
-	}
-	if end > begin {
-		filename := cd[begin+1 : end]
-		filename = strings.TrimSpace(filename)
-		filename = strings.ToLower(filename)
-		// log.DebugS("isXlsFile", "filename: ", filename)
-		if strings.HasSuffix(filename, ".xls") {
-			return "application/vnd.ms-excel"
-		} else if strings.HasSuffix(filename, ".xlsx") {
-			return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
-		} else if strings.HasSuffix(filename, ".csv") {
-			return "text/csv"
-		}
-	}
-	return ""
-}
-
 func infoLog(logHeader *log.LogHeader, detail *DetailJson) {
 	if bs, e := json.Marshal(&detail); e == nil {
 		log.Info(logHeader, string(bs))
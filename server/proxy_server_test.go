@@ -13,14 +13,26 @@ import (
 	"testing"
 	"time"
 
+	"github.com/wangfeiping/weeder/log"
 	redisutil "github.com/wangfeiping/weeder/util/redis"
 )
 
-var submitApi string = // "https://dev-apis.qianbao.com/basicservice/v1/intranet/weed"
-"https://apis.qianbao.com/basicservice/v1/intranet/weed"
-var filerApi string = // "http://dev-apis.qianbao.com/basicservice/v1/intranet/filer"
-"https://apis.qianbao.com/basicservice/v1/intranet/filer"
-var getFileAddr string = "https://img3.qianbao.com"
+type FileMeta = log.FileMeta
+
+// 上传接口返回结果
+type FileUploadResult struct {
+	Result  []FileMeta `json:"result"`
+	Message string     `json:"message"`
+	Status  int        `json:"status"`
+}
+
+// 以下接口测试需要访问实际部署的服务，通过环境变量指定地址，为空时不测试，例如：
+// WEEDER_TEST_SUBMIT_API=https://apis.qianbao.com/basicservice/v1/intranet/weed
+// WEEDER_TEST_FILER_API=https://apis.qianbao.com/basicservice/v1/intranet/filer
+// WEEDER_TEST_FILE_ADDR=https://img3.qianbao.com
+var submitApi string = os.Getenv("WEEDER_TEST_SUBMIT_API")
+var filerApi string = os.Getenv("WEEDER_TEST_FILER_API")
+var getFileAddr string = os.Getenv("WEEDER_TEST_FILE_ADDR")
 var submitFileMeta *FileMeta
 var filerFileMeta *FileMeta
 
@@ -69,6 +81,10 @@ func Test_UploadFilerFile(t *testing.T) {
 }
 
 func Test_GetNeverExistFile(t *testing.T) {
+	if getFileAddr == "" {
+		t.Log("Has not been tested!")
+		return
+	}
 	var err error
 	var req *http.Request
 	var resp *http.Response
@@ -90,6 +106,10 @@ func Test_GetNeverExistFile(t *testing.T) {
 }
 
 func Test_QueryNeverExistFileId(t *testing.T) {
+	if getFileAddr == "" {
+		t.Log("Has not been tested!")
+		return
+	}
 	var err error
 	var req *http.Request
 	var resp *http.Response
@@ -122,6 +142,10 @@ func Test_QueryNeverExistFileId(t *testing.T) {
 }
 
 func Test_QueryNeverExistFilePath(t *testing.T) {
+	if getFileAddr == "" {
+		t.Log("Has not been tested!")
+		return
+	}
 	var err error
 	var req *http.Request
 	var resp *http.Response
@@ -154,6 +178,10 @@ func Test_QueryNeverExistFilePath(t *testing.T) {
 }
 
 func Test_QueryFileIdByFilepath(t *testing.T) {
+	if getFileAddr == "" {
+		t.Log("Has not been tested!")
+		return
+	}
 	var err error
 	var req *http.Request
 	var resp *http.Response
@@ -185,6 +213,10 @@ func Test_QueryFileIdByFilepath(t *testing.T) {
 }
 
 func Test_QueryFilepathByFileId(t *testing.T) {
+	if getFileAddr == "" || filerFileMeta == nil {
+		t.Log("Has not been tested!")
+		return
+	}
 	var err error
 	var req *http.Request
 	var resp *http.Response
@@ -219,6 +251,10 @@ func Test_QueryFilepathByFileId(t *testing.T) {
 }
 
 func Test_GetFileByFid(t *testing.T) {
+	if getFileAddr == "" || submitFileMeta == nil {
+		t.Log("Has not been tested!")
+		return
+	}
 	var err error
 	var req *http.Request
 	var resp *http.Response
@@ -248,6 +284,10 @@ func Test_GetFileByFid(t *testing.T) {
 }
 
 func Test_GetFileByFilepath(t *testing.T) {
+	if getFileAddr == "" {
+		t.Log("Has not been tested!")
+		return
+	}
 	var err error
 	var req *http.Request
 	var resp *http.Response
@@ -277,7 +317,7 @@ func Test_GetFileByFilepath(t *testing.T) {
 }
 
 func Test_RedisClientQueryFilepathByFileId(t *testing.T) {
-	if redisAddr == "" {
+	if redisAddr == "" || filerFileMeta == nil {
 		t.Log("Has not been tested!")
 		return
 	}
@@ -385,6 +425,9 @@ func doUploadSingleFile(method string, url string,
 	req.Header.Set("Uni-Source", "go_test")
 	var client http.Client
 	resp, err = client.Do(req)
+	if err != nil {
+		return
+	}
 	defer resp.Body.Close()
 	var result []byte
 	result, err = ioutil.ReadAll(resp.Body)
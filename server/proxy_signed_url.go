@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+	"github.com/wangfeiping/weeder/util"
+)
+
+var urlSigner *util.UrlSigner
+
+type SignResult struct {
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	Path    string `json:"path,omitempty"`
+	Url     string `json:"url,omitempty"`
+	Expires int64  `json:"expires,omitempty"`
+}
+
+func initSignedUrl(ps *ProxyServer) {
+	c := &ps.Config.SignedUrl
+	log.DebugS("main", "config: signedUrl ", c.Enable)
+	if !c.Enable {
+		return
+	}
+	if c.DefaultTtl <= 0 {
+		c.DefaultTtl = 3600
+	}
+	if c.MaxTtl <= 0 {
+		c.MaxTtl = 7 * 24 * 3600
+	}
+	var err error
+	urlSigner, err = util.NewUrlSigner(c.Keys, c.CurrentKey)
+	if err != nil {
+		log.ErrorS("main", "config: signedUrl error: ", err.Error())
+		return
+	}
+	log.DebugS("main", "config: signedUrl keys ", len(c.Keys),
+		" currentKey ", c.CurrentKey, " defaultTtl ", c.DefaultTtl,
+		" maxTtl ", c.MaxTtl)
+}
+
+/**
+ * 校验请求中的签名，签名参数在获取文件前去除；
+ * 没有签名参数时返回的错误为nil，signed 为false
+ */
+func (ps *ProxyServer) checkSignedUrl(r *http.Request,
+	logHeader *log.LogHeader) (*http.Request, bool, error) {
+	query := r.URL.Query()
+	if urlSigner == nil || query.Get("sig") == "" {
+		return r, false, nil
+	}
+	err := urlSigner.Verify(r.URL.Path, query, clientIp(logHeader.Caddress),
+		r.Method, time.Now())
+	if err != nil {
+		stats.Incr("signedUrl.rejected")
+		log.Debug(logHeader, "signed url: ", err.Error())
+		return stripQuery(r, util.SignedUrlParams...), false, err
+	}
+	stats.Incr("signedUrl.accepted")
+	return stripQuery(r, util.SignedUrlParams...), true, nil
+}
+
+/**
+ * 签发签名url，与上传相同需要白名单许可（及Uni-Source 请求头）
+ *
+ * curl --data "path=/app/report.pdf&ttl=600&ip=1.2.3.4&method=GET" http://localhost:9330/sign
+ * {"status":200, "message":"ok", "path":"/app/report.pdf",
+ *  "url":"http://files.example.com/app/report.pdf?expires=1479813429&ip=1.2.3.4&kid=k1&method=GET&sig=...",
+ *  "expires":1479813429}
+ */
+func (ps *ProxyServer) signHandler(w http.ResponseWriter, r *http.Request) {
+	logHeader := &log.LogHeader{
+		TraceId:    checkGid(r),
+		Caddress:   checkRealIp(r),
+		UserId:     checkUniSource(r),
+		Key:        "request",
+		ThreadName: r.URL.Path,
+		ClassName:  "sign",
+		MethodName: r.Method,
+	}
+	log.Info(logHeader, `{"uri":"`, r.RequestURI, `"}`)
+	logHeader.Key = "response"
+	ret := &SignResult{Status: http.StatusOK, Message: "ok"}
+	if addr, ok := ps.isWritable(r.RemoteAddr); !ok {
+		ret.Status = http.StatusNotAcceptable
+		ret.Message = fmt.Sprintf("It's not allowed to sign by whitelist (%s).", addr)
+	} else if ps.Config.UniSourceCheck && logHeader.UserId == "" {
+		ret.Status = http.StatusNotAcceptable
+		ret.Message = "It's not allowed to sign without Uni-Source header."
+	} else if !strings.EqualFold(r.Method, "post") {
+		ret.Status = http.StatusMethodNotAllowed
+		ret.Message = "Only sign via POST!"
+	} else if urlSigner == nil {
+		ret.Status = http.StatusNotImplemented
+		ret.Message = "Signed url is not enabled."
+	} else {
+		ps.signUrl(r, ret)
+	}
+	writeSignResult(w, ret, logHeader)
+}
+
+func (ps *ProxyServer) signUrl(r *http.Request, ret *SignResult) {
+	r.ParseForm()
+	path := r.Form.Get("path")
+	if !strings.HasPrefix(path, "/") || strings.HasSuffix(path, "/") {
+		ret.Status = http.StatusBadRequest
+		ret.Message = "Bad request, path is invalid!"
+		return
+	}
+	ttl := ps.Config.SignedUrl.DefaultTtl
+	if v := r.Form.Get("ttl"); v != "" {
+		var err error
+		if ttl, err = strconv.ParseInt(v, 10, 64); err != nil || ttl <= 0 {
+			ret.Status = http.StatusBadRequest
+			ret.Message = "Bad request, ttl is invalid!"
+			return
+		}
+	}
+	if ttl > ps.Config.SignedUrl.MaxTtl {
+		ttl = ps.Config.SignedUrl.MaxTtl
+	}
+	expires := time.Now().Add(time.Duration(ttl) * time.Second)
+	query := urlSigner.Sign(path, expires, r.Form.Get("ip"), r.Form.Get("method"))
+	ret.Path = path
+	// 签名使用未转义的路径，与校验时的r.URL.Path 一致
+	ret.Url = strings.TrimSuffix(ps.Config.FileUrlPrefix, "/") +
+		(&url.URL{Path: path}).EscapedPath() + "?" + query.Encode()
+	ret.Expires = expires.Unix()
+}
+
+func writeSignResult(w http.ResponseWriter, ret *SignResult, logHeader *log.LogHeader) {
+	bs, err := json.Marshal(ret)
+	if err != nil {
+		logHeader.Status = "err"
+		log.Error(logHeader, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(ret.Status)
+	w.Write(bs)
+	w.Write([]byte("\n"))
+	if ret.Status == http.StatusOK {
+		logHeader.Status = "ok"
+		log.Info(logHeader, `{"path":"`, ret.Path, `", "expires":`, ret.Expires, `}`)
+	} else {
+		logHeader.Status = "err"
+		log.Error(logHeader, string(bs))
+	}
+}
@@ -3,8 +3,8 @@ package server
 import (
 	"bytes"
 	"encoding/json"
-
-	//	"fmt"
+	"errors"
+	"fmt"
 	"io"
 	"mime/multipart"
 	"net/http"
@@ -17,14 +17,57 @@ import (
 	"github.com/wangfeiping/weeder/util"
 )
 
+// Url 为splitAssign 返回的volume 地址，注册时不使用，按fid 从master 查询
 type UploadMeta struct {
 	Fid    string `json:"fid,omitempty"`
 	Url    string `json:"url,omitempty"`
 	Action string `json:"action,omitempty"`
 }
 
+/**
+ * 分片上传接口，与上传相同需要白名单许可（及Uni-Source 请求头）
+ */
+func (ps *ProxyServer) splitHandler(w http.ResponseWriter, r *http.Request) {
+	logHeader := &log.LogHeader{
+		TraceId:    checkGid(r),
+		Caddress:   checkRealIp(r),
+		UserId:     checkUniSource(r),
+		Key:        "request",
+		ThreadName: r.URL.Path,
+		ClassName:  "split",
+		MethodName: r.Method,
+	}
+	log.Info(logHeader, `{"uri":"`, r.RequestURI, `"}`)
+	result := &log.ApiResult{
+		Result:  make([]*log.FileMeta, 0, 0),
+		Message: "error",
+		Status:  http.StatusNotAcceptable,
+	}
+	if addr, ok := ps.isWritable(r.RemoteAddr); !ok {
+		logHeader.Key = "response"
+		logHeader.Status = "err"
+		result.Detail = fmt.Sprintf(
+			"It's not allowed to upload by whitelist (%s).", addr)
+		log.ErrorResponse(logHeader, result, w)
+		return
+	}
+	if ps.Config.UniSourceCheck && logHeader.UserId == "" {
+		logHeader.Key = "response"
+		logHeader.Status = "err"
+		result.Detail = "It's not allowed to upload without Uni-Source header."
+		log.ErrorResponse(logHeader, result, w)
+		return
+	}
+	ps.split(w, r, logHeader)
+}
+
 func (ps *ProxyServer) split(w http.ResponseWriter, r *http.Request,
 	logHeader *log.LogHeader) {
+	// 分片内容不能作为表单解析，会话参数只使用查询参数
+	if _, exist := r.URL.Query()["session"]; exist {
+		ps.uploadSession(w, r, logHeader)
+		return
+	}
 	r.ParseForm()
 	if _, exist := r.URL.Query()["upload"]; exist {
 		ps.splitUpload(w, r, logHeader)
@@ -58,23 +101,36 @@ func (ps *ProxyServer) splitUpload(w http.ResponseWriter, r *http.Request,
 	//	log.Debug(logHeader, fmt.Sprintf("the pointer is : %p \n", r.MultipartForm.File))
 	meta, file := checkMeta(r.MultipartForm.File)
 	//	log.Debug(logHeader, fmt.Sprintf("the pointer is (meta): %p \n", meta))
-	_, err = metaUploadRequest(meta, file, nil, logHeader)
-
 	result.Result = make([]*log.FileMeta, 0, 0)
+	logHeader.Key = "response"
+	if meta == nil || file == nil {
+		logHeader.Status = "err"
+		result.Message = "error"
+		result.Status = http.StatusBadRequest
+		result.Detail = "Bad request, meta and file are required!"
+		log.ErrorResponse(logHeader, result, w)
+		return
+	}
+	_, err = ps.metaUploadRequest(meta, file, logHeader)
 	if err == nil {
 		logHeader.Status = "ok"
 		log.InfoResponse(logHeader, result, w)
 		return
 	}
 	result.Message = "error"
-	result.Status = http.StatusInternalServerError
+	result.Status = submitErrorStatus(err)
+	result.Detail = err.Error()
 	logHeader.Status = "err"
 	log.Error(logHeader, err.Error())
 	log.ErrorResponse(logHeader, result, w)
 }
 
-func metaUploadRequest(metaFile *multipart.FileHeader, file *multipart.FileHeader,
-	fileUploaded *log.FileMeta, logHeader *log.LogHeader) (resp []byte, err error) {
+/**
+ * 注册客户端分片上传的chunks manifest，
+ * volume 地址按meta 中的fid 从master 查询，不使用客户端提供的url
+ */
+func (ps *ProxyServer) metaUploadRequest(metaFile *multipart.FileHeader,
+	file *multipart.FileHeader, logHeader *log.LogHeader) (resp []byte, err error) {
 	var bs []byte
 	bs, err = readBytes(metaFile)
 	if err != nil {
@@ -91,25 +147,69 @@ func metaUploadRequest(metaFile *multipart.FileHeader, file *multipart.FileHeade
 		return
 	}
 	log.Debug(logHeader, string(bs))
-	//	meta.Url = "http://172.28.40.95:9360/"
-	//	meta.Fid = "dddd"
-	meta.Fid = fileUploaded.Fid
-	meta.Url = fileUploaded.Url
-	if strings.EqualFold("registerChunkMeta", meta.Action) {
-		var u *url.URL
-		u, err = url.Parse(meta.Url) // + meta.Fid)
-		//		fmt.Println("POST chunks meta", u.String())
-		q := u.Query()
-		q.Set("cm", "true")
-		q.Set("ts", strconv.Itoa(int(time.Now().Unix())))
-		u.RawQuery = q.Encode()
-		registerMetaUrl := u.String()
-		log.Debug(logHeader, "register chunks meta url: ", registerMetaUrl)
-		resp, err = util.Upload(registerMetaUrl, "application/json", bs)
+	if !strings.EqualFold("registerChunkMeta", meta.Action) {
+		return
+	}
+	fid := strings.TrimPrefix(meta.Fid, "/")
+	if _, e := parseVolumeId(fid); e != nil || !fidChecker.MatchString("/"+fid) {
+		err = &policyError{status: http.StatusBadRequest,
+			err: errors.New("Bad request, meta fid is required!")}
+		return
 	}
+	var cm *util.ChunkManifest
+	cm, err = checkChunkManifest(bs, "", ps.uploadPolicy("/submit", logHeader.UserId))
+	if err != nil {
+		return
+	}
+	var locations []VolumeLocation
+	locations, err = lookupVolumeLocations(ps.getFileUrl("", false, 0), fid)
+	if err != nil {
+		return
+	}
+	if len(locations) == 0 {
+		err = ErrNotFound
+		return
+	}
+	q := make(url.Values)
+	q.Set("cm", "true")
+	q.Set("ts", strconv.Itoa(int(time.Now().Unix())))
+	registerMetaUrl := "http://" + locations[0].Url + "/" + fid + "?" + q.Encode()
+	log.Debug(logHeader, "register chunks meta url: ", registerMetaUrl)
+	resp, err = util.Upload(registerMetaUrl, "application/json", bs)
+	if err != nil {
+		return
+	}
+	invalidateCache("/" + fid)
+	ps.mirrorUploadStored("/"+fid, false, cm.Name, "", nil, logHeader)
 	return
 }
 
+/**
+ * 检查客户端上传的chunks manifest，并按上传规则检查文件名、类型与大小；
+ * name 为空时使用manifest 中的文件名
+ */
+func checkChunkManifest(bs []byte, name string,
+	policy *util.UploadPolicy) (*util.ChunkManifest, error) {
+	cm := &util.ChunkManifest{}
+	err := json.Unmarshal(bs, cm)
+	if err == nil {
+		err = cm.Validate()
+	}
+	if err != nil {
+		return nil, &policyError{status: http.StatusBadRequest,
+			err: fmt.Errorf("Bad request, invalid chunks manifest: %s", err.Error())}
+	}
+	if name == "" {
+		name = cm.Name
+	}
+	if policy != nil {
+		if _, err = checkUploadMeta(policy, name, cm.Mime, cm.Size); err != nil {
+			return nil, err
+		}
+	}
+	return cm, nil
+}
+
 func readBytes(fileHeader *multipart.FileHeader) ([]byte, error) {
 	//	fmt.Printf("the pointer is (readBytes): %p \n", fileHeader)
 	file, err := fileHeader.Open()
@@ -176,8 +276,20 @@ func (ps *ProxyServer) splitAssign(w http.ResponseWriter, r *http.Request,
 	if _, exist := r.URL.Query()["ttl"]; exist {
 		values.Add("ttl", r.Form.Get("ttl"))
 	}
-	assignUrl := ps.getFileUrl("/dir/assign", false, 0)
 	logHeader.Key = "response"
+	// 客户端分片上传的文件没有路径，与/submit 使用相同的默认存储位置
+	placement, err := ps.uploadPlacement(r.Form, "/submit", logHeader.UserId)
+	if err != nil {
+		result.Message = "error"
+		result.Status = submitErrorStatus(err)
+		result.Detail = err.Error()
+		result.Result = result.Result[:0]
+		logHeader.Status = "err"
+		log.ErrorResponse(logHeader, result, w)
+		return
+	}
+	placement.AddTo(values)
+	assignUrl := ps.getFileUrl("/dir/assign", false, 0)
 	fileJson, err := assignRequest(assignUrl, &values)
 	if err == nil {
 		result.Result[0] = fileJson
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+)
+
+type StatsResult struct {
+	Status    int              `json:"status"`
+	Timestamp int64            `json:"timestamp"`
+	Counters  map[string]int64 `json:"counters"`
+}
+
+/**
+ * 运行统计接口，需要filerWhite 白名单许可，输出各项累计计数，例如：
+ * {"status":200, "timestamp":1479812829, "counters":{"hedge.reads":120, "hedge.sent":9}}
+ */
+func (ps *ProxyServer) statsHandler(w http.ResponseWriter, r *http.Request) {
+	logHeader := &log.LogHeader{
+		TraceId:    checkGid(r),
+		Caddress:   checkRealIp(r),
+		UserId:     checkUniSource(r),
+		Key:        "request",
+		ThreadName: r.URL.Path,
+		ClassName:  "stats",
+		MethodName: r.Method,
+	}
+	log.Info(logHeader, `{"uri":"`, r.RequestURI, `"}`)
+	logHeader.Key = "response"
+	if !ps.isAccessible(logHeader.Caddress) {
+		logHeader.Status = "denied"
+		log.Info(logHeader, `{"detail":"Does not allow access."}`)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	ret := &StatsResult{
+		Status:    http.StatusOK,
+		Timestamp: time.Now().Unix(),
+		Counters:  stats.Counters(),
+	}
+	bs, err := json.Marshal(ret)
+	if err != nil {
+		logHeader.Status = "err"
+		log.Error(logHeader, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(bs)
+	w.Write([]byte("\n"))
+	logHeader.Status = "ok"
+	log.Info(logHeader)
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+const (
+	// 上传失败时可以重新发送的数据量，超过该大小的文件上传失败后不能重试
+	uploadRetryBufferSize = 1 << 20
+	// 表单参数的最大长度
+	formValueMaxSize = 1 << 20
+)
+
+var ErrFormValueTooLarge = errors.New(`Bad request, form value is too large!`)
+
+/**
+ * 流式上传：通过管道以multipart 格式将数据直接写入请求，不在内存中缓存整个文件。
+ * 上游提前返回或请求失败时结束写入，fill 返回的错误优先返回。
+ */
+func postMultipart(client *http.Client, url string, h textproto.MIMEHeader,
+	fill func(w io.Writer) error, pairMap map[string]string) (*http.Response, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	done := make(chan error, 1)
+	go func() {
+		part, err := mw.CreatePart(h)
+		if err == nil {
+			err = fill(part)
+		}
+		if err == nil {
+			err = mw.Close()
+		}
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	req, err := http.NewRequest("POST", url, pr)
+	if err == nil {
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		for k, v := range pairMap {
+			req.Header.Set(k, v)
+		}
+		var resp *http.Response
+		resp, err = client.Do(req)
+		pr.CloseWithError(io.ErrUnexpectedEOF)
+		if fillErr := <-done; fillErr != nil {
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, fillErr
+		}
+		return resp, err
+	}
+	pr.Close()
+	<-done
+	return nil, err
+}
+
+/**
+ * 记录读取的前max 字节，上传失败时可以从头重新读取
+ */
+type replayReader struct {
+	r        io.Reader
+	buf      []byte
+	max      int
+	pos      int
+	overflow bool
+}
+
+func newReplayReader(r io.Reader, max int) *replayReader {
+	return &replayReader{r: r, max: max}
+}
+
+func (rr *replayReader) Read(p []byte) (int, error) {
+	if rr.pos < len(rr.buf) {
+		n := copy(p, rr.buf[rr.pos:])
+		rr.pos += n
+		return n, nil
+	}
+	n, err := rr.r.Read(p)
+	if n > 0 && !rr.overflow {
+		if len(rr.buf)+n > rr.max {
+			rr.overflow = true
+			rr.buf = nil
+			rr.pos = 0
+		} else {
+			rr.buf = append(rr.buf, p[:n]...)
+			rr.pos = len(rr.buf)
+		}
+	}
+	return n, err
+}
+
+// 回到开始位置重新读取，已读取的数据超过max 时返回false
+func (rr *replayReader) Rewind() bool {
+	if rr.overflow {
+		return false
+	}
+	rr.pos = 0
+	return true
+}
+
+/**
+ * 最多保存max 字节的缓冲区，超过时丢弃已保存的内容，写入总是成功
+ */
+type limitedBuffer struct {
+	bytes.Buffer
+	max      int64
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if b.overflow {
+		return len(p), nil
+	}
+	if int64(b.Len()+len(p)) > b.max {
+		b.overflow = true
+		b.Reset()
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// 判断请求内容是否为multipart 表单，其它类型的请求内容作为文件内容上传
+func isMultipartRequest(r *http.Request) bool {
+	mtype, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && strings.HasPrefix(mtype, "multipart/")
+}
+
+/**
+ * 返回上传文件的文件名，
+ * Part.FileName 会去除文件名中的路径，filer 上传时文件名中可以包含路径
+ */
+func partFilename(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	return part.FileName()
+}
+
+func readFormValue(part *multipart.Part) (string, error) {
+	bs, err := ioutil.ReadAll(io.LimitReader(part, formValueMaxSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(bs) > formValueMaxSize {
+		return "", ErrFormValueTooLarge
+	}
+	return string(bs), nil
+}
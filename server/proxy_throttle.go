@@ -0,0 +1,221 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+	"github.com/wangfeiping/weeder/util"
+)
+
+const (
+	throttleChunkSize = 32 * 1024
+	throttleSweepSize = 10000
+	throttleIdle      = 10 * time.Minute
+)
+
+/**
+ * 带宽限制：每条规则按匹配的ip、Uni-Source 或路径前缀使用共享的令牌桶，
+ * 同一客户端的多个并发连接共用令牌，总速率不超过配置。
+ */
+type throttler struct {
+	sync.Mutex
+	rules   []*throttleRule
+	buckets map[string]*throttleBucket
+}
+
+type throttleRule struct {
+	util.ThrottleRule
+	index int
+	ipnet *net.IPNet
+}
+
+type throttleBucket struct {
+	bucket *util.TokenBucket
+	used   time.Time
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	buckets []*util.TokenBucket
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	buckets []*util.TokenBucket
+}
+
+var throttle *throttler
+
+func initThrottle(ps *ProxyServer) {
+	c := &ps.Config.Throttle
+	log.DebugS("main", "config: throttle ", c.Enable)
+	if !c.Enable {
+		return
+	}
+	t := &throttler{buckets: make(map[string]*throttleBucket)}
+	for i, rule := range c.Rules {
+		tr := &throttleRule{ThrottleRule: rule, index: i}
+		switch rule.Key {
+		case "ip":
+			if rule.Match != "" {
+				_, ipnet, err := net.ParseCIDR(rule.Match)
+				if err != nil {
+					log.ErrorS("main", "config: throttle ip error: ", err.Error())
+					continue
+				}
+				tr.ipnet = ipnet
+			}
+		case "uniSource", "prefix":
+		default:
+			log.ErrorS("main", "config: throttle unknown key: ", rule.Key)
+			continue
+		}
+		t.rules = append(t.rules, tr)
+		log.DebugS("main", "config: throttle ", rule.Key, " ", rule.Match,
+			" download ", rule.Download, " upload ", rule.Upload)
+	}
+	throttle = t
+}
+
+// 规则匹配时返回令牌桶的key
+func (tr *throttleRule) bucketKey(path string, ip string, uniSource string) (string, bool) {
+	var value string
+	switch tr.Key {
+	case "ip":
+		if tr.ipnet != nil {
+			parsed := net.ParseIP(ip)
+			if parsed == nil || !tr.ipnet.Contains(parsed) {
+				return "", false
+			}
+		} else {
+			value = ip
+		}
+	case "uniSource":
+		if uniSource == "" || (tr.Match != "" && uniSource != tr.Match) {
+			return "", false
+		}
+		if tr.Match == "" {
+			value = uniSource
+		}
+	case "prefix":
+		if !strings.HasPrefix(path, tr.Match) {
+			return "", false
+		}
+	}
+	return strconv.Itoa(tr.index) + "|" + value, true
+}
+
+// 返回请求匹配的所有令牌桶
+func (t *throttler) match(r *http.Request, logHeader *log.LogHeader,
+	upload bool) []*util.TokenBucket {
+	var ret []*util.TokenBucket
+	now := time.Now()
+	t.Lock()
+	defer t.Unlock()
+	for _, tr := range t.rules {
+		rate := tr.Download
+		if upload {
+			rate = tr.Upload
+		}
+		if rate <= 0 {
+			continue
+		}
+		key, ok := tr.bucketKey(r.URL.Path, clientIp(logHeader.Caddress),
+			logHeader.UserId)
+		if !ok {
+			continue
+		}
+		if upload {
+			key = "u" + key
+		} else {
+			key = "d" + key
+		}
+		b, ok := t.buckets[key]
+		if !ok {
+			b = &throttleBucket{bucket: util.NewTokenBucket(rate, rate)}
+			t.buckets[key] = b
+		}
+		b.used = now
+		ret = append(ret, b.bucket)
+	}
+	if len(t.buckets) > throttleSweepSize {
+		for k, b := range t.buckets {
+			if now.Sub(b.used) > throttleIdle {
+				delete(t.buckets, k)
+			}
+		}
+	}
+	return ret
+}
+
+// 包装下载响应，所有下载方式（缓存、合并请求等）都受限制
+func (ps *ProxyServer) throttleDownload(w http.ResponseWriter, r *http.Request,
+	logHeader *log.LogHeader) http.ResponseWriter {
+	if throttle == nil {
+		return w
+	}
+	if buckets := throttle.match(r, logHeader, false); len(buckets) > 0 {
+		return &throttledWriter{ResponseWriter: w, buckets: buckets}
+	}
+	return w
+}
+
+// 包装上传请求内容，在解析上传文件之前调用
+func (ps *ProxyServer) throttleUpload(r *http.Request, logHeader *log.LogHeader) {
+	if throttle == nil {
+		return
+	}
+	if buckets := throttle.match(r, logHeader, true); len(buckets) > 0 {
+		r.Body = &throttledReader{ReadCloser: r.Body, buckets: buckets}
+	}
+}
+
+func waitBuckets(buckets []*util.TokenBucket, n int) {
+	var wait time.Duration
+	for _, b := range buckets {
+		if d := b.Reserve(float64(n)); d > wait {
+			wait = d
+		}
+	}
+	if wait > 0 {
+		stats.Incr("throttle.waits")
+		stats.Add("throttle.waitMs", int64(wait/time.Millisecond))
+		time.Sleep(wait)
+	}
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > throttleChunkSize {
+			chunk = chunk[:throttleChunkSize]
+		}
+		waitBuckets(tw.buckets, len(chunk))
+		n, err := tw.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (tr *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunkSize {
+		p = p[:throttleChunkSize]
+	}
+	n, err := tr.ReadCloser.Read(p)
+	if n > 0 {
+		waitBuckets(tr.buckets, n)
+	}
+	return n, err
+}
@@ -0,0 +1,142 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+	"github.com/wangfeiping/weeder/util"
+)
+
+/**
+ * 同一filer 路径的条件上传按顺序执行，避免检查与上传之间被其他请求覆盖；
+ * 只在当前weeder 内有效
+ */
+type pathLocker struct {
+	sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.Mutex
+	waiters int
+}
+
+var uploadPathLocks = &pathLocker{locks: make(map[string]*pathLock)}
+
+func (l *pathLocker) lock(path string) func() {
+	l.Lock()
+	pl, ok := l.locks[path]
+	if !ok {
+		pl = &pathLock{}
+		l.locks[path] = pl
+	}
+	pl.waiters++
+	l.Unlock()
+	pl.Lock()
+	return func() {
+		pl.Unlock()
+		l.Lock()
+		pl.waiters--
+		if pl.waiters == 0 {
+			delete(l.locks, path)
+		}
+		l.Unlock()
+	}
+}
+
+func noUnlock() {}
+
+/**
+ * 检查filer 上传的条件请求头：
+ *	If-None-Match: * 路径不存在时才上传
+ *	If-Match: <etag> 路径当前的ETag 相同时才覆盖
+ * 上传规则设置了writeOnce 的路径不论是否指定条件，都要求路径不存在；
+ * 条件不满足时返回412，返回的函数在上传完成后调用
+ */
+func (ps *ProxyServer) checkUploadCondition(r *http.Request, path string,
+	policy *util.UploadPolicy, logHeader *log.LogHeader) (func(), error) {
+	return ps.checkPathCondition(path, strings.TrimSpace(r.Header.Get("If-Match")),
+		strings.TrimSpace(r.Header.Get("If-None-Match")), policy, logHeader)
+}
+
+// 检查路径的上传条件，writeOnce 的路径按If-None-Match: * 检查，忽略请求中的If-None-Match
+func (ps *ProxyServer) checkPathCondition(path string, ifMatch string, ifNoneMatch string,
+	policy *util.UploadPolicy, logHeader *log.LogHeader) (func(), error) {
+	if policy != nil && policy.WriteOnce {
+		ifNoneMatch = "*"
+	}
+	if ifMatch == "" && ifNoneMatch == "" {
+		return noUnlock, nil
+	}
+	unlock := uploadPathLocks.lock(path)
+	exists, etag, err := ps.filerETag(path)
+	if err != nil {
+		unlock()
+		log.Error(logHeader, "upload condition error: ", path, " ", err.Error())
+		return nil, err
+	}
+	if ifNoneMatch != "" && exists && etagMatches(ifNoneMatch, etag) {
+		unlock()
+		stats.Incr("uploadCondition.rejected")
+		return nil, &policyError{status: http.StatusPreconditionFailed,
+			err: fmt.Errorf("File %s already exists!", path)}
+	}
+	if ifMatch != "" && (!exists || !strongETagMatches(ifMatch, etag)) {
+		unlock()
+		stats.Incr("uploadCondition.rejected")
+		if !exists {
+			return nil, &policyError{status: http.StatusPreconditionFailed,
+				err: fmt.Errorf("File %s does not exist!", path)}
+		}
+		return nil, &policyError{status: http.StatusPreconditionFailed,
+			err: fmt.Errorf("File %s has been modified, current ETag %s!", path, etag)}
+	}
+	log.Debug(logHeader, "upload condition: ", path, " exists ", exists, " etag ", etag)
+	return unlock, nil
+}
+
+/**
+ * 查询filer 路径当前的ETag，与下载时返回的ETag 相同：
+ * 保存了摘要时使用md5，否则使用filer 返回的ETag
+ */
+func (ps *ProxyServer) filerETag(path string) (bool, string, error) {
+	uri := (&url.URL{Path: path}).EscapedPath()
+	resp, err := weedHttpClient.Head(ps.getFileUrl(uri, true, 0))
+	if err != nil {
+		return false, "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return false, "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, "", fmt.Errorf("filer returned %s", resp.Status)
+	}
+	if fileDigestStore {
+		if value, err := metaClient().GetFileDigest(path); err == nil {
+			if digest, err := util.ParseFileDigest(value); err == nil {
+				return true, digest.ETag(), nil
+			}
+		}
+	}
+	return true, resp.Header.Get("ETag"), nil
+}
+
+// If-Match 使用强比较，弱ETag 不匹配
+func strongETagMatches(ifMatch string, etag string) bool {
+	if strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	for _, v := range strings.Split(ifMatch, ",") {
+		v = strings.TrimSpace(v)
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/wangfeiping/weeder/stats"
+	"github.com/wangfeiping/weeder/util"
+)
+
+// 文件类型识别需要读取的内容长度，与http.DetectContentType 一致
+const sniffSize = 512
+
+var ErrUploadTooLarge = errors.New("Upload size limit exceeded!")
+
+/**
+ * 违反上传规则的错误，status 为返回的http 状态码
+ */
+type policyError struct {
+	status int
+	err    error
+}
+
+func (e *policyError) Error() string {
+	return e.err.Error()
+}
+
+func newPolicyError(status int, format string, a ...interface{}) error {
+	stats.Incr("uploadPolicy.rejected")
+	return &policyError{status: status, err: fmt.Errorf(format, a...)}
+}
+
+/**
+ * 读取的内容超过限制后返回错误，大小未知的请求与文件上传后通过exceeded 判断失败原因
+ */
+type policyLimitReader struct {
+	io.Reader
+	max      int64
+	n        int64
+	exceeded bool
+}
+
+type policyLimitBody struct {
+	*policyLimitReader
+	io.Closer
+}
+
+func (l *policyLimitReader) Read(p []byte) (int, error) {
+	if l.exceeded {
+		return 0, ErrUploadTooLarge
+	}
+	n, err := l.Reader.Read(p)
+	l.n += int64(n)
+	if l.n > l.max {
+		l.exceeded = true
+		return n, ErrUploadTooLarge
+	}
+	return n, err
+}
+
+// 请求使用的上传规则路径，通过/submit 上传时为/submit
+func requestPolicyPath(r *http.Request, isFiler bool) string {
+	if isFiler {
+		return strings.TrimPrefix(r.URL.Path, "/filer")
+	}
+	return "/submit"
+}
+
+func (ps *ProxyServer) uploadPolicy(path string, uniSource string) *util.UploadPolicy {
+	if len(ps.Config.UploadPolicies) == 0 {
+		return nil
+	}
+	return util.MatchUploadPolicy(ps.Config.UploadPolicies, path, uniSource)
+}
+
+/**
+ * 检查请求大小：Content-Length 超过限制时直接拒绝，
+ * 否则包装请求内容，读取超过限制时返回错误
+ */
+func (ps *ProxyServer) limitUploadRequest(r *http.Request, isFiler bool,
+	uniSource string) (*policyLimitReader, error) {
+	policy := ps.uploadPolicy(requestPolicyPath(r, isFiler), uniSource)
+	if policy == nil || policy.MaxRequestSize <= 0 {
+		return nil, nil
+	}
+	if r.ContentLength > policy.MaxRequestSize {
+		return nil, newPolicyError(http.StatusRequestEntityTooLarge,
+			"Request size %d exceeds the limit %d!", r.ContentLength, policy.MaxRequestSize)
+	}
+	limit := &policyLimitReader{Reader: r.Body, max: policy.MaxRequestSize}
+	r.Body = &policyLimitBody{policyLimitReader: limit, Closer: r.Body}
+	return limit, nil
+}
+
+/**
+ * 检查扩展名、类型与已知的文件大小，mtype 为空时按扩展名判断类型
+ */
+func checkUploadMeta(policy *util.UploadPolicy, name string, mtype string,
+	size int64) (string, error) {
+	if !policy.AllowExtension(name) {
+		return "", newPolicyError(http.StatusUnsupportedMediaType,
+			"File extension of %s is not allowed!", name)
+	}
+	if mtype == "" {
+		if mtype = mimeTypes.ByFilename(name); mtype == "" {
+			mtype = mime.TypeByExtension(strings.ToLower(filepath.Ext(name)))
+		}
+	}
+	if !util.IsGenericMimeType(mtype) && !policy.AllowMimeType(mtype) {
+		return "", newPolicyError(http.StatusUnsupportedMediaType,
+			"File type %s of %s is not allowed!", mtype, name)
+	}
+	if size >= 0 && policy.MaxFileSize > 0 && size > policy.MaxFileSize {
+		return "", newPolicyError(http.StatusRequestEntityTooLarge,
+			"File size %d of %s exceeds the limit %d!", size, name, policy.MaxFileSize)
+	}
+	return mtype, nil
+}
+
+/**
+ * 按上传规则检查文件，需要时读取文件开头识别实际类型：
+ * 与扩展名或声明的类型不符，或者类型未知且不在允许的类型中时拒绝；
+ * 返回的reader 包含识别类型时已读取的内容，大小未知时读取超过限制返回错误
+ */
+func checkUploadFile(policy *util.UploadPolicy, file io.Reader, size int64,
+	name string, mtype string) (io.Reader, *policyLimitReader, error) {
+	mtype, err := checkUploadMeta(policy, name, mtype, size)
+	if err != nil {
+		return nil, nil, err
+	}
+	if policy.SniffContent || len(policy.MimeTypes) > 0 {
+		head := make([]byte, sniffSize)
+		n, err := io.ReadFull(file, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, nil, err
+		}
+		head = head[:n]
+		file = io.MultiReader(bytes.NewReader(head), file)
+		detected := http.DetectContentType(head)
+		if policy.SniffContent && !util.ContentTypeMatches(mtype, detected) {
+			return nil, nil, newPolicyError(http.StatusUnsupportedMediaType,
+				"Content of %s is %s, it does not match the file type %s!",
+				name, detected, mtype)
+		}
+		if util.IsGenericMimeType(mtype) && !policy.AllowMimeType(detected) {
+			return nil, nil, newPolicyError(http.StatusUnsupportedMediaType,
+				"File type %s of %s is not allowed!", detected, name)
+		}
+	}
+	var limit *policyLimitReader
+	if policy.MaxFileSize > 0 {
+		limit = &policyLimitReader{Reader: file, max: policy.MaxFileSize}
+		file = limit
+	}
+	return file, limit, nil
+}
+
+// 上传失败时返回的http 状态码
+func submitErrorStatus(err error) int {
+	if err == ErrNullFilename {
+		return http.StatusBadRequest
+	}
+	if e, ok := err.(*policyError); ok {
+		return e.status
+	}
+	return http.StatusInternalServerError
+}
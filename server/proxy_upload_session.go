@@ -0,0 +1,761 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/stats"
+	"github.com/wangfeiping/weeder/util"
+)
+
+const (
+	uploadSessionExt       = ".session"
+	uploadSessionMaxChunks = 10000
+)
+
+var ErrSessionNotFound = errors.New("Upload session not found!")
+var ErrSessionCommitting = errors.New("Upload session is committing!")
+var ErrChecksumMismatch = errors.New("Chunk checksum mismatch!")
+
+/**
+ * 分片上传会话，保存在会话目录下的{id}.session 文件中；
+ * 分片编号从0 开始，除最后一个分片外大小均为chunkSize
+ */
+type UploadSession struct {
+	Id        string                `json:"id"`
+	Path      string                `json:"path"`
+	Mime      string                `json:"mime,omitempty"`
+	Ttl       string                `json:"ttl,omitempty"`
+	Size      int64                 `json:"size"`
+	ChunkSize int64                 `json:"chunkSize"`
+	Count     int                   `json:"count"`
+	Chunks    map[int]*SessionChunk `json:"chunks"`
+	UniSource string                `json:"uniSource,omitempty"`
+	Placement *util.Placement       `json:"placement,omitempty"`
+	Created   int64                 `json:"created"`
+	Updated   int64                 `json:"updated"`
+}
+
+type SessionChunk struct {
+	Fid  string `json:"fid"`
+	Size int64  `json:"size"`
+	Md5  string `json:"md5"`
+}
+
+type UploadSessionResult struct {
+	Status  int            `json:"status"`
+	Message string         `json:"message"`
+	Session *UploadSession `json:"session,omitempty"`
+	Missing []int          `json:"missing,omitempty"`
+	File    *log.FileMeta  `json:"file,omitempty"`
+}
+
+type uploadSessionStore struct {
+	sync.Mutex
+	config   *util.UploadSessionConfig
+	sessions map[string]*UploadSession
+	// 正在上传分片的数量及正在提交的会话，清理超时会话时跳过
+	uploading  map[string]int
+	committing map[string]bool
+}
+
+var uploadSessions *uploadSessionStore
+
+func initUploadSession(ps *ProxyServer) {
+	c := &ps.Config.UploadSession
+	log.DebugS("main", "config: uploadSession ", c.Enable)
+	if !c.Enable {
+		return
+	}
+	if c.Dir == "" {
+		c.Dir = "./sessions"
+	}
+	if c.ChunkSize <= 0 {
+		c.ChunkSize = 8 << 20
+	}
+	if c.MaxChunkSize <= 0 {
+		c.MaxChunkSize = 64 << 20
+	}
+	if c.MaxSize <= 0 {
+		c.MaxSize = 16 << 30
+	}
+	if c.Ttl <= 0 {
+		c.Ttl = 24 * 3600
+	}
+	if c.GcInterval <= 0 {
+		c.GcInterval = 600
+	}
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
+		log.ErrorS("main", "config: uploadSession dir error: ", err.Error())
+		return
+	}
+	store := &uploadSessionStore{
+		config:     c,
+		sessions:   make(map[string]*UploadSession),
+		uploading:  make(map[string]int),
+		committing: make(map[string]bool),
+	}
+	if err := store.load(); err != nil {
+		log.ErrorS("main", "config: uploadSession load error: ", err.Error())
+		return
+	}
+	uploadSessions = store
+	log.DebugS("main", "config: uploadSession dir ", c.Dir,
+		" sessions ", len(store.sessions), " chunkSize ", c.ChunkSize,
+		" maxChunkSize ", c.MaxChunkSize, " maxSize ", c.MaxSize,
+		" ttl ", c.Ttl, " gcInterval ", c.GcInterval)
+	go ps.uploadSessionGc()
+}
+
+/**
+ * 分片上传会话，与上传相同需要白名单许可（及Uni-Source 请求头）：
+ *
+ * 创建会话：POST /split?session&path=/app/dir/name.ext&size=20000000[&chunkSize=8388608&ttl=3d&mime=video/mp4]
+ * 上传分片：PUT /split?session={id}&chunk=0，请求内容为分片内容，
+ *	Content-MD5 请求头（base64）或md5 参数（hex）校验分片内容，重复上传的分片覆盖之前的内容
+ * 查询会话：GET /split?session={id}，missing 为未上传的分片编号
+ * 提交文件：POST /split?session={id}&commit，上传chunks manifest 并注册filer 路径
+ * 取消上传：DELETE /split?session={id}，删除已上传的分片
+ *
+ * 超过ttl 没有更新的会话定时清理，同时删除已上传的分片。
+ */
+func (ps *ProxyServer) uploadSession(w http.ResponseWriter, r *http.Request,
+	logHeader *log.LogHeader) {
+	logHeader.ClassName = "upload_session"
+	logHeader.Key = "response"
+	ret := &UploadSessionResult{Status: http.StatusOK, Message: "ok"}
+	query := r.URL.Query()
+	id := query.Get("session")
+	_, isChunk := query["chunk"]
+	_, isCommit := query["commit"]
+	switch {
+	case uploadSessions == nil:
+		ret.Status = http.StatusNotImplemented
+		ret.Message = "Upload session is not enabled."
+	case id == "" && strings.EqualFold(r.Method, "post"):
+		ps.createUploadSession(r, ret, logHeader)
+	case id == "":
+		ret.Status = http.StatusBadRequest
+		ret.Message = "Bad request, session is required!"
+	case isChunk && (strings.EqualFold(r.Method, "put") ||
+		strings.EqualFold(r.Method, "post")):
+		ps.uploadSessionChunk(id, r, ret, logHeader)
+	case isCommit && strings.EqualFold(r.Method, "post"):
+		ps.commitUploadSession(id, r, ret, logHeader)
+	case strings.EqualFold(r.Method, "get"):
+		uploadSessions.status(id, logHeader.UserId, ret)
+	case strings.EqualFold(r.Method, "delete"):
+		ps.abortUploadSession(id, ret, logHeader)
+	default:
+		ret.Status = http.StatusMethodNotAllowed
+		ret.Message = "Method not allowed!"
+	}
+	writeUploadSessionResult(w, ret, logHeader)
+}
+
+func (ps *ProxyServer) createUploadSession(r *http.Request,
+	ret *UploadSessionResult, logHeader *log.LogHeader) {
+	c := uploadSessions.config
+	query := r.URL.Query()
+	path := query.Get("path")
+	if !strings.HasPrefix(path, "/") || strings.HasSuffix(path, "/") ||
+		strings.LastIndex(path, "/") == 0 {
+		// 与filer 上传相同，文件不允许保存在根路径下
+		ret.Status = http.StatusBadRequest
+		ret.Message = "Bad request, path is invalid!"
+		return
+	}
+	size, err := strconv.ParseInt(query.Get("size"), 10, 64)
+	if err != nil || size <= 0 || size > c.MaxSize {
+		ret.Status = http.StatusBadRequest
+		ret.Message = "Bad request, size is invalid!"
+		return
+	}
+	if policy := ps.uploadPolicy(path, logHeader.UserId); policy != nil {
+		// 分片上传不识别文件内容，只检查扩展名、类型与大小
+		_, err = checkUploadMeta(policy, filepath.Base(path), query.Get("mime"), size)
+		if err != nil {
+			ret.Status = submitErrorStatus(err)
+			ret.Message = err.Error()
+			return
+		}
+	}
+	chunkSize := c.ChunkSize
+	if v := query.Get("chunkSize"); v != "" {
+		chunkSize, err = strconv.ParseInt(v, 10, 64)
+		if err != nil || chunkSize <= 0 || chunkSize > c.MaxChunkSize {
+			ret.Status = http.StatusBadRequest
+			ret.Message = "Bad request, chunkSize is invalid!"
+			return
+		}
+	}
+	count := (size + chunkSize - 1) / chunkSize
+	if count > uploadSessionMaxChunks {
+		ret.Status = http.StatusBadRequest
+		ret.Message = fmt.Sprintf("Bad request, too many chunks (%d)!", count)
+		return
+	}
+	placement, err := ps.uploadPlacement(query, path, logHeader.UserId)
+	if err != nil {
+		ret.Status = submitErrorStatus(err)
+		ret.Message = err.Error()
+		return
+	}
+	ttl := query.Get("ttl")
+	if !strings.EqualFold(ps.Config.DevEnvEnforcedTtl, "") {
+		ttl = ps.Config.DevEnvEnforcedTtl
+	}
+	mtype := query.Get("mime")
+	if mtype == "" {
+		mtype = mimeTypes.ByFilename(path)
+	}
+	id, err := newUploadSessionId()
+	if err != nil {
+		ret.Status = http.StatusInternalServerError
+		ret.Message = err.Error()
+		return
+	}
+	now := time.Now().Unix()
+	s := &UploadSession{
+		Id:        id,
+		Path:      path,
+		Mime:      mtype,
+		Ttl:       ttl,
+		Size:      size,
+		ChunkSize: chunkSize,
+		Count:     int(count),
+		Chunks:    make(map[int]*SessionChunk),
+		UniSource: logHeader.UserId,
+		Placement: placement,
+		Created:   now,
+		Updated:   now,
+	}
+	if err = uploadSessions.create(s); err != nil {
+		ret.Status = http.StatusInternalServerError
+		ret.Message = err.Error()
+		return
+	}
+	stats.Incr("uploadSession.created")
+	ret.Session = s.clone()
+	ret.Missing = s.missing()
+}
+
+/**
+ * 上传分片到seaweedfs，校验大小与md5 后记录到会话；
+ * 校验失败或会话已删除时删除刚上传的分片
+ */
+func (ps *ProxyServer) uploadSessionChunk(id string, r *http.Request,
+	ret *UploadSessionResult, logHeader *log.LogHeader) {
+	index, err := strconv.Atoi(r.URL.Query().Get("chunk"))
+	if err != nil {
+		ret.Status = http.StatusBadRequest
+		ret.Message = "Bad request, chunk is invalid!"
+		return
+	}
+	expectedMd5, err := chunkChecksum(r)
+	if err != nil {
+		ret.Status = http.StatusBadRequest
+		ret.Message = "Bad request, checksum is invalid!"
+		return
+	}
+	s, status, err := uploadSessions.acquire(id, logHeader.UserId)
+	if err != nil {
+		ret.Status = status
+		ret.Message = err.Error()
+		return
+	}
+	defer uploadSessions.release(id)
+	if index < 0 || index >= s.Count {
+		ret.Status = http.StatusBadRequest
+		ret.Message = fmt.Sprintf("Bad request, chunk must be in [0, %d)!", s.Count)
+		return
+	}
+	ps.throttleUpload(r, logHeader)
+	chunk, status, err := ps.uploadChunk(s, index, r.Body, expectedMd5, logHeader)
+	if err != nil {
+		stats.Incr("uploadSession.chunkErrors")
+		ret.Status = status
+		ret.Message = err.Error()
+		return
+	}
+	old, err := uploadSessions.putChunk(id, index, chunk)
+	if err != nil {
+		ps.deleteFids([]string{chunk.Fid}, logHeader)
+		ret.Status = http.StatusInternalServerError
+		if err == ErrSessionNotFound {
+			ret.Status = http.StatusNotFound
+		} else if err == ErrSessionCommitting {
+			ret.Status = http.StatusConflict
+		}
+		ret.Message = err.Error()
+		return
+	}
+	if old != nil && old.Fid != chunk.Fid {
+		ps.deleteFids([]string{old.Fid}, logHeader)
+	}
+	stats.Incr("uploadSession.chunks")
+	log.Debug(logHeader, "upload session ", id, " chunk ", index, " -> ", chunk.Fid)
+	uploadSessions.status(id, logHeader.UserId, ret)
+}
+
+func (ps *ProxyServer) uploadChunk(s *UploadSession, index int, body io.Reader,
+	expectedMd5 []byte, logHeader *log.LogHeader) (*SessionChunk, int, error) {
+	expected := s.chunkLength(index)
+	// 多读取一个字节用于判断分片是否超过大小
+	hash := md5.New()
+	counter := &countingReader{r: io.LimitReader(body, expected+1)}
+	assigned, err := ps.uploadChunkContent(
+		fmt.Sprintf("%s.%d", filepath.Base(s.Path), index), s.Ttl, s.Placement,
+		io.TeeReader(counter, hash), logHeader)
+	if err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	sum := hash.Sum(nil)
+	if counter.n != expected {
+		err = fmt.Errorf("Bad request, chunk %d size must be %d!", index, expected)
+	} else if expectedMd5 != nil && !bytes.Equal(sum, expectedMd5) {
+		err = ErrChecksumMismatch
+	}
+	if err != nil {
+		ps.deleteFids([]string{assigned.Fid}, logHeader)
+		return nil, http.StatusBadRequest, err
+	}
+	return &SessionChunk{
+		Fid:  assigned.Fid,
+		Size: counter.n,
+		Md5:  hex.EncodeToString(sum),
+	}, http.StatusOK, nil
+}
+
+/**
+ * 所有分片上传完成后生成chunks manifest，上传并注册filer 路径
+ */
+func (ps *ProxyServer) commitUploadSession(id string, r *http.Request,
+	ret *UploadSessionResult, logHeader *log.LogHeader) {
+	s, status, err := uploadSessions.beginCommit(id, logHeader.UserId)
+	if err != nil {
+		if status == http.StatusConflict {
+			// 返回未上传的分片
+			uploadSessions.status(id, logHeader.UserId, ret)
+		}
+		ret.Status = status
+		ret.Message = err.Error()
+		return
+	}
+	// 提交时检查条件请求头，条件不满足时会话保留，可以重新提交
+	unlock, err := ps.checkUploadCondition(r, s.Path,
+		ps.uploadPolicy(s.Path, logHeader.UserId), logHeader)
+	if err != nil {
+		uploadSessions.endCommit(id, false)
+		ret.Status = submitErrorStatus(err)
+		ret.Message = err.Error()
+		return
+	}
+	defer unlock()
+	manifest := s.manifest()
+	var bs []byte
+	if err = manifest.Validate(); err == nil {
+		bs, err = manifest.Marshal()
+	}
+	var assigned *AssignResult
+	if err == nil {
+		assigned, err = ps.registerChunkManifest(bytes.NewReader(bs),
+			filepath.Base(s.Path), s.Path, s.Ttl, s.Placement, logHeader)
+	}
+	if err != nil {
+		uploadSessions.endCommit(id, false)
+		stats.Incr("uploadSession.commitErrors")
+		ret.Status = http.StatusInternalServerError
+		ret.Message = err.Error()
+		return
+	}
+	uploadSessions.endCommit(id, true)
+	// 通过/admin/register 映射，filer 不删除原fid，释放去重上传的原文件
+	if dedup != nil {
+		if e := ps.replaceDedupPath(s.Path, logHeader); e != nil {
+			log.Error(logHeader, "dedup release error: ", s.Path, " ", e.Error())
+		}
+	}
+	if ps.Config.RedisCacheTtl != "" {
+		redisclient.CacheFilePath(s.Path, assigned.Fid, ps.Config.RedisCacheTtl)
+	}
+	deleteFileDigest(s.Path, logHeader)
+	invalidateCache(s.Path)
+	ps.mirrorUploadStored(s.Path, true, filepath.Base(s.Path), s.Ttl, s.Placement, logHeader)
+	stats.Incr("uploadSession.committed")
+	log.Debug(logHeader, "upload session ", id, " committed: ", s.Path, " -> ", assigned.Fid)
+	ret.File = &log.FileMeta{
+		Name:      filepath.Base(s.Path),
+		Fid:       assigned.Fid,
+		Url:       ps.Config.FileUrlPrefix + assigned.Fid,
+		PublicUrl: assigned.PublicUrl,
+		Size:      int(s.Size),
+	}
+}
+
+func (ps *ProxyServer) abortUploadSession(id string, ret *UploadSessionResult,
+	logHeader *log.LogHeader) {
+	s, status, err := uploadSessions.remove(id, logHeader.UserId)
+	if err != nil {
+		ret.Status = status
+		ret.Message = err.Error()
+		return
+	}
+	stats.Incr("uploadSession.aborted")
+	ps.deleteFids(s.manifest().Fids(), logHeader)
+}
+
+// 定时清理超时的会话及其分片
+func (ps *ProxyServer) uploadSessionGc() {
+	c := uploadSessions.config
+	logHeader := &log.LogHeader{
+		ClassName:  "upload_session",
+		MethodName: "gc",
+		Key:        "gc",
+	}
+	tick := time.NewTicker(time.Duration(c.GcInterval) * time.Second)
+	defer tick.Stop()
+	for range tick.C {
+		expired := uploadSessions.expire(time.Now().Unix() - c.Ttl)
+		for _, s := range expired {
+			log.Info(logHeader, `{"expired":"`, s.Id, `", "path":"`, s.Path, `"}`)
+			stats.Incr("uploadSession.expired")
+			ps.deleteFids(s.manifest().Fids(), logHeader)
+		}
+	}
+}
+
+/**
+ * 申请fid 上传一个分片，placement 为nil 时使用默认存储位置
+ */
+func (ps *ProxyServer) uploadChunkContent(name string, ttl string,
+	placement *util.Placement, content io.Reader,
+	logHeader *log.LogHeader) (*AssignResult, error) {
+	ar := newAssignRequest(ttl, placement)
+	assigned, err := Assign(ps.getFileUrl("", false, 0), ar, logHeader)
+	if err != nil {
+		return nil, err
+	}
+	uploadUrl := "http://" + assigned.Url + "/" + assigned.Fid
+	if ttl != "" {
+		uploadUrl = uploadUrl + "?ttl=" + ttl
+	}
+	_, err = ps.Upload(uploadUrl, name, content, false,
+		"application/octet-stream", nil, logHeader)
+	if err != nil {
+		return nil, err
+	}
+	return assigned, nil
+}
+
+// 删除分片，失败时只记录日志
+func (ps *ProxyServer) deleteFids(fids []string, logHeader *log.LogHeader) {
+	for _, fid := range fids {
+		if err := ps.weedDelete(nil, "/"+fid, false, logHeader, 0); err != nil {
+			log.Error(logHeader, "delete chunk error: ", fid, " ", err.Error())
+		}
+	}
+}
+
+func writeUploadSessionResult(w http.ResponseWriter, ret *UploadSessionResult,
+	logHeader *log.LogHeader) {
+	bs, err := json.Marshal(ret)
+	if err != nil {
+		logHeader.Status = "err"
+		log.Error(logHeader, err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(ret.Status)
+	w.Write(bs)
+	w.Write([]byte("\n"))
+	if ret.Status == http.StatusOK {
+		logHeader.Status = "ok"
+		log.Info(logHeader, `{"message":"`, ret.Message, `"}`)
+	} else {
+		logHeader.Status = "err"
+		log.Error(logHeader, string(bs))
+	}
+}
+
+// 分片md5：Content-MD5 请求头为base64 编码，md5 参数为hex 编码，都没有时不校验
+func chunkChecksum(r *http.Request) ([]byte, error) {
+	if v := r.Header.Get("Content-MD5"); v != "" {
+		sum, err := base64.StdEncoding.DecodeString(v)
+		if err == nil && len(sum) != md5.Size {
+			err = ErrChecksumMismatch
+		}
+		return sum, err
+	}
+	if v := r.URL.Query().Get("md5"); v != "" {
+		sum, err := hex.DecodeString(v)
+		if err == nil && len(sum) != md5.Size {
+			err = ErrChecksumMismatch
+		}
+		return sum, err
+	}
+	return nil, nil
+}
+
+func newUploadSessionId() (string, error) {
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(bs), nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (s *UploadSession) chunkLength(index int) int64 {
+	offset := int64(index) * s.ChunkSize
+	if s.Size-offset < s.ChunkSize {
+		return s.Size - offset
+	}
+	return s.ChunkSize
+}
+
+func (s *UploadSession) missing() []int {
+	missing := make([]int, 0)
+	for i := 0; i < s.Count; i++ {
+		if _, ok := s.Chunks[i]; !ok {
+			missing = append(missing, i)
+		}
+	}
+	return missing
+}
+
+func (s *UploadSession) manifest() *util.ChunkManifest {
+	cm := &util.ChunkManifest{
+		Name:   filepath.Base(s.Path),
+		Mime:   s.Mime,
+		Size:   s.Size,
+		Chunks: make([]*util.ChunkInfo, 0, len(s.Chunks)),
+	}
+	for i, c := range s.Chunks {
+		cm.Chunks = append(cm.Chunks, &util.ChunkInfo{
+			Fid:    c.Fid,
+			Offset: int64(i) * s.ChunkSize,
+			Size:   c.Size,
+		})
+	}
+	return cm
+}
+
+func (s *UploadSession) clone() *UploadSession {
+	c := *s
+	c.Chunks = make(map[int]*SessionChunk, len(s.Chunks))
+	for i, chunk := range s.Chunks {
+		c.Chunks[i] = chunk
+	}
+	return &c
+}
+
+func (st *uploadSessionStore) file(id string) string {
+	return filepath.Join(st.config.Dir, id+uploadSessionExt)
+}
+
+func (st *uploadSessionStore) load() error {
+	names, err := filepath.Glob(filepath.Join(st.config.Dir, "*"+uploadSessionExt))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		bs, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		s := &UploadSession{}
+		if err = json.Unmarshal(bs, s); err != nil {
+			log.ErrorS("main", "upload session ", name, " error: ", err.Error())
+			continue
+		}
+		if s.Chunks == nil {
+			s.Chunks = make(map[int]*SessionChunk)
+		}
+		st.sessions[s.Id] = s
+	}
+	return nil
+}
+
+// 先写入临时文件再改名，避免进程退出时留下不完整的会话文件
+func (st *uploadSessionStore) save(s *UploadSession) error {
+	bs, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(st.config.Dir, s.Id+".tmp")
+	if err = ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, st.file(s.Id))
+}
+
+func (st *uploadSessionStore) create(s *UploadSession) error {
+	st.Lock()
+	defer st.Unlock()
+	if err := st.save(s); err != nil {
+		return err
+	}
+	st.sessions[s.Id] = s
+	return nil
+}
+
+// 调用时需要持有锁
+func (st *uploadSessionStore) get(id string, uniSource string) (*UploadSession, int, error) {
+	s, ok := st.sessions[id]
+	if !ok {
+		return nil, http.StatusNotFound, ErrSessionNotFound
+	}
+	if s.UniSource != "" && s.UniSource != uniSource {
+		return nil, http.StatusForbidden,
+			errors.New("Upload session belongs to another Uni-Source!")
+	}
+	return s, http.StatusOK, nil
+}
+
+func (st *uploadSessionStore) status(id string, uniSource string,
+	ret *UploadSessionResult) {
+	st.Lock()
+	defer st.Unlock()
+	s, status, err := st.get(id, uniSource)
+	if err != nil {
+		ret.Status = status
+		ret.Message = err.Error()
+		return
+	}
+	ret.Session = s.clone()
+	ret.Missing = s.missing()
+}
+
+// 开始上传分片，返回会话的副本
+func (st *uploadSessionStore) acquire(id string, uniSource string) (*UploadSession, int, error) {
+	st.Lock()
+	defer st.Unlock()
+	s, status, err := st.get(id, uniSource)
+	if err != nil {
+		return nil, status, err
+	}
+	if st.committing[id] {
+		return nil, http.StatusConflict, ErrSessionCommitting
+	}
+	st.uploading[id]++
+	return s.clone(), http.StatusOK, nil
+}
+
+func (st *uploadSessionStore) release(id string) {
+	st.Lock()
+	defer st.Unlock()
+	if st.uploading[id]--; st.uploading[id] <= 0 {
+		delete(st.uploading, id)
+	}
+}
+
+// 记录上传完成的分片，返回被覆盖的分片
+func (st *uploadSessionStore) putChunk(id string, index int,
+	chunk *SessionChunk) (*SessionChunk, error) {
+	st.Lock()
+	defer st.Unlock()
+	s, ok := st.sessions[id]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+	if st.committing[id] {
+		return nil, ErrSessionCommitting
+	}
+	old := s.Chunks[index]
+	s.Chunks[index] = chunk
+	s.Updated = time.Now().Unix()
+	if err := st.save(s); err != nil {
+		s.Chunks[index] = old
+		return nil, err
+	}
+	return old, nil
+}
+
+func (st *uploadSessionStore) beginCommit(id string, uniSource string) (*UploadSession, int, error) {
+	st.Lock()
+	defer st.Unlock()
+	s, status, err := st.get(id, uniSource)
+	if err != nil {
+		return nil, status, err
+	}
+	if st.committing[id] || st.uploading[id] > 0 {
+		return nil, http.StatusConflict,
+			errors.New("Upload session has chunks in progress!")
+	}
+	if missing := s.missing(); len(missing) > 0 {
+		return nil, http.StatusConflict,
+			fmt.Errorf("Upload session has %d missing chunks!", len(missing))
+	}
+	st.committing[id] = true
+	return s.clone(), http.StatusOK, nil
+}
+
+// 提交成功后删除会话，分片成为文件的一部分
+func (st *uploadSessionStore) endCommit(id string, ok bool) {
+	st.Lock()
+	defer st.Unlock()
+	delete(st.committing, id)
+	if ok {
+		delete(st.sessions, id)
+		os.Remove(st.file(id))
+	}
+}
+
+func (st *uploadSessionStore) remove(id string, uniSource string) (*UploadSession, int, error) {
+	st.Lock()
+	defer st.Unlock()
+	s, status, err := st.get(id, uniSource)
+	if err != nil {
+		return nil, status, err
+	}
+	if st.committing[id] {
+		return nil, http.StatusConflict, ErrSessionCommitting
+	}
+	delete(st.sessions, id)
+	os.Remove(st.file(id))
+	return s, http.StatusOK, nil
+}
+
+// 删除before 之后没有更新、且没有正在上传或提交的会话
+func (st *uploadSessionStore) expire(before int64) []*UploadSession {
+	st.Lock()
+	defer st.Unlock()
+	var expired []*UploadSession
+	for id, s := range st.sessions {
+		if s.Updated >= before || st.uploading[id] > 0 || st.committing[id] {
+			continue
+		}
+		delete(st.sessions, id)
+		os.Remove(st.file(id))
+		expired = append(expired, s)
+	}
+	return expired
+}
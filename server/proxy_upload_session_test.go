@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/wangfeiping/weeder/log"
+	"github.com/wangfeiping/weeder/util"
+)
+
+func newTestUploadSessions(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "weeder-sessions-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploadSessions = &uploadSessionStore{
+		config: &util.UploadSessionConfig{
+			Dir: dir, ChunkSize: 4, MaxChunkSize: 1 << 20, MaxSize: 1 << 20, Ttl: 3600,
+		},
+		sessions:   make(map[string]*UploadSession),
+		uploading:  make(map[string]int),
+		committing: make(map[string]bool),
+	}
+	return func() {
+		uploadSessions = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func doTestSession(ps *ProxyServer, method string, query string,
+	body io.Reader) *UploadSessionResult {
+	r := httptest.NewRequest(method, "/split?"+query, body)
+	w := httptest.NewRecorder()
+	ps.uploadSession(w, r, &log.LogHeader{})
+	ret := &UploadSessionResult{}
+	json.Unmarshal(w.Body.Bytes(), ret)
+	return ret
+}
+
+func Test_UploadSession(t *testing.T) {
+	weed, shadow := newFakeWeed(), newFakeWeed()
+	defer weed.Close()
+	defer shadow.Close()
+	ps := newTestProxy(weed)
+	defer newTestUploadSessions(t)()
+	defer newTestMirror(t, ps, shadow)()
+
+	ret := doTestSession(ps, "POST", "session&path=/app/dir/v.bin&size=10", nil)
+	if ret.Status != http.StatusOK || len(ret.Missing) != 3 {
+		t.Fatal("Test_UploadSession: create ", ret.Status, " ", ret.Message)
+	}
+	id := ret.Session.Id
+	// md5 不一致的分片不记录
+	ret = doTestSession(ps, "PUT", "session="+id+"&chunk=0&md5=00000000000000000000000000000000",
+		strings.NewReader("abcd"))
+	if ret.Status != http.StatusBadRequest {
+		t.Error("Test_UploadSession: checksum ", ret.Status)
+	}
+	for i, chunk := range []string{"abcd", "efgh", "ij"} {
+		ret = doTestSession(ps, "PUT", "session="+id+"&chunk="+strconv.Itoa(i),
+			strings.NewReader(chunk))
+		if ret.Status != http.StatusOK {
+			t.Fatal("Test_UploadSession: chunk ", i, " ", ret.Message)
+		}
+	}
+	ret = doTestSession(ps, "POST", "session="+id+"&commit", nil)
+	if ret.Status != http.StatusOK || ret.File == nil || ret.File.Size != 10 {
+		t.Fatal("Test_UploadSession: commit ", ret.Status, " ", ret.Message)
+	}
+	manifest, ok := weed.get("/app/dir/v.bin")
+	if !ok || !strings.Contains(manifest, `"chunks"`) {
+		t.Error("Test_UploadSession: manifest ", manifest)
+	}
+	// 提交后写入镜像队列
+	runTestMirror(ps)
+	if content, _ := shadow.get("/app/dir/v.bin"); content != manifest {
+		t.Error("Test_UploadSession: mirror ", content)
+	}
+	ret = doTestSession(ps, "GET", "session="+id, nil)
+	if ret.Status != http.StatusNotFound {
+		t.Error("Test_UploadSession: committed session ", ret.Status)
+	}
+}
@@ -0,0 +1,204 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/wangfeiping/weeder/util"
+)
+
+/**
+ * 模拟seaweedfs 的master、volume 与filer，文件保存在内存中：
+ * filer 文件以路径为key，volume 文件以"/"+fid 为key；
+ * master 读取fid 时重定向到/volume/{fid}
+ */
+type fakeWeed struct {
+	sync.Mutex
+	*httptest.Server
+	files map[string][]byte
+	seq   int
+	// 收到的请求，格式为"{method} {转义的路径}"
+	calls []string
+	// 上传请求的查询参数，key 为转义的路径
+	queries map[string]url.Values
+}
+
+func newFakeWeed() *fakeWeed {
+	f := &fakeWeed{
+		files:   make(map[string][]byte),
+		queries: make(map[string]url.Values),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.handle))
+	return f
+}
+
+func (f *fakeWeed) put(path string, content string) {
+	f.Lock()
+	defer f.Unlock()
+	f.files[path] = []byte(content)
+}
+
+func (f *fakeWeed) get(path string) (string, bool) {
+	f.Lock()
+	defer f.Unlock()
+	content, ok := f.files[path]
+	return string(content), ok
+}
+
+func (f *fakeWeed) called(call string) bool {
+	f.Lock()
+	defer f.Unlock()
+	for _, c := range f.calls {
+		if c == call {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *fakeWeed) query(path string) url.Values {
+	f.Lock()
+	defer f.Unlock()
+	return f.queries[path]
+}
+
+func (f *fakeWeed) newFid() string {
+	f.seq++
+	return fmt.Sprintf("3,%02x637037d6", f.seq)
+}
+
+func (f *fakeWeed) handle(w http.ResponseWriter, r *http.Request) {
+	f.Lock()
+	defer f.Unlock()
+	path := r.URL.Path
+	f.calls = append(f.calls, r.Method+" "+r.URL.EscapedPath())
+	switch {
+	case path == "/dir/assign":
+		writeJson(w, &AssignResult{Fid: f.newFid(), Url: r.Host, PublicUrl: r.Host, Count: 1})
+	case path == "/admin/register":
+		r.ParseForm()
+		f.files[r.Form.Get("path")] = f.files["/"+r.Form.Get("fileId")]
+	case r.Method == "POST" || r.Method == "PUT":
+		f.queries[r.URL.EscapedPath()] = r.URL.Query()
+		f.upload(w, r)
+	case r.Method == "DELETE":
+		f.delete(w, strings.TrimPrefix(path, "/volume"))
+	case strings.HasSuffix(path, "/"):
+		f.list(w, path)
+	case fidChecker.MatchString(path) && strings.Contains(path, ","):
+		http.Redirect(w, r, "http://"+r.Host+"/volume"+path, http.StatusFound)
+	default:
+		content, ok := f.files[strings.TrimPrefix(path, "/volume")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, len(content)))
+		w.Write(content)
+	}
+}
+
+func (f *fakeWeed) upload(w http.ResponseWriter, r *http.Request) {
+	// 表单中只有一个文件，参数名不固定
+	reader, err := r.MultipartReader()
+	var part *multipart.Part
+	if err == nil {
+		part, err = reader.NextPart()
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	content, _ := ioutil.ReadAll(part)
+	filename := part.FileName()
+	fid := f.newFid()
+	switch path := r.URL.Path; {
+	case path == "/submit":
+		f.files["/"+fid] = content
+	case strings.HasSuffix(path, "/"):
+		f.files[path+filename] = content
+	case strings.Contains(path, ","):
+		// 上传到volume 时使用申请的fid
+		fid = path[1:]
+		f.files[path] = content
+	default:
+		f.files[path] = content
+	}
+	writeJson(w, map[string]interface{}{
+		"fid": fid, "fileName": filename, "name": filename,
+		"size": len(content),
+	})
+}
+
+// 目录只删除空目录
+func (f *fakeWeed) delete(w http.ResponseWriter, path string) {
+	if strings.HasSuffix(path, "/") {
+		for name := range f.files {
+			if strings.HasPrefix(name, path) {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if _, ok := f.files[path]; !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	delete(f.files, path)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// 按文件路径返回目录下的文件与子目录，没有文件的目录不存在
+func (f *fakeWeed) list(w http.ResponseWriter, dir string) {
+	var files []map[string]string
+	dirs := make(map[string]bool)
+	for name := range f.files {
+		if !strings.HasPrefix(name, dir) {
+			continue
+		}
+		rest := name[len(dir):]
+		if i := strings.Index(rest, "/"); i >= 0 {
+			dirs[rest[:i]] = true
+		} else {
+			files = append(files, map[string]string{"name": rest})
+		}
+	}
+	if len(files) == 0 && len(dirs) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i]["name"] < files[j]["name"] })
+	subdirs := make([]string, 0, len(dirs))
+	for name := range dirs {
+		subdirs = append(subdirs, name)
+	}
+	sort.Strings(subdirs)
+	writeJson(w, map[string]interface{}{
+		"Path": dir, "Files": files, "Subdirectories": subdirs,
+	})
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	bs, _ := json.Marshal(v)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
+
+// 使用fakeWeed 作为filer 与master 的ProxyServer，允许所有客户端写入
+func newTestProxy(weed *fakeWeed) *ProxyServer {
+	weedHttpClient = http.DefaultClient
+	mimeTypes = util.NewMimeTypes(nil)
+	ps := &ProxyServer{Config: &util.WeederConfig{}}
+	ps.Weeds = []Weed{{weed.URL, "filer"}, {weed.URL, "master"}}
+	return ps
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/wangfeiping/weeder/util"
+)
+
+var ErrInvalidFid = errors.New(`Invalid fid!`)
+
+type VolumeLocation struct {
+	Url       string `json:"url,omitempty"`
+	PublicUrl string `json:"publicUrl,omitempty"`
+}
+
+type LookupResult struct {
+	VolumeId  string           `json:"volumeId,omitempty"`
+	Locations []VolumeLocation `json:"locations,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+type lookupCacheEntry struct {
+	locations []VolumeLocation
+	expire    time.Time
+}
+
+var lookupCache = struct {
+	sync.RWMutex
+	entries map[string]*lookupCacheEntry
+}{entries: make(map[string]*lookupCacheEntry)}
+
+var lookupCacheTtl = 60 * time.Second
+
+/**
+ * 从fid 中解析volume id，
+ * fid 格式：3,01637037d6 或 /3,01637037d6.jpg
+ */
+func parseVolumeId(fid string) (string, error) {
+	fid = strings.TrimPrefix(fid, "/")
+	i := strings.Index(fid, ",")
+	if i < 1 {
+		return "", ErrInvalidFid
+	}
+	return fid[:i], nil
+}
+
+/**
+ * curl "http://192.168.1.182:9333/dir/lookup?volumeId=3"
+ *     {"volumeId":"3","locations":[{"url":"127.0.0.1:9360","publicUrl":"localhost:9360"}]}
+ */
+func Lookup(server string, vid string) (*LookupResult, error) {
+	values := make(url.Values)
+	values.Add("volumeId", vid)
+	jsonBlob, err := util.Post(server+"/dir/lookup", values)
+	if err != nil {
+		return nil, err
+	}
+	var ret LookupResult
+	err = json.Unmarshal(jsonBlob, &ret)
+	if err != nil {
+		return nil, err
+	}
+	if ret.Error != "" {
+		return nil, errors.New(ret.Error)
+	}
+	return &ret, nil
+}
+
+/**
+ * 查询volume 所有副本位置，查询结果按lookupCacheTtl 缓存
+ */
+func lookupVolumeLocations(server string, fid string) ([]VolumeLocation, error) {
+	vid, err := parseVolumeId(fid)
+	if err != nil {
+		return nil, err
+	}
+	key := server + "/" + vid
+	lookupCache.RLock()
+	entry, ok := lookupCache.entries[key]
+	lookupCache.RUnlock()
+	if ok && time.Now().Before(entry.expire) {
+		return entry.locations, nil
+	}
+	ret, err := Lookup(server, vid)
+	if err != nil {
+		return nil, err
+	}
+	lookupCache.Lock()
+	lookupCache.entries[key] = &lookupCacheEntry{
+		locations: ret.Locations,
+		expire:    time.Now().Add(lookupCacheTtl),
+	}
+	lookupCache.Unlock()
+	return ret.Locations, nil
+}
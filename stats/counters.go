@@ -0,0 +1,55 @@
+package stats
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// counters holds named cumulative counters, they are exported by the
+// proxy's /stats api.
+var counters = struct {
+	sync.RWMutex
+	values map[string]*int64
+}{values: make(map[string]*int64)}
+
+func counter(name string) *int64 {
+	counters.RLock()
+	c, ok := counters.values[name]
+	counters.RUnlock()
+	if ok {
+		return c
+	}
+	counters.Lock()
+	defer counters.Unlock()
+	if c, ok = counters.values[name]; !ok {
+		c = new(int64)
+		counters.values[name] = c
+	}
+	return c
+}
+
+// Incr adds one to the named counter.
+func Incr(name string) {
+	atomic.AddInt64(counter(name), 1)
+}
+
+// Add adds val to the named counter.
+func Add(name string, val int64) {
+	atomic.AddInt64(counter(name), val)
+}
+
+// Get returns the current value of the named counter.
+func Get(name string) int64 {
+	return atomic.LoadInt64(counter(name))
+}
+
+// Counters returns a snapshot of all named counters.
+func Counters() map[string]int64 {
+	counters.RLock()
+	defer counters.RUnlock()
+	snapshot := make(map[string]int64, len(counters.values))
+	for name, c := range counters.values {
+		snapshot[name] = atomic.LoadInt64(c)
+	}
+	return snapshot
+}
@@ -0,0 +1,29 @@
+package stats
+
+import (
+	"sync"
+	"testing"
+)
+
+func Test_Counters(t *testing.T) {
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				Incr("test.incr")
+			}
+		}()
+	}
+	wg.Wait()
+	Add("test.add", 5)
+	Add("test.add", -2)
+	if Get("test.incr") != 1000 {
+		t.Error("Test_Counters incr: ", Get("test.incr"))
+	}
+	snapshot := Counters()
+	if snapshot["test.add"] != 3 {
+		t.Error("Test_Counters add: ", snapshot["test.add"])
+	}
+}
@@ -0,0 +1,43 @@
+package util
+
+import (
+	"strconv"
+	"strings"
+)
+
+/**
+ * 按Accept-Encoding 请求头判断客户端是否接受coding 编码，
+ * 支持q 值与“*”，q=0 表示不接受
+ */
+func AcceptsEncoding(acceptEncoding string, coding string) bool {
+	accepted, wildcard := false, false
+	explicit, wildcardSet := false, false
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		parts := strings.Split(item, ";")
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		switch name {
+		case coding:
+			explicit = true
+			accepted = q > 0
+		case "*":
+			wildcardSet = true
+			wildcard = q > 0
+		}
+	}
+	if explicit {
+		return accepted
+	}
+	return wildcardSet && wildcard
+}
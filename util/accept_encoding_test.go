@@ -0,0 +1,26 @@
+package util
+
+import (
+	"testing"
+)
+
+func Test_AcceptsEncoding(t *testing.T) {
+	cases := map[string]bool{
+		"":                       false,
+		"gzip":                   true,
+		"gzip, deflate, br":      true,
+		"deflate, GZIP;q=0.5":    true,
+		"br;q=1.0, gzip;q=0":     false,
+		"*":                      true,
+		"*;q=0":                  false,
+		"gzip;q=0, *":            false,
+		"identity":               false,
+		"br, *;q=0.1":            true,
+		"gzip;q=0.000, identity": false,
+	}
+	for header, expected := range cases {
+		if AcceptsEncoding(header, "gzip") != expected {
+			t.Error("Test_AcceptsEncoding: ", header)
+		}
+	}
+}
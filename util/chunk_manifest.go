@@ -0,0 +1,66 @@
+package util
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var ErrNoChunks = errors.New("chunk manifest has no chunks")
+
+/**
+ * seaweedfs 分片文件的chunks manifest，以?cm=true 参数上传到申请的fid，
+ * 下载时由volume 服务器按offset 顺序合并各分片
+ */
+type ChunkManifest struct {
+	Name   string       `json:"name,omitempty"`
+	Mime   string       `json:"mime,omitempty"`
+	Size   int64        `json:"size,omitempty"`
+	Chunks []*ChunkInfo `json:"chunks"`
+}
+
+type ChunkInfo struct {
+	Fid    string `json:"fid"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// 按offset 排序并检查各分片是否连续覆盖整个文件
+func (cm *ChunkManifest) Validate() error {
+	if len(cm.Chunks) == 0 {
+		return ErrNoChunks
+	}
+	sort.Slice(cm.Chunks, func(i, j int) bool {
+		return cm.Chunks[i].Offset < cm.Chunks[j].Offset
+	})
+	var offset int64
+	for _, c := range cm.Chunks {
+		if c.Fid == "" {
+			return fmt.Errorf("chunk at offset %d has no fid", c.Offset)
+		}
+		if c.Offset != offset || c.Size <= 0 {
+			return fmt.Errorf("chunk at offset %d (size %d) is not contiguous",
+				c.Offset, c.Size)
+		}
+		offset += c.Size
+	}
+	if offset != cm.Size {
+		return fmt.Errorf("chunks size %d does not match file size %d",
+			offset, cm.Size)
+	}
+	return nil
+}
+
+func (cm *ChunkManifest) Marshal() ([]byte, error) {
+	return json.Marshal(cm)
+}
+
+// 分片的fid 列表，用于上传失败或取消时删除已上传的分片
+func (cm *ChunkManifest) Fids() []string {
+	fids := make([]string, 0, len(cm.Chunks))
+	for _, c := range cm.Chunks {
+		fids = append(fids, c.Fid)
+	}
+	return fids
+}
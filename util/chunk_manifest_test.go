@@ -0,0 +1,47 @@
+package util
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func Test_ChunkManifestValidate(t *testing.T) {
+	cm := &ChunkManifest{
+		Name: "a.bin",
+		Size: 25,
+		Chunks: []*ChunkInfo{
+			{Fid: "3,02", Offset: 10, Size: 10},
+			{Fid: "3,03", Offset: 20, Size: 5},
+			{Fid: "3,01", Offset: 0, Size: 10},
+		},
+	}
+	if err := cm.Validate(); err != nil {
+		t.Error("Test_ChunkManifestValidate: ", err)
+	}
+	if cm.Chunks[0].Fid != "3,01" || cm.Chunks[2].Fid != "3,03" {
+		t.Error("Test_ChunkManifestValidate: not sorted")
+	}
+	bs, _ := cm.Marshal()
+	decoded := &ChunkManifest{}
+	if err := json.Unmarshal(bs, decoded); err != nil || len(decoded.Chunks) != 3 ||
+		decoded.Chunks[1].Offset != 10 {
+		t.Error("Test_ChunkManifestValidate: marshal ", string(bs))
+	}
+	if fids := cm.Fids(); len(fids) != 3 || fids[1] != "3,02" {
+		t.Error("Test_ChunkManifestValidate: fids ", fids)
+	}
+
+	cm.Size = 30
+	if cm.Validate() == nil {
+		t.Error("Test_ChunkManifestValidate: size mismatch accepted")
+	}
+	cm.Size = 25
+	cm.Chunks = cm.Chunks[1:]
+	if cm.Validate() == nil {
+		t.Error("Test_ChunkManifestValidate: gap accepted")
+	}
+	cm.Chunks = nil
+	if cm.Validate() != ErrNoChunks {
+		t.Error("Test_ChunkManifestValidate: empty accepted")
+	}
+}
@@ -28,6 +28,252 @@ type QiniuConfig struct {
 	Bucket    string `json:"bucket"`
 }
 
+// 多副本对冲读取配置，延迟单位为毫秒
+type HedgedReadConfig struct {
+	Enable         bool    `json:"enable"`
+	Percentile     float64 `json:"percentile"`     // 按响应头到达耗时的分位数计算对冲延迟，默认95
+	MinDelay       int     `json:"minDelay"`       // 对冲延迟下限，默认10
+	MaxDelay       int     `json:"maxDelay"`       // 对冲延迟上限，样本不足时使用，默认500
+	MaxHedgeRatio  int     `json:"maxHedgeRatio"`  // 对冲请求占读请求的最大百分比，默认10
+	LookupCacheTtl int     `json:"lookupCacheTtl"` // volume 位置缓存时间，单位秒，默认60
+}
+
+// 写操作镜像到shadow 集群的配置
+type MirrorConfig struct {
+	Enable     bool   `json:"enable"`
+	QueueDir   string `json:"queueDir"`   // 本地持久化队列目录，默认./mirror
+	MaxRetry   int    `json:"maxRetry"`   // 最大重试次数，超过后记录为不一致，默认10
+	RetryDelay int    `json:"retryDelay"` // 重试间隔，单位秒，按重试次数递增，默认30
+}
+
+// 从shadow 集群读取成功的文件迁移回主集群的配置
+type ReadRepairConfig struct {
+	Enable   bool    `json:"enable"`
+	Rate     float64 `json:"rate"`     // 每秒最多迁移文件数，默认5
+	MaxSize  int64   `json:"maxSize"`  // 超过该大小的文件不迁移，单位字节，默认64MB
+	DedupTtl int     `json:"dedupTtl"` // 迁移成功后在该时间内不重复迁移，单位秒，默认3600
+	TempDir  string  `json:"tempDir"`  // 迁移文件临时目录，默认系统临时目录
+}
+
+// 热点文件本地磁盘缓存配置
+type DiskCacheConfig struct {
+	Enable      bool     `json:"enable"`
+	Dir         string   `json:"dir"`         // 缓存目录，默认./cache，启动时只清理目录下的*.cache 文件
+	MaxSize     int64    `json:"maxSize"`     // 缓存总大小，单位字节，默认1GB
+	MaxFileSize int64    `json:"maxFileSize"` // 单个文件最大缓存大小，单位字节，默认16MB
+	Ttl         int      `json:"ttl"`         // 缓存时间，单位秒，上游返回max-age 时以上游为准，默认300
+	Prefixes    []string `json:"prefixes"`    // 缓存的路径前缀，默认/public/
+	ServeStale  bool     `json:"serveStale"`  // 上游错误时使用过期的缓存
+}
+
+// 相同文件并发读取请求合并配置
+type CoalesceConfig struct {
+	Enable                bool  `json:"enable"`
+	MaxSize               int64 `json:"maxSize"`               // 大小未知或超过该大小的文件不缓冲也不合并，等待的请求各自获取，单位字节，默认16MB
+	MemoryCacheSize       int64 `json:"memoryCacheSize"`       // 内存缓存总大小，单位字节，0 为不使用内存缓存
+	MemoryCacheObjectSize int64 `json:"memoryCacheObjectSize"` // 小于该大小的文件保存到内存缓存，单位字节，默认64KB
+	MemoryCacheTtl        int   `json:"memoryCacheTtl"`        // 内存缓存时间，单位秒，上游返回max-age 时以上游为准，默认60
+}
+
+// 下载时按w、h、mode、q 参数缩放或裁剪图片
+type ImageResizeConfig struct {
+	Enable          bool     `json:"enable"`
+	Presets         []string `json:"presets"`         // 允许的尺寸，如"200x200"、"640x0"，0 表示按比例计算
+	Qualities       []int    `json:"qualities"`       // 允许的jpeg 质量参数q，默认60、75、85
+	MaxWidth        int      `json:"maxWidth"`        // 输出图片最大宽度，默认2048
+	MaxHeight       int      `json:"maxHeight"`       // 输出图片最大高度，默认2048
+	MaxSourceSize   int64    `json:"maxSourceSize"`   // 原图最大字节数，默认20MB
+	MaxSourcePixels int      `json:"maxSourcePixels"` // 原图最大像素数，默认40000000
+	MaxConcurrent   int      `json:"maxConcurrent"`   // 同时处理的图片数，默认为cpu 核数
+	CacheSize       int64    `json:"cacheSize"`       // 处理结果内存缓存大小，单位字节，默认64MB
+	CacheTtl        int      `json:"cacheTtl"`        // 处理结果缓存时间，单位秒，默认3600
+}
+
+// 上传图片到filer 时按路径前缀生成缩略图等衍生图片
+type DerivativesConfig struct {
+	Enable          bool             `json:"enable"`
+	MaxSourceSize   int64            `json:"maxSourceSize"`   // 超过该大小的图片不生成衍生图片，默认20MB
+	MaxSourcePixels int              `json:"maxSourcePixels"` // 原图最大像素数，默认40000000
+	Rules           []DerivativeRule `json:"rules"`
+}
+
+type DerivativeRule struct {
+	Prefix string           `json:"prefix"` // filer 路径前缀，匹配最长的前缀
+	Sizes  []DerivativeSize `json:"sizes"`
+}
+
+type DerivativeSize struct {
+	Name    string `json:"name"` // 衍生图片名称，保存为“原文件名.name.扩展名”，如car.thumb.jpg
+	Width   int    `json:"width"`
+	Height  int    `json:"height"`
+	Mode    string `json:"mode"` // fit、fill 或crop，默认fit
+	Quality int    `json:"quality"`
+}
+
+// 按文件扩展名修正下载文件的Content-Type
+type MimeTypesConfig struct {
+	Types map[string]string `json:"types"` // 扩展名 -> Content-Type，覆盖默认对应关系，值为空时取消该扩展名
+	Sniff bool              `json:"sniff"` // 上游返回application/octet-stream 等通用类型时按文件内容识别
+}
+
+// 按路径前缀设置下载文件的Content-Disposition
+type DispositionRule struct {
+	Prefix      string   `json:"prefix"`
+	Disposition string   `json:"disposition"` // inline 或attachment
+	InlineTypes []string `json:"inlineTypes"` // disposition 为attachment 时仍按inline 返回的Content-Type 前缀，如image/、application/pdf
+}
+
+// 按Accept-Encoding 压缩下载文件，只支持gzip（brotli 需要引入第三方库，暂不支持）
+type CompressionConfig struct {
+	Enable  bool     `json:"enable"`
+	Types   []string `json:"types"`   // 压缩的Content-Type 前缀，默认text/、application/json、application/javascript、application/xml、image/svg+xml
+	MinSize int64    `json:"minSize"` // 小于该大小的文件不压缩，单位字节，默认1KB
+	MaxSize int64    `json:"maxSize"` // 大于该大小的文件不压缩，单位字节，默认64MB
+	Level   int      `json:"level"`   // gzip 压缩级别1-9，默认6
+}
+
+// 签名url：白名单以外的客户端在有效期内访问私有路径
+type SignedUrlConfig struct {
+	Enable     bool              `json:"enable"`
+	Keys       map[string]string `json:"keys"`       // key id -> 密钥，更换密钥时保留旧密钥直到旧url 过期
+	CurrentKey string            `json:"currentKey"` // 签发使用的key id
+	DefaultTtl int64             `json:"defaultTtl"` // 默认有效期，单位秒，默认3600
+	MaxTtl     int64             `json:"maxTtl"`     // 最长有效期，单位秒，默认7 天
+}
+
+// 按客户端ip、Uni-Source 或路径前缀限制上传、下载带宽
+type ThrottleConfig struct {
+	Enable bool           `json:"enable"`
+	Rules  []ThrottleRule `json:"rules"`
+}
+
+/**
+ * Key 为ip 时Match 为CIDR，为uniSource 时Match 为Uni-Source 请求头的值，
+ * 为prefix 时Match 为路径前缀；
+ * 匹配的请求共用一个令牌桶，Match 为空时每个ip 或Uni-Source 单独限制。
+ */
+type ThrottleRule struct {
+	Key      string  `json:"key"` // ip、uniSource 或prefix
+	Match    string  `json:"match"`
+	Download float64 `json:"download"` // 下载速率，单位字节/秒，0 为不限制
+	Upload   float64 `json:"upload"`   // 上传速率，单位字节/秒，0 为不限制
+}
+
+// 可续传的分片上传，会话保存为Dir 下的json 文件
+type UploadSessionConfig struct {
+	Enable       bool   `json:"enable"`
+	Dir          string `json:"dir"`          // 会话目录，默认./sessions
+	ChunkSize    int64  `json:"chunkSize"`    // 默认分片大小，单位字节，默认8MB
+	MaxChunkSize int64  `json:"maxChunkSize"` // 最大分片大小，单位字节，默认64MB
+	MaxSize      int64  `json:"maxSize"`      // 文件最大大小，单位字节，默认16GB
+	Ttl          int64  `json:"ttl"`          // 会话最后一次更新后保留的时间，超时后删除已上传的分片，单位秒，默认24 小时
+	GcInterval   int64  `json:"gcInterval"`   // 清理超时会话的间隔，单位秒，默认600
+}
+
+/**
+ * 超过threshold 的上传文件由weeder 分片并行上传并生成chunks manifest；
+ * 文件大小未知时（multipart 上传）需要先读取threshold 大小的内容到内存
+ */
+type AutoChunkConfig struct {
+	Enable      bool  `json:"enable"`
+	Threshold   int64 `json:"threshold"`   // 单位字节，默认32MB
+	ChunkSize   int64 `json:"chunkSize"`   // 分片大小，单位字节，默认8MB
+	Concurrency int   `json:"concurrency"` // 单个文件同时上传的分片数，默认4
+}
+
+/**
+ * 上传校验规则，选择路径前缀最长的规则，前缀相同时指定Uni-Source 的规则优先；
+ * 违反规则时返回400、412、413 或415
+ */
+type UploadPolicy struct {
+	Prefix         string   `json:"prefix"`         // 上传路径前缀，通过/submit 上传时路径为/submit
+	UniSource      string   `json:"uniSource"`      // Uni-Source 请求头，为空时匹配所有客户端
+	MaxFileSize    int64    `json:"maxFileSize"`    // 单个文件最大大小，单位字节，0 为不限制
+	MaxRequestSize int64    `json:"maxRequestSize"` // 请求内容最大大小，单位字节，0 为不限制
+	MaxFiles       int      `json:"maxFiles"`       // 单个请求最多上传的文件数，0 为不限制
+	Extensions     []string `json:"extensions"`     // 允许的扩展名，如.jpg，为空时不限制
+	MimeTypes      []string `json:"mimeTypes"`      // 允许的Content-Type 前缀，如image/，为空时不限制
+	SniffContent   bool     `json:"sniffContent"`   // 按文件开头的内容识别类型，与扩展名或声明的类型不符时拒绝
+	WriteOnce      bool     `json:"writeOnce"`      // filer 路径已存在时拒绝上传，条件请求头也不能覆盖
+}
+
+/**
+ * 上传时计算的MD5 与SHA-256 保存到路径映射的元数据中，
+ * 获取文件时通过ETag 与Digest 响应头返回；需要配置redis 或mysql
+ */
+type FileDigestConfig struct {
+	Enable bool `json:"enable"`
+}
+
+/**
+ * 按内容去重：不超过maxSize 的文件先读取到内存计算SHA-256，
+ * 内容相同的文件使用已上传的fid，删除时引用计数为0 才删除文件；
+ * 设置了ttl 的上传不去重，需要配置redis 或mysql
+ */
+type DedupConfig struct {
+	Enable  bool  `json:"enable"`
+	MaxSize int64 `json:"maxSize"` // 单位字节，默认4MB
+}
+
+/**
+ * 从url 获取文件保存到seaweedfs：只允许获取allowHosts 中的主机（包括重定向），
+ * 避免通过weeder 访问内部服务；超过maxSize 或timeout 时失败
+ */
+type FetchConfig struct {
+	Enable       bool     `json:"enable"`
+	AllowHosts   []string `json:"allowHosts"`   // 主机名、*.子域名或ip 地址段，可以指定端口
+	MaxSize      int64    `json:"maxSize"`      // 单位字节，默认100MB
+	Timeout      int      `json:"timeout"`      // 获取并上传的总时间，单位秒，默认60
+	MaxRedirects int      `json:"maxRedirects"` // 默认5
+}
+
+/**
+ * 文件的存储位置，对应seaweedfs 申请fid 时的参数
+ */
+type Placement struct {
+	Replication string `json:"replication"`
+	Collection  string `json:"collection"`
+	DataCenter  string `json:"dataCenter"`
+	Rack        string `json:"rack"`
+	DataNode    string `json:"dataNode"`
+}
+
+/**
+ * 路径前缀对应的默认存储位置，选择前缀最长的配置，通过/submit 上传时路径为/submit
+ */
+type PlacementDefault struct {
+	Prefix string `json:"prefix"`
+	Placement
+}
+
+/**
+ * Uni-Source 允许在请求中指定的存储位置，"*" 允许任意值；
+ * uniSource 为空的配置用于其他客户端，没有匹配的配置时不允许指定
+ */
+type PlacementAllow struct {
+	UniSource    string   `json:"uniSource"`
+	Replications []string `json:"replications"`
+	Collections  []string `json:"collections"`
+	DataCenters  []string `json:"dataCenters"`
+	Racks        []string `json:"racks"`
+	DataNodes    []string `json:"dataNodes"`
+}
+
+type PlacementConfig struct {
+	Defaults []PlacementDefault `json:"defaults"`
+	Allow    []PlacementAllow   `json:"allow"`
+}
+
+/**
+ * 批量删除：一次请求最多删除maxItems 个文件，concurrency 个文件并行删除；
+ * 递归删除目录时目录下的文件超过maxDirFiles 时拒绝删除
+ */
+type BatchDeleteConfig struct {
+	MaxItems    int `json:"maxItems"`    // 默认1000
+	Concurrency int `json:"concurrency"` // 默认8
+	MaxDirFiles int `json:"maxDirFiles"` // 默认10000
+}
+
 const (
 	//stored unit types
 	Empty byte = iota
@@ -40,28 +286,48 @@ const (
 )
 
 type WeederConfig struct {
-	Ip                  string            `json:"ip"`
-	Port                int               `json:"port"`
-	Server              []Server          `json:"server"`
-	MaxIdleConnsPerHost int               `json:"maxIdleConnsPerHost"`
-	Retry               int32             `json:"retry"`
-	LogHost             string            `json:"logHost"`
-	FileUrlPrefix       string            `json:"fileUrlPrefix"`
-	Redis               RedisConfig       `json:"redis"`
-	UploadWhite         []string          `json:"uploadWhite"`
-	FilerWhite          []string          `json:"filerWhite"`
-	UniSourceCheck      bool              `json:"uniSourceCheck"`
-	Shadow              []Server          `json:"shadow"`
-	RedisCacheTtl       string            `json:"redisCacheTtl"`
-	UnkonwnUriChecker   string            `json:"unkonwnUriChecker"`
-	Mysql               mysql.MysqlConfig `json:"mysql"`
-	Qiniu               QiniuConfig       `json:"qiniu"`
-	DebugDetailLog      bool              `json:"debugDetailLog"`
-	DevEnvEnforcedTtl   string            `json:"devEnvEnforcedTtl"`
-	VolumeCheckDuration int               `json:"volumeCheckDuration"`
-	VolumeCheckUrl      string            `json:"volumeCheckUrl"`
-	VolumeCheckBaseLine int               `json:"volumeCheckBaseLine"`
-	NodeCheckBaseLine   int               `json:"nodeCheckBaseLine"`
+	Ip                  string              `json:"ip"`
+	Port                int                 `json:"port"`
+	Server              []Server            `json:"server"`
+	MaxIdleConnsPerHost int                 `json:"maxIdleConnsPerHost"`
+	Retry               int32               `json:"retry"`
+	LogHost             string              `json:"logHost"`
+	FileUrlPrefix       string              `json:"fileUrlPrefix"`
+	Redis               RedisConfig         `json:"redis"`
+	UploadWhite         []string            `json:"uploadWhite"`
+	FilerWhite          []string            `json:"filerWhite"`
+	UniSourceCheck      bool                `json:"uniSourceCheck"`
+	Shadow              []Server            `json:"shadow"`
+	RedisCacheTtl       string              `json:"redisCacheTtl"`
+	UnkonwnUriChecker   string              `json:"unkonwnUriChecker"`
+	Mysql               mysql.MysqlConfig   `json:"mysql"`
+	Qiniu               QiniuConfig         `json:"qiniu"`
+	DebugDetailLog      bool                `json:"debugDetailLog"`
+	DevEnvEnforcedTtl   string              `json:"devEnvEnforcedTtl"`
+	VolumeCheckDuration int                 `json:"volumeCheckDuration"`
+	VolumeCheckUrl      string              `json:"volumeCheckUrl"`
+	VolumeCheckBaseLine int                 `json:"volumeCheckBaseLine"`
+	NodeCheckBaseLine   int                 `json:"nodeCheckBaseLine"`
+	HedgedRead          HedgedReadConfig    `json:"hedgedRead"`
+	Mirror              MirrorConfig        `json:"mirror"`
+	ReadRepair          ReadRepairConfig    `json:"readRepair"`
+	DiskCache           DiskCacheConfig     `json:"diskCache"`
+	Coalesce            CoalesceConfig      `json:"coalesce"`
+	ImageResize         ImageResizeConfig   `json:"imageResize"`
+	Derivatives         DerivativesConfig   `json:"derivatives"`
+	MimeTypes           MimeTypesConfig     `json:"mimeTypes"`
+	Disposition         []DispositionRule   `json:"disposition"`
+	Compression         CompressionConfig   `json:"compression"`
+	SignedUrl           SignedUrlConfig     `json:"signedUrl"`
+	Throttle            ThrottleConfig      `json:"throttle"`
+	UploadSession       UploadSessionConfig `json:"uploadSession"`
+	AutoChunk           AutoChunkConfig     `json:"autoChunk"`
+	UploadPolicies      []UploadPolicy      `json:"uploadPolicies"`
+	FileDigest          FileDigestConfig    `json:"fileDigest"`
+	Dedup               DedupConfig         `json:"dedup"`
+	Fetch               FetchConfig         `json:"fetch"`
+	Placement           PlacementConfig     `json:"placement"`
+	BatchDelete         BatchDeleteConfig   `json:"batchDelete"`
 }
 
 /**
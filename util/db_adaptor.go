@@ -5,4 +5,17 @@ type DbAdaptor interface {
 	GetFileFullPath(fid string) (filepath string, err error)
 	SetPathMeta(path string, ttl string) (err error)
 	CacheFilePath(filepath string, fid string, ttl string) (err error)
+	// fid 迁移到主集群后记录新的fid
+	SetFileIdAlias(fid string, newFid string) (err error)
+	GetFileIdAlias(fid string) (newFid string, err error)
+	// 上传时计算的文件摘要，key 为filer 路径或fid
+	SetFileDigest(key string, digest string) (err error)
+	GetFileDigest(key string) (digest string, err error)
+	DeleteFileDigest(key string) (err error)
+	// 上传去重索引：sha256、fid、filer 路径到对应值的映射
+	GetDedupIndex(key string) (value string, err error)
+	SetDedupIndex(key string, value string) (err error)
+	DeleteDedupIndex(key string) (err error)
+	// 修改fid 的引用计数，返回修改后的计数，计数小于等于0 时删除
+	IncrFileRef(fid string, delta int64) (refs int64, err error)
 }
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"strings"
+	"unicode"
+)
+
+const (
+	DispositionInline     = "inline"
+	DispositionAttachment = "attachment"
+)
+
+// RFC 5987 attr-char 之外的字符需要编码
+const attrChars = "!#$&+-.^_`|~"
+
+/**
+ * 生成Content-Disposition 响应头（RFC 6266），
+ * 非ASCII 文件名同时设置filename（不支持的字符替换为“_”）
+ * 与filename*=UTF-8''...（RFC 5987），兼容不支持filename* 的浏览器。
+ */
+func ContentDisposition(dtype string, filename string) string {
+	filename = SanitizeFilename(filename)
+	if filename == "" {
+		return dtype
+	}
+	ascii := true
+	var fallback strings.Builder
+	for _, c := range filename {
+		switch {
+		case c > unicode.MaxASCII:
+			ascii = false
+			fallback.WriteByte('_')
+		case c == '"' || c == '\\':
+			fallback.WriteByte('\\')
+			fallback.WriteRune(c)
+		default:
+			fallback.WriteRune(c)
+		}
+	}
+	ret := dtype + `; filename="` + fallback.String() + `"`
+	if !ascii {
+		ret = ret + "; filename*=UTF-8''" + encodeRFC5987(filename)
+	}
+	return ret
+}
+
+// 去除文件名中的路径与控制字符
+func SanitizeFilename(filename string) string {
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+	filename = strings.Map(func(c rune) rune {
+		if unicode.IsControl(c) {
+			return -1
+		}
+		return c
+	}, filename)
+	return strings.TrimSpace(filename)
+}
+
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x80 && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
+			c >= '0' && c <= '9' || strings.IndexByte(attrChars, c) >= 0) {
+			b.WriteByte(c)
+		} else {
+			b.WriteByte('%')
+			b.WriteByte(hex[c>>4])
+			b.WriteByte(hex[c&15])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,34 @@
+package util
+
+import (
+	"testing"
+)
+
+func Test_ContentDisposition(t *testing.T) {
+	cases := []struct {
+		dtype    string
+		filename string
+		expected string
+	}{
+		{DispositionAttachment, "", "attachment"},
+		{DispositionAttachment, "report.xlsx", `attachment; filename="report.xlsx"`},
+		{DispositionInline, `a"b.txt`, `inline; filename="a\"b.txt"`},
+		{DispositionAttachment, "报表-2026-10.xlsx",
+			`attachment; filename="__-2026-10.xlsx"; filename*=UTF-8''%E6%8A%A5%E8%A1%A8-2026-10.xlsx`},
+		{DispositionAttachment, "../../etc/pass\r\nwd", `attachment; filename="passwd"`},
+		{DispositionAttachment, "a b.txt", `attachment; filename="a b.txt"`},
+	}
+	for _, c := range cases {
+		if cd := ContentDisposition(c.dtype, c.filename); cd != c.expected {
+			t.Error("Test_ContentDisposition: ", c.filename, " -> ", cd)
+		}
+	}
+}
+
+func Test_ContentDispositionRoundTrip(t *testing.T) {
+	filename := "季度 报表（终版）.xlsx"
+	cd := ContentDisposition(DispositionAttachment, filename)
+	if parsed := DispositionFilename(cd); parsed != filename {
+		t.Error("Test_ContentDispositionRoundTrip: ", cd, " -> ", parsed)
+	}
+}
@@ -0,0 +1,140 @@
+package util
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"strings"
+)
+
+var ErrDigestInvalid = errors.New("invalid digest")
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+/**
+ * 文件内容的摘要，保存为十六进制字符串
+ */
+type FileDigest struct {
+	Md5    string
+	Sha256 string
+}
+
+/**
+ * 读取上传内容的同时计算MD5 与SHA-256
+ */
+type Digester struct {
+	md5    hash.Hash
+	sha256 hash.Hash
+}
+
+func NewDigester() *Digester {
+	return &Digester{md5: md5.New(), sha256: sha256.New()}
+}
+
+func (d *Digester) Write(p []byte) (int, error) {
+	d.md5.Write(p)
+	d.sha256.Write(p)
+	return len(p), nil
+}
+
+func (d *Digester) Sum() *FileDigest {
+	return &FileDigest{
+		Md5:    hex.EncodeToString(d.md5.Sum(nil)),
+		Sha256: hex.EncodeToString(d.sha256.Sum(nil)),
+	}
+}
+
+/**
+ * 解析客户端提供的摘要：Content-MD5 请求头（base64），
+ * 以及Digest 请求头（RFC 3230，如md5=..., sha-256=...），不支持的算法忽略；
+ * 都未提供时返回nil
+ */
+func ParseExpectedDigest(contentMd5 string, digest string) (*FileDigest, error) {
+	expected := &FileDigest{}
+	var err error
+	if contentMd5 = strings.TrimSpace(contentMd5); contentMd5 != "" {
+		if expected.Md5, err = decodeDigest(contentMd5, md5.Size); err != nil {
+			return nil, err
+		}
+	}
+	for _, item := range strings.Split(digest, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.Index(item, "=")
+		if i <= 0 {
+			return nil, ErrDigestInvalid
+		}
+		var value string
+		switch strings.ToLower(item[:i]) {
+		case "md5":
+			if value, err = decodeDigest(item[i+1:], md5.Size); err != nil {
+				return nil, err
+			}
+			if expected.Md5 != "" && expected.Md5 != value {
+				return nil, ErrDigestMismatch
+			}
+			expected.Md5 = value
+		case "sha-256":
+			if value, err = decodeDigest(item[i+1:], sha256.Size); err != nil {
+				return nil, err
+			}
+			expected.Sha256 = value
+		}
+	}
+	if expected.Md5 == "" && expected.Sha256 == "" {
+		return nil, nil
+	}
+	return expected, nil
+}
+
+func decodeDigest(value string, size int) (string, error) {
+	bs, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+	if err != nil || len(bs) != size {
+		return "", ErrDigestInvalid
+	}
+	return hex.EncodeToString(bs), nil
+}
+
+/**
+ * 比较客户端提供的摘要，未提供的算法不比较
+ */
+func (d *FileDigest) Verify(actual *FileDigest) error {
+	if (d.Md5 != "" && d.Md5 != actual.Md5) ||
+		(d.Sha256 != "" && d.Sha256 != actual.Sha256) {
+		return ErrDigestMismatch
+	}
+	return nil
+}
+
+// 保存到元数据的格式 md5:sha256
+func (d *FileDigest) String() string {
+	return d.Md5 + ":" + d.Sha256
+}
+
+func ParseFileDigest(s string) (*FileDigest, error) {
+	i := strings.Index(s, ":")
+	if i < 0 {
+		return nil, ErrDigestInvalid
+	}
+	d := &FileDigest{Md5: s[:i], Sha256: s[i+1:]}
+	if len(d.Md5) != md5.Size*2 || len(d.Sha256) != sha256.Size*2 {
+		return nil, ErrDigestInvalid
+	}
+	return d, nil
+}
+
+func (d *FileDigest) ETag() string {
+	return `"` + d.Md5 + `"`
+}
+
+// Digest 响应头，格式与请求头相同
+func (d *FileDigest) DigestHeader() string {
+	m, _ := hex.DecodeString(d.Md5)
+	s, _ := hex.DecodeString(d.Sha256)
+	return "md5=" + base64.StdEncoding.EncodeToString(m) +
+		",sha-256=" + base64.StdEncoding.EncodeToString(s)
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+const (
+	helloMd5    = "5d41402abc4b2a76b9719d911017c592"
+	helloSha256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+)
+
+func Test_Digester(t *testing.T) {
+	d := NewDigester()
+	io.Copy(d, strings.NewReader("hello"))
+	sum := d.Sum()
+	if sum.Md5 != helloMd5 || sum.Sha256 != helloSha256 {
+		t.Error("Test_Digester: ", sum)
+	}
+	parsed, err := ParseFileDigest(sum.String())
+	if err != nil || *parsed != *sum {
+		t.Error("Test_Digester: parse ", sum.String(), " ", err)
+	}
+	if sum.ETag() != `"`+helloMd5+`"` {
+		t.Error("Test_Digester: etag ", sum.ETag())
+	}
+	expected, err := ParseExpectedDigest("", sum.DigestHeader())
+	if err != nil || expected.Verify(sum) != nil {
+		t.Error("Test_Digester: digest header ", sum.DigestHeader(), " ", err)
+	}
+	if _, err = ParseFileDigest("abc:def"); err != ErrDigestInvalid {
+		t.Error("Test_Digester: invalid digest should fail")
+	}
+}
+
+func Test_ParseExpectedDigest(t *testing.T) {
+	sum := &FileDigest{Md5: helloMd5, Sha256: helloSha256}
+	md5Base64 := "XUFAKrxLKna5cZ2REBfFkg=="
+	sha256Base64 := "LPJNul+wow4m6DsqxbninhsWHlwfp0JecwQzYpOLmCQ="
+	cases := []struct {
+		contentMd5 string
+		digest     string
+		err        error
+		matches    bool
+	}{
+		{md5Base64, "", nil, true},
+		{"", "SHA-256=" + sha256Base64, nil, true},
+		{"", "sha-512=abc, md5=" + md5Base64, nil, true},
+		{md5Base64, "md5=" + md5Base64 + ",sha-256=" + sha256Base64, nil, true},
+		{"", "sha-256=" + md5Base64, ErrDigestInvalid, false},
+		{"not base64", "", ErrDigestInvalid, false},
+		{"", "md5", ErrDigestInvalid, false},
+		{"1B2M2Y8AsgTpgAmY7PhCfg==", "", nil, false},
+		{"1B2M2Y8AsgTpgAmY7PhCfg==", "md5=" + md5Base64, ErrDigestMismatch, false},
+	}
+	for _, c := range cases {
+		expected, err := ParseExpectedDigest(c.contentMd5, c.digest)
+		if err != c.err {
+			t.Error("Test_ParseExpectedDigest: ", c.contentMd5, " ", c.digest, " ", err)
+			continue
+		}
+		if err == nil && (expected.Verify(sum) == nil) != c.matches {
+			t.Error("Test_ParseExpectedDigest: verify ", c.contentMd5, " ", c.digest)
+		}
+	}
+	if expected, err := ParseExpectedDigest("", "sha-512=abc"); expected != nil || err != nil {
+		t.Error("Test_ParseExpectedDigest: unsupported algorithms should be ignored")
+	}
+}
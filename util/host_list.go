@@ -0,0 +1,49 @@
+package util
+
+import (
+	"net"
+	"strings"
+)
+
+/**
+ * 判断host（可以包含端口）是否在列表中，列表为空时不允许任何主机：
+ *	files.example.com       主机名，不限端口
+ *	files.example.com:8080  主机名与端口
+ *	*.example.com           所有子域名，不包括example.com
+ *	10.0.0.0/8              ip 地址段，只匹配ip 形式的host
+ */
+func MatchHost(patterns []string, host string) bool {
+	hostname, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		hostname, port = h, p
+	}
+	hostname = strings.ToLower(strings.TrimSuffix(hostname, "."))
+	if hostname == "" {
+		return false
+	}
+	ip := net.ParseIP(hostname)
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if strings.Contains(pattern, "/") {
+			if _, network, err := net.ParseCIDR(pattern); err == nil &&
+				ip != nil && network.Contains(ip) {
+				return true
+			}
+			continue
+		}
+		if h, p, err := net.SplitHostPort(pattern); err == nil {
+			if p != port {
+				continue
+			}
+			pattern = h
+		}
+		if strings.HasPrefix(pattern, "*.") {
+			if ip == nil && strings.HasSuffix(hostname, pattern[1:]) {
+				return true
+			}
+		} else if pattern == hostname {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package util
+
+import (
+	"testing"
+)
+
+func Test_MatchHost(t *testing.T) {
+	patterns := []string{
+		"files.example.com",
+		"cdn.example.com:8080",
+		"*.corp.example.com",
+		"10.1.0.0/16",
+		"[::1]:9000",
+	}
+	for host, expected := range map[string]bool{
+		"files.example.com":      true,
+		"FILES.example.com:443":  true,
+		"cdn.example.com:8080":   true,
+		"cdn.example.com":        false,
+		"a.corp.example.com":     true,
+		"a.b.corp.example.com:8": true,
+		"corp.example.com":       false,
+		"evilcorp.example.com":   false,
+		"10.1.2.3":               true,
+		"10.1.2.3:8080":          true,
+		"10.2.0.1":               false,
+		"[::1]:9000":             true,
+		"[::1]:9001":             false,
+		"example.com":            false,
+		"":                       false,
+	} {
+		if MatchHost(patterns, host) != expected {
+			t.Error("Test_MatchHost: ", host, " expected ", expected)
+		}
+	}
+	if MatchHost(nil, "files.example.com") {
+		t.Error("Test_MatchHost: empty list should not allow any host")
+	}
+}
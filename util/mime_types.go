@@ -0,0 +1,85 @@
+package util
+
+import (
+	"mime"
+	"path"
+	"strings"
+)
+
+/**
+ * 默认的扩展名与Content-Type 对应关系，可通过配置覆盖或增加。
+ * 部分文件上传时的Content-Type 不正确（如某种excel 生成sdk 生成的xls 文件
+ * 实际为zip 压缩文件），ie 8 下载时会按Content-Type 修改文件扩展名，
+ * 因此按扩展名强制设置Content-Type。
+ */
+var DefaultMimeTypes = map[string]string{
+	".xls":  "application/vnd.ms-excel",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".csv":  "text/csv",
+	".doc":  "application/msword",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".apk":  "application/vnd.android.package-archive",
+	".ipa":  "application/octet-stream",
+}
+
+// 需要按内容识别的通用类型
+var genericMimeTypes = map[string]bool{
+	"":                         true,
+	"application/octet-stream": true,
+	"binary/octet-stream":      true,
+	"application/x-download":   true,
+	"application/unknown":      true,
+}
+
+type MimeTypes struct {
+	types map[string]string
+}
+
+// overrides 覆盖默认对应关系，Content-Type 为空时删除该扩展名
+func NewMimeTypes(overrides map[string]string) *MimeTypes {
+	m := &MimeTypes{types: make(map[string]string)}
+	for ext, mtype := range DefaultMimeTypes {
+		m.types[ext] = mtype
+	}
+	for ext, mtype := range overrides {
+		ext = strings.ToLower(ext)
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if mtype == "" {
+			delete(m.types, ext)
+		} else {
+			m.types[ext] = mtype
+		}
+	}
+	return m
+}
+
+// 按文件名扩展名返回Content-Type，没有对应关系时返回空字符串
+func (m *MimeTypes) ByFilename(filename string) string {
+	return m.types[strings.ToLower(path.Ext(filename))]
+}
+
+/**
+ * 解析Content-Disposition 中的文件名，支持filename*（RFC 5987）编码的文件名
+ */
+func DispositionFilename(cd string) string {
+	if cd == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(cd)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(params["filename"])
+}
+
+// 是否是需要按内容识别的通用类型
+func IsGenericMimeType(mtype string) bool {
+	if mediaType, _, err := mime.ParseMediaType(mtype); err == nil {
+		mtype = mediaType
+	}
+	return genericMimeTypes[strings.ToLower(strings.TrimSpace(mtype))]
+}
@@ -0,0 +1,52 @@
+package util
+
+import (
+	"testing"
+)
+
+func Test_DispositionFilename(t *testing.T) {
+	cases := map[string]string{
+		`attachment; filename="report.xls"`:                     "report.xls",
+		`inline; filename=data.CSV`:                             "data.CSV",
+		`attachment; filename*=UTF-8''%E6%8A%A5%E8%A1%A8.xlsx`:  "报表.xlsx",
+		`attachment; filename="a.xls"; filename*=UTF-8''b.docx`: "b.docx",
+		``:                        "",
+		`attachment; filename="a`: "",
+	}
+	for cd, expected := range cases {
+		if filename := DispositionFilename(cd); filename != expected {
+			t.Error("Test_DispositionFilename: ", cd, " -> ", filename)
+		}
+	}
+}
+
+func Test_MimeTypes(t *testing.T) {
+	m := NewMimeTypes(map[string]string{
+		"XLS":  "application/x-excel",
+		".csv": "",
+		".key": "application/vnd.apple.keynote",
+	})
+	cases := map[string]string{
+		"/a/report.XLS":   "application/x-excel",
+		"b.xlsx":          DefaultMimeTypes[".xlsx"],
+		"data.csv":        "",
+		"slides.key":      "application/vnd.apple.keynote",
+		"/3,01637037d6":   "",
+		"app-release.apk": "application/vnd.android.package-archive",
+	}
+	for filename, expected := range cases {
+		if mtype := m.ByFilename(filename); mtype != expected {
+			t.Error("Test_MimeTypes: ", filename, " -> ", mtype)
+		}
+	}
+}
+
+func Test_IsGenericMimeType(t *testing.T) {
+	if !IsGenericMimeType("application/octet-stream; charset=binary") ||
+		!IsGenericMimeType("") {
+		t.Error("Test_IsGenericMimeType: generic")
+	}
+	if IsGenericMimeType("image/png") {
+		t.Error("Test_IsGenericMimeType: image/png")
+	}
+}
@@ -126,6 +126,130 @@ func (m *MysqlClient) CacheFilePath(
 	return
 }
 
+func (m *MysqlClient) SetFileIdAlias(fid string, newFid string) (err error) {
+	sqlStatement := "INSERT INTO filer_fid_alias (fid,newFid,createTime) VALUES(?,?,?)"
+	var rows int64
+	rows, err = m.Insert(sqlStatement, fid, newFid, time.Now().Unix())
+	if err == nil {
+		return
+	}
+	log.ErrorS("mysql", "set fid alias insert error: ", err.Error(),
+		" affected rows: ", rows)
+	sqlStatement = "UPDATE filer_fid_alias SET newFid=?, updateTime=? WHERE fid=?"
+	rows, err = m.Update(sqlStatement, newFid, time.Now().Unix(), fid)
+	if err != nil {
+		log.ErrorS("mysql", "set fid alias update error: ", err.Error(),
+			" affected rows: ", rows)
+	}
+	return
+}
+
+func (m *MysqlClient) GetFileIdAlias(fid string) (newFid string, err error) {
+	sqlStatement := "SELECT newFid FROM filer_fid_alias WHERE fid=?"
+	newFid, err = m.Query(sqlStatement, fid)
+	if err != nil {
+		err = errors.New("fid alias not found")
+	}
+	return
+}
+
+func (m *MysqlClient) SetFileDigest(key string, digest string) (err error) {
+	sqlStatement := "INSERT INTO filer_file_digest (fileKey,digest,createTime) VALUES(?,?,?)"
+	var rows int64
+	rows, err = m.Insert(sqlStatement, key, digest, time.Now().Unix())
+	if err == nil {
+		return
+	}
+	log.ErrorS("mysql", "set file digest insert error: ", err.Error(),
+		" affected rows: ", rows)
+	sqlStatement = "UPDATE filer_file_digest SET digest=?, updateTime=? WHERE fileKey=?"
+	rows, err = m.Update(sqlStatement, digest, time.Now().Unix(), key)
+	if err != nil {
+		log.ErrorS("mysql", "set file digest update error: ", err.Error(),
+			" affected rows: ", rows)
+	}
+	return
+}
+
+func (m *MysqlClient) GetFileDigest(key string) (digest string, err error) {
+	sqlStatement := "SELECT digest FROM filer_file_digest WHERE fileKey=?"
+	digest, err = m.Query(sqlStatement, key)
+	if err != nil {
+		err = errors.New("digest not found")
+	}
+	return
+}
+
+func (m *MysqlClient) DeleteFileDigest(key string) (err error) {
+	sqlStatement := "DELETE FROM filer_file_digest WHERE fileKey=?"
+	_, err = m.Update(sqlStatement, key)
+	return
+}
+
+func (m *MysqlClient) GetDedupIndex(key string) (value string, err error) {
+	sqlStatement := "SELECT value FROM filer_dedup_index WHERE indexKey=?"
+	value, err = m.Query(sqlStatement, key)
+	if err != nil {
+		err = errors.New("dedup index not found")
+	}
+	return
+}
+
+func (m *MysqlClient) SetDedupIndex(key string, value string) (err error) {
+	sqlStatement := "INSERT INTO filer_dedup_index (indexKey,value,createTime) VALUES(?,?,?)"
+	var rows int64
+	rows, err = m.Insert(sqlStatement, key, value, time.Now().Unix())
+	if err == nil {
+		return
+	}
+	log.ErrorS("mysql", "set dedup index insert error: ", err.Error(),
+		" affected rows: ", rows)
+	sqlStatement = "UPDATE filer_dedup_index SET value=?, updateTime=? WHERE indexKey=?"
+	rows, err = m.Update(sqlStatement, value, time.Now().Unix(), key)
+	if err != nil {
+		log.ErrorS("mysql", "set dedup index update error: ", err.Error(),
+			" affected rows: ", rows)
+	}
+	return
+}
+
+func (m *MysqlClient) DeleteDedupIndex(key string) (err error) {
+	sqlStatement := "DELETE FROM filer_dedup_index WHERE indexKey=?"
+	_, err = m.Update(sqlStatement, key)
+	return
+}
+
+func (m *MysqlClient) IncrFileRef(fid string, delta int64) (refs int64, err error) {
+	// 在一个事务中修改并读取计数，避免并发上传与删除时计数错误
+	var tx *sql.Tx
+	tx, err = m.Client.Begin()
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	_, err = tx.Exec("INSERT INTO filer_file_ref (fid,refs,updateTime) VALUES(?,?,?) "+
+		"ON DUPLICATE KEY UPDATE refs=refs+VALUES(refs), updateTime=VALUES(updateTime)",
+		fid, delta, time.Now().Unix())
+	if err != nil {
+		return
+	}
+	err = tx.QueryRow("SELECT refs FROM filer_file_ref WHERE fid=?", fid).Scan(&refs)
+	if err != nil {
+		return
+	}
+	if refs <= 0 {
+		if _, err = tx.Exec("DELETE FROM filer_file_ref WHERE fid=?", fid); err != nil {
+			return
+		}
+	}
+	err = tx.Commit()
+	return
+}
+
 func (m *MysqlClient) Query(sqlStatement string, value string) (string, error) {
 	row := m.Client.QueryRow(sqlStatement, value)
 	var result string
@@ -0,0 +1,123 @@
+package util
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// 请求参数名与Placement 字段的对应，同时用于seaweedfs 的上传与申请fid 参数
+var placementParams = []string{"replication", "collection", "dataCenter", "rack", "dataNode"}
+
+func (p *Placement) fields() []*string {
+	return []*string{&p.Replication, &p.Collection, &p.DataCenter, &p.Rack, &p.DataNode}
+}
+
+func (a *PlacementAllow) lists() [][]string {
+	return [][]string{a.Replications, a.Collections, a.DataCenters, a.Racks, a.DataNodes}
+}
+
+// 读取请求中的存储位置参数
+func PlacementFromValues(values url.Values) Placement {
+	var p Placement
+	for i, field := range p.fields() {
+		*field = strings.TrimSpace(values.Get(placementParams[i]))
+	}
+	return p
+}
+
+// 是否是存储位置参数
+func IsPlacementParam(name string) bool {
+	for _, v := range placementParams {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 将不为空的存储位置添加到seaweedfs 请求参数
+func (p *Placement) AddTo(values url.Values) {
+	for i, field := range p.fields() {
+		if *field != "" {
+			values.Set(placementParams[i], *field)
+		}
+	}
+}
+
+func (p *Placement) IsEmpty() bool {
+	return *p == Placement{}
+}
+
+// 使用o 中不为空的值覆盖
+func (p *Placement) Override(o *Placement) {
+	fields := p.fields()
+	for i, field := range o.fields() {
+		if *field != "" {
+			*fields[i] = *field
+		}
+	}
+}
+
+/**
+ * 选择路径前缀最长的默认存储位置，没有匹配的配置时返回空的存储位置
+ */
+func MatchPlacementDefault(defaults []PlacementDefault, path string) Placement {
+	var matched *PlacementDefault
+	for i := range defaults {
+		d := &defaults[i]
+		if strings.HasPrefix(path, d.Prefix) &&
+			(matched == nil || len(d.Prefix) > len(matched.Prefix)) {
+			matched = d
+		}
+	}
+	if matched == nil {
+		return Placement{}
+	}
+	return matched.Placement
+}
+
+/**
+ * 选择Uni-Source 对应的配置，没有时使用uniSource 为空的配置
+ */
+func MatchPlacementAllow(allows []PlacementAllow, uniSource string) *PlacementAllow {
+	var matched *PlacementAllow
+	for i := range allows {
+		a := &allows[i]
+		if a.UniSource == uniSource && uniSource != "" {
+			return a
+		}
+		if a.UniSource == "" && matched == nil {
+			matched = a
+		}
+	}
+	return matched
+}
+
+/**
+ * 检查请求指定的存储位置是否允许，a 为nil 时不允许指定任何值
+ */
+func (a *PlacementAllow) Check(p *Placement) error {
+	var lists [][]string
+	if a != nil {
+		lists = a.lists()
+	}
+	for i, field := range p.fields() {
+		if *field == "" {
+			continue
+		}
+		if lists == nil || !containsOrAny(lists[i], *field) {
+			return fmt.Errorf("%s %s is not allowed!", placementParams[i], *field)
+		}
+	}
+	return nil
+}
+
+func containsOrAny(list []string, value string) bool {
+	for _, v := range list {
+		if v == "*" || v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,76 @@
+package util
+
+import (
+	"net/url"
+	"testing"
+)
+
+func Test_MatchPlacementDefault(t *testing.T) {
+	defaults := []PlacementDefault{
+		{Prefix: "/", Placement: Placement{Replication: "000"}},
+		{Prefix: "/app/", Placement: Placement{Replication: "001", Collection: "app"}},
+		{Prefix: "/app/video/", Placement: Placement{Collection: "video"}},
+	}
+	cases := []struct {
+		path     string
+		expected Placement
+	}{
+		{"/app/a.jpg", Placement{Replication: "001", Collection: "app"}},
+		{"/app/video/a.mp4", Placement{Collection: "video"}},
+		{"/submit", Placement{Replication: "000"}},
+	}
+	for _, c := range cases {
+		if p := MatchPlacementDefault(defaults, c.path); p != c.expected {
+			t.Error("Test_MatchPlacementDefault: ", c.path, " -> ", p)
+		}
+	}
+	if p := MatchPlacementDefault(defaults[1:], "/other/a.jpg"); !p.IsEmpty() {
+		t.Error("Test_MatchPlacementDefault: /other/a.jpg should not match")
+	}
+}
+
+func Test_PlacementAllow(t *testing.T) {
+	allows := []PlacementAllow{
+		{Replications: []string{"000", "001"}},
+		{UniSource: "admin", Replications: []string{"*"}, Collections: []string{"*"},
+			DataCenters: []string{"dc1"}},
+	}
+	cases := []struct {
+		uniSource string
+		values    string
+		allowed   bool
+	}{
+		{"", "replication=001", true},
+		{"web", "replication=010", false},
+		{"web", "collection=app", false},
+		{"admin", "replication=200&collection=app&dataCenter=dc1", true},
+		{"admin", "dataCenter=dc2", false},
+		{"admin", "rack=r1", false},
+		{"web", "", true},
+	}
+	for _, c := range cases {
+		values, _ := url.ParseQuery(c.values)
+		p := PlacementFromValues(values)
+		err := MatchPlacementAllow(allows, c.uniSource).Check(&p)
+		if (err == nil) != c.allowed {
+			t.Error("Test_PlacementAllow: ", c.uniSource, " ", c.values, " ", err)
+		}
+	}
+	p := Placement{DataNode: "n1"}
+	if MatchPlacementAllow(nil, "web").Check(&p) == nil {
+		t.Error("Test_PlacementAllow: nothing should be allowed without config")
+	}
+}
+
+func Test_PlacementOverride(t *testing.T) {
+	p := Placement{Replication: "001", Collection: "app"}
+	p.Override(&Placement{Collection: "logo", Rack: "r1"})
+	if p != (Placement{Replication: "001", Collection: "logo", Rack: "r1"}) {
+		t.Error("Test_PlacementOverride: ", p)
+	}
+	values := make(url.Values)
+	p.AddTo(values)
+	if values.Encode() != "collection=logo&rack=r1&replication=001" {
+		t.Error("Test_PlacementOverride: ", values.Encode())
+	}
+}
@@ -49,6 +49,58 @@ func (r *RedisClient) SetPathMeta(path string, meta string) (err error) {
 	return r.Client.HSet("weed-meta", path, meta).Err()
 }
 
+func (r *RedisClient) SetFileIdAlias(fid string, newFid string) (err error) {
+	return r.Client.HSet("weed-fid-alias", fid, newFid).Err()
+}
+
+func (r *RedisClient) GetFileIdAlias(fid string) (newFid string, err error) {
+	newFid, err = r.Client.HGet("weed-fid-alias", fid).Result()
+	if err == redis.Nil {
+		err = errors.New("fid alias not found")
+	}
+	return
+}
+
+func (r *RedisClient) SetFileDigest(key string, digest string) (err error) {
+	return r.Client.HSet("weed-digest", key, digest).Err()
+}
+
+func (r *RedisClient) GetFileDigest(key string) (digest string, err error) {
+	digest, err = r.Client.HGet("weed-digest", key).Result()
+	if err == redis.Nil {
+		err = errors.New("digest not found")
+	}
+	return
+}
+
+func (r *RedisClient) DeleteFileDigest(key string) (err error) {
+	return r.Client.HDel("weed-digest", key).Err()
+}
+
+func (r *RedisClient) GetDedupIndex(key string) (value string, err error) {
+	value, err = r.Client.HGet("weed-dedup", key).Result()
+	if err == redis.Nil {
+		err = errors.New("dedup index not found")
+	}
+	return
+}
+
+func (r *RedisClient) SetDedupIndex(key string, value string) (err error) {
+	return r.Client.HSet("weed-dedup", key, value).Err()
+}
+
+func (r *RedisClient) DeleteDedupIndex(key string) (err error) {
+	return r.Client.HDel("weed-dedup", key).Err()
+}
+
+func (r *RedisClient) IncrFileRef(fid string, delta int64) (refs int64, err error) {
+	refs, err = r.Client.HIncrBy("weed-file-ref", fid, delta).Result()
+	if err == nil && refs <= 0 {
+		err = r.Client.HDel("weed-file-ref", fid).Err()
+	}
+	return
+}
+
 func (r *RedisClient) CacheFilePath(filepath string, fid string, ttl string) (err error) {
 	ttlDuration, e := util.ParseTtlDuration(ttl)
 	if e != nil {
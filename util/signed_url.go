@@ -0,0 +1,102 @@
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrSignatureInvalid = errors.New("invalid signature")
+var ErrSignatureExpired = errors.New("signature expired")
+var ErrSignatureKey = errors.New("unknown signature key")
+
+// 签名url 使用的查询参数
+var SignedUrlParams = []string{"expires", "kid", "ip", "method", "sig"}
+
+/**
+ * 使用HMAC-SHA256 签发与校验有效期内的url：
+ * 签名内容包括路径、过期时间，以及可选的客户端ip 与请求方法；
+ * kid 指定密钥，更换密钥时旧密钥签发的url 在保留旧密钥期间仍然有效。
+ */
+type UrlSigner struct {
+	keys    map[string][]byte
+	current string
+}
+
+func NewUrlSigner(keys map[string]string, current string) (*UrlSigner, error) {
+	s := &UrlSigner{
+		keys:    make(map[string][]byte, len(keys)),
+		current: current,
+	}
+	for kid, key := range keys {
+		if key == "" {
+			return nil, errors.New("empty signature key: " + kid)
+		}
+		s.keys[kid] = []byte(key)
+	}
+	if _, ok := s.keys[current]; !ok {
+		return nil, ErrSignatureKey
+	}
+	return s, nil
+}
+
+// 返回签名参数，ip 与method 为空时不限制
+func (s *UrlSigner) Sign(path string, expires time.Time, ip string,
+	method string) url.Values {
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("kid", s.current)
+	if ip != "" {
+		query.Set("ip", ip)
+	}
+	method = strings.ToUpper(method)
+	if method != "" {
+		query.Set("method", method)
+	}
+	query.Set("sig", s.signature(s.keys[s.current], s.current, path,
+		query.Get("expires"), ip, method))
+	return query
+}
+
+// 校验签名，HEAD 请求可以使用GET 的签名
+func (s *UrlSigner) Verify(path string, query url.Values, ip string,
+	method string, now time.Time) error {
+	kid := query.Get("kid")
+	key, ok := s.keys[kid]
+	if !ok {
+		return ErrSignatureKey
+	}
+	expires := query.Get("expires")
+	sig := s.signature(key, kid, path, expires, query.Get("ip"), query.Get("method"))
+	if !hmac.Equal([]byte(sig), []byte(query.Get("sig"))) {
+		return ErrSignatureInvalid
+	}
+	t, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrSignatureInvalid
+	}
+	if now.Unix() > t {
+		return ErrSignatureExpired
+	}
+	if v := query.Get("ip"); v != "" && v != ip {
+		return ErrSignatureInvalid
+	}
+	method = strings.ToUpper(method)
+	if v := query.Get("method"); v != "" && v != method &&
+		!(v == "GET" && method == "HEAD") {
+		return ErrSignatureInvalid
+	}
+	return nil
+}
+
+func (s *UrlSigner) signature(key []byte, kid string, path string,
+	expires string, ip string, method string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join([]string{kid, path, expires, ip, method}, "\n")))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,70 @@
+package util
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func Test_UrlSigner(t *testing.T) {
+	now := time.Now()
+	old, err := NewUrlSigner(map[string]string{"k1": "secret1"}, "k1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	s, err := NewUrlSigner(map[string]string{"k1": "secret1", "k2": "secret2"}, "k2")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	query := s.Sign("/app/a.pdf", now.Add(time.Minute), "", "")
+	if query.Get("kid") != "k2" {
+		t.Error("Test_UrlSigner: kid ", query.Get("kid"))
+	}
+	if err := s.Verify("/app/a.pdf", query, "1.2.3.4", "GET", now); err != nil {
+		t.Error("Test_UrlSigner: ", err.Error())
+	}
+	if err := s.Verify("/app/b.pdf", query, "1.2.3.4", "GET", now); err != ErrSignatureInvalid {
+		t.Error("Test_UrlSigner: other path ", err)
+	}
+	if err := s.Verify("/app/a.pdf", query, "", "GET",
+		now.Add(2*time.Minute)); err != ErrSignatureExpired {
+		t.Error("Test_UrlSigner: expired ", err)
+	}
+
+	// 旧密钥签发的url 仍然有效
+	query = old.Sign("/app/a.pdf", now.Add(time.Minute), "", "")
+	if err := s.Verify("/app/a.pdf", query, "", "GET", now); err != nil {
+		t.Error("Test_UrlSigner: rotated ", err.Error())
+	}
+	query.Set("kid", "k3")
+	if err := s.Verify("/app/a.pdf", query, "", "GET", now); err != ErrSignatureKey {
+		t.Error("Test_UrlSigner: unknown key ", err)
+	}
+}
+
+func Test_UrlSignerBinding(t *testing.T) {
+	now := time.Now()
+	s, _ := NewUrlSigner(map[string]string{"k1": "secret1"}, "k1")
+	query := s.Sign("/app/a.pdf", now.Add(time.Minute), "1.2.3.4", "get")
+	if err := s.Verify("/app/a.pdf", query, "1.2.3.4", "HEAD", now); err != nil {
+		t.Error("Test_UrlSignerBinding: ", err.Error())
+	}
+	if err := s.Verify("/app/a.pdf", query, "5.6.7.8", "GET", now); err != ErrSignatureInvalid {
+		t.Error("Test_UrlSignerBinding: ip ", err)
+	}
+	if err := s.Verify("/app/a.pdf", query, "1.2.3.4", "DELETE", now); err != ErrSignatureInvalid {
+		t.Error("Test_UrlSignerBinding: method ", err)
+	}
+	// 修改参数后签名无效
+	tampered, _ := url.ParseQuery(query.Encode())
+	tampered.Set("ip", "5.6.7.8")
+	if err := s.Verify("/app/a.pdf", tampered, "5.6.7.8", "GET", now); err != ErrSignatureInvalid {
+		t.Error("Test_UrlSignerBinding: tampered ", err)
+	}
+	tampered, _ = url.ParseQuery(query.Encode())
+	tampered.Set("expires", "99999999999")
+	if err := s.Verify("/app/a.pdf", tampered, "1.2.3.4", "GET", now); err != ErrSignatureInvalid {
+		t.Error("Test_UrlSignerBinding: expires ", err)
+	}
+}
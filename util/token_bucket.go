@@ -0,0 +1,71 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+/**
+ * 令牌桶限流，rate 为每秒产生的令牌数，burst 为桶容量
+ */
+type TokenBucket struct {
+	sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst float64) *TokenBucket {
+	if burst < rate {
+		burst = rate
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// 桶中令牌足够时取出n 个令牌并返回true，否则返回false
+func (b *TokenBucket) Allow(n float64) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(time.Now())
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// 取出n 个令牌，令牌不足时允许透支，返回需要等待的时间；
+// 并发调用按调用顺序依次等待，总速率不超过rate
+func (b *TokenBucket) Reserve(n float64) time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(time.Now())
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// 取出n 个令牌，令牌不足时等待，返回等待的时间
+func (b *TokenBucket) Wait(n float64) time.Duration {
+	d := b.Reserve(n)
+	if d > 0 {
+		time.Sleep(d)
+	}
+	return d
+}
@@ -0,0 +1,52 @@
+package util
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_TokenBucketAllow(t *testing.T) {
+	b := NewTokenBucket(10, 2)
+	if b.burst != 10 {
+		t.Error("Test_TokenBucketAllow burst: ", b.burst)
+	}
+	for i := 0; i < 10; i++ {
+		if !b.Allow(1) {
+			t.Error("Test_TokenBucketAllow: denied ", i)
+		}
+	}
+	if b.Allow(1) {
+		t.Error("Test_TokenBucketAllow: bucket should be empty")
+	}
+	b.last = b.last.Add(-200 * time.Millisecond)
+	if !b.Allow(2) {
+		t.Error("Test_TokenBucketAllow: refill failed")
+	}
+}
+
+func Test_TokenBucketReserve(t *testing.T) {
+	b := NewTokenBucket(100, 100)
+	if d := b.Reserve(100); d != 0 {
+		t.Error("Test_TokenBucketReserve: ", d)
+	}
+	// 透支的令牌按rate 计算等待时间
+	if d := b.Reserve(50); d < 450*time.Millisecond || d > 500*time.Millisecond {
+		t.Error("Test_TokenBucketReserve: ", d)
+	}
+	if d := b.Reserve(50); d < 950*time.Millisecond || d > time.Second {
+		t.Error("Test_TokenBucketReserve: ", d)
+	}
+	if b.Allow(1) {
+		t.Error("Test_TokenBucketReserve: bucket should be overdrawn")
+	}
+}
+
+func Test_TokenBucketWait(t *testing.T) {
+	b := NewTokenBucket(1000, 1000)
+	b.Wait(1000)
+	start := time.Now()
+	b.Wait(50)
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Error("Test_TokenBucketWait: ", d)
+	}
+}
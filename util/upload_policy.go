@@ -0,0 +1,145 @@
+package util
+
+import (
+	"mime"
+	"path"
+	"strings"
+)
+
+// 同一类型的不同写法，比较前统一
+var contentTypeAliases = map[string]string{
+	"image/jpg":                    "image/jpeg",
+	"image/pjpeg":                  "image/jpeg",
+	"image/x-icon":                 "image/vnd.microsoft.icon",
+	"application/x-gzip":           "application/gzip",
+	"application/x-zip-compressed": "application/zip",
+	"application/x-pdf":            "application/pdf",
+	"audio/mp3":                    "audio/mpeg",
+	"audio/wave":                   "audio/wav",
+	"audio/x-wav":                  "audio/wav",
+	"audio/vnd.wave":               "audio/wav",
+	"audio/x-aiff":                 "audio/aiff",
+	"video/x-msvideo":              "video/avi",
+}
+
+// 以zip 为容器的格式，按内容只能识别为application/zip
+var zipBasedTypes = []string{
+	"application/vnd.openxmlformats-",
+	"application/vnd.oasis.opendocument.",
+	"application/vnd.android.package-archive",
+	"application/java-archive",
+	"application/epub+zip",
+}
+
+// mp4 容器的音频文件按内容识别为video/mp4
+var mp4BasedTypes = []string{
+	"audio/mp4",
+	"audio/x-m4a",
+	"video/quicktime",
+}
+
+/**
+ * 选择路径前缀最长的规则，前缀相同时指定Uni-Source 的规则优先，没有匹配的规则时返回nil
+ */
+func MatchUploadPolicy(policies []UploadPolicy, path string,
+	uniSource string) *UploadPolicy {
+	var matched *UploadPolicy
+	for i := range policies {
+		p := &policies[i]
+		if !strings.HasPrefix(path, p.Prefix) ||
+			(p.UniSource != "" && p.UniSource != uniSource) {
+			continue
+		}
+		if matched == nil || len(p.Prefix) > len(matched.Prefix) ||
+			(len(p.Prefix) == len(matched.Prefix) &&
+				matched.UniSource == "" && p.UniSource != "") {
+			matched = p
+		}
+	}
+	return matched
+}
+
+func (p *UploadPolicy) AllowExtension(filename string) bool {
+	if len(p.Extensions) == 0 {
+		return true
+	}
+	ext := strings.ToLower(path.Ext(filename))
+	for _, e := range p.Extensions {
+		e = strings.ToLower(e)
+		if !strings.HasPrefix(e, ".") {
+			e = "." + e
+		}
+		if e == ext {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *UploadPolicy) AllowMimeType(mtype string) bool {
+	if len(p.MimeTypes) == 0 {
+		return true
+	}
+	mtype = normalizeContentType(mtype)
+	for _, t := range p.MimeTypes {
+		if strings.HasPrefix(mtype, strings.ToLower(t)) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * 判断按文件内容识别的类型（http.DetectContentType）与扩展名或声明的类型是否相符，
+ * 任一类型未知时认为相符
+ */
+func ContentTypeMatches(expected string, detected string) bool {
+	expected = normalizeContentType(expected)
+	detected = normalizeContentType(detected)
+	if IsGenericMimeType(expected) || IsGenericMimeType(detected) ||
+		expected == detected {
+		return true
+	}
+	switch detected {
+	case "application/zip":
+		return hasAnyPrefix(expected, zipBasedTypes)
+	case "video/mp4":
+		return hasAnyPrefix(expected, mp4BasedTypes)
+	case "text/plain":
+		return isTextContentType(expected)
+	case "text/xml":
+		return expected == "application/xml" || strings.HasSuffix(expected, "+xml")
+	case "text/html":
+		return expected == "application/xhtml+xml"
+	}
+	return false
+}
+
+// 去掉参数并统一大小写与别名
+func normalizeContentType(mtype string) string {
+	if mediaType, _, err := mime.ParseMediaType(mtype); err == nil {
+		mtype = mediaType
+	}
+	mtype = strings.ToLower(strings.TrimSpace(mtype))
+	if alias, ok := contentTypeAliases[mtype]; ok {
+		return alias
+	}
+	return mtype
+}
+
+func isTextContentType(mtype string) bool {
+	return strings.HasPrefix(mtype, "text/") ||
+		strings.HasSuffix(mtype, "+json") || strings.HasSuffix(mtype, "+xml") ||
+		mtype == "application/json" || mtype == "application/javascript" ||
+		mtype == "application/xml" || mtype == "application/x-sh" ||
+		mtype == "application/x-yaml" || mtype == "application/yaml"
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
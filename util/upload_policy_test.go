@@ -0,0 +1,95 @@
+package util
+
+import (
+	"testing"
+)
+
+func Test_MatchUploadPolicy(t *testing.T) {
+	policies := []UploadPolicy{
+		{Prefix: "/", MaxFileSize: 1},
+		{Prefix: "/app/", MaxFileSize: 2},
+		{Prefix: "/app/", UniSource: "mobile", MaxFileSize: 3},
+		{Prefix: "/app/avatar/", MaxFileSize: 4},
+		{Prefix: "/other/", UniSource: "web", MaxFileSize: 5},
+	}
+	cases := []struct {
+		path      string
+		uniSource string
+		expected  int64
+	}{
+		{"/app/a.jpg", "", 2},
+		{"/app/a.jpg", "mobile", 3},
+		{"/app/avatar/a.jpg", "mobile", 4},
+		{"/other/a.jpg", "mobile", 1},
+		{"/other/a.jpg", "web", 5},
+		{"/submit", "", 1},
+	}
+	for _, c := range cases {
+		p := MatchUploadPolicy(policies, c.path, c.uniSource)
+		if p == nil || p.MaxFileSize != c.expected {
+			t.Error("Test_MatchUploadPolicy: ", c.path, " ", c.uniSource, " -> ", p)
+		}
+	}
+	if MatchUploadPolicy(policies[1:], "/submit", "") != nil {
+		t.Error("Test_MatchUploadPolicy: /submit should not match")
+	}
+}
+
+func Test_UploadPolicyAllow(t *testing.T) {
+	p := &UploadPolicy{
+		Extensions: []string{".jpg", "PNG"},
+		MimeTypes:  []string{"image/", "application/pdf"},
+	}
+	for filename, expected := range map[string]bool{
+		"/a/b.JPG": true,
+		"c.png":    true,
+		"d.gif":    false,
+		"noext":    false,
+	} {
+		if p.AllowExtension(filename) != expected {
+			t.Error("Test_UploadPolicyAllow: extension ", filename)
+		}
+	}
+	for mtype, expected := range map[string]bool{
+		"image/png":                true,
+		"Image/JPEG":               true,
+		"application/pdf":          true,
+		"text/html; charset=utf-8": false,
+		"":                         false,
+	} {
+		if p.AllowMimeType(mtype) != expected {
+			t.Error("Test_UploadPolicyAllow: mime type ", mtype)
+		}
+	}
+	if !(&UploadPolicy{}).AllowExtension("a.exe") || !(&UploadPolicy{}).AllowMimeType("") {
+		t.Error("Test_UploadPolicyAllow: empty policy should allow everything")
+	}
+}
+
+func Test_ContentTypeMatches(t *testing.T) {
+	cases := []struct {
+		expected string
+		detected string
+		matches  bool
+	}{
+		{"image/jpeg", "image/jpeg", true},
+		{"image/jpg", "image/jpeg", true},
+		{"image/jpeg", "image/png", false},
+		{"image/jpeg", "text/html; charset=utf-8", false},
+		{"image/png", "text/plain; charset=utf-8", false},
+		{"", "text/html; charset=utf-8", true},
+		{"image/jpeg", "application/octet-stream", true},
+		{DefaultMimeTypes[".docx"], "application/zip", true},
+		{"application/pdf", "application/zip", false},
+		{"text/csv", "text/plain; charset=utf-8", true},
+		{"application/json", "text/plain; charset=utf-8", true},
+		{"image/svg+xml", "text/xml; charset=utf-8", true},
+		{"image/vnd.microsoft.icon", "image/x-icon", true},
+		{"audio/mp4", "video/mp4", true},
+	}
+	for _, c := range cases {
+		if ContentTypeMatches(c.expected, c.detected) != c.matches {
+			t.Error("Test_ContentTypeMatches: ", c.expected, " ", c.detected)
+		}
+	}
+}